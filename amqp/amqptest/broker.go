@@ -0,0 +1,416 @@
+// Package amqptest provides an in-memory fake of an AMQP broker for unit tests that run without RabbitMQ
+//
+// A Broker routes messages published by its Publishers to the queues of its Subscriptions, which implement the
+// amqp.Publisher and amqp.Subscriber interfaces, so that code depending on those interfaces can be tested without
+// Docker.
+package amqptest
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/syncromatics/go-kit/v2/amqp"
+)
+
+// TestingT is the subset of *testing.T used by the assertion helpers
+type TestingT interface {
+	Errorf(format string, args ...interface{})
+}
+
+// Broker is an in-memory stand-in for an AMQP broker. Like RabbitMQ, it routes messages by the type of the exchange
+// and the binding keys of queues, and it requeues messages that are nacked or left unacknowledged by a closed
+// subscription.
+type Broker struct {
+	mutex   sync.Mutex
+	changed chan struct{}
+
+	exchanges map[string]*exchange
+	queues    map[string]*queue
+	published []*published
+	retrying  int
+}
+
+type exchange struct {
+	kind     amqp.ExchangeKind
+	bindings []amqp.Binding
+}
+
+type queue struct {
+	name      string
+	ready     []*delivery
+	unacked   int
+	consumers int
+}
+
+type delivery struct {
+	exchangeName string
+	publishing   *amqp.Publishing
+}
+
+type published struct {
+	exchangeName string
+	publishing   *amqp.Publishing
+}
+
+// NewBroker creates a new Broker with no exchanges or queues
+func NewBroker() *Broker {
+	return &Broker{
+		changed:   make(chan struct{}),
+		exchanges: map[string]*exchange{},
+		queues:    map[string]*queue{},
+	}
+}
+
+// DeclareExchange declares an exchange of the given kind
+func (b *Broker) DeclareExchange(name string, kind amqp.ExchangeKind) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.declareExchange(name, kind)
+}
+
+// Apply declares the exchanges, queues and bindings of the topology
+func (b *Broker) Apply(topology *amqp.Topology) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.apply(topology)
+}
+
+func (b *Broker) apply(topology *amqp.Topology) error {
+	for _, exchange := range topology.Exchanges {
+		b.declareExchange(exchange.Name, exchange.Kind)
+	}
+
+	for _, queue := range topology.Queues {
+		b.declareQueue(queue.Name)
+	}
+
+	for _, binding := range topology.Bindings {
+		err := b.bind(binding)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (b *Broker) declareExchange(name string, kind amqp.ExchangeKind) {
+	if _, ok := b.exchanges[name]; ok {
+		return
+	}
+	b.exchanges[name] = &exchange{kind: kind}
+}
+
+func (b *Broker) declareQueue(name string) *queue {
+	q, ok := b.queues[name]
+	if !ok {
+		q = &queue{name: name}
+		b.queues[name] = q
+	}
+	return q
+}
+
+func (b *Broker) deleteQueue(name string) {
+	delete(b.queues, name)
+	for _, exchange := range b.exchanges {
+		bindings := exchange.bindings[:0]
+		for _, binding := range exchange.bindings {
+			if binding.Queue != name {
+				bindings = append(bindings, binding)
+			}
+		}
+		exchange.bindings = bindings
+	}
+	b.notify()
+}
+
+func (b *Broker) bind(binding amqp.Binding) error {
+	exchange, ok := b.exchanges[binding.Exchange]
+	if !ok {
+		return fmt.Errorf("exchange '%s' not found", binding.Exchange)
+	}
+	if _, ok := b.queues[binding.Queue]; !ok {
+		return fmt.Errorf("queue '%s' not found", binding.Queue)
+	}
+
+	for _, existing := range exchange.bindings {
+		if reflect.DeepEqual(existing, binding) {
+			return nil
+		}
+	}
+	exchange.bindings = append(exchange.bindings, binding)
+
+	return nil
+}
+
+// publish records the message and routes it to the matching queues, reporting whether any queue received it
+func (b *Broker) publish(exchangeName string, message *amqp.Publishing) (bool, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	message = copyPublishing(message)
+
+	queues, err := b.route(exchangeName, message)
+	if err != nil {
+		return false, err
+	}
+
+	b.published = append(b.published, &published{
+		exchangeName: exchangeName,
+		publishing:   message,
+	})
+
+	for _, q := range queues {
+		b.enqueue(q, &delivery{
+			exchangeName: exchangeName,
+			publishing:   message,
+		})
+	}
+
+	return len(queues) > 0, nil
+}
+
+func (b *Broker) route(exchangeName string, message *amqp.Publishing) ([]*queue, error) {
+	if exchangeName == "" {
+		// the default exchange routes directly to the queue named by the routing key
+		q, ok := b.queues[message.RoutingKey]
+		if !ok {
+			return nil, nil
+		}
+		return []*queue{q}, nil
+	}
+
+	exchange, ok := b.exchanges[exchangeName]
+	if !ok {
+		return nil, fmt.Errorf("exchange '%s' not found", exchangeName)
+	}
+
+	var queues []*queue
+	routed := map[string]bool{}
+	for _, binding := range exchange.bindings {
+		if routed[binding.Queue] || !matches(exchange.kind, binding, message) {
+			continue
+		}
+		routed[binding.Queue] = true
+		queues = append(queues, b.queues[binding.Queue])
+	}
+
+	return queues, nil
+}
+
+func (b *Broker) enqueue(q *queue, d *delivery) {
+	q.ready = append(q.ready, d)
+	b.notify()
+}
+
+// take removes the next ready message from the queue, unless the consumer is already at its prefetch limit. When
+// there is nothing to take, it returns a channel that is closed once something changes.
+func (b *Broker) take(q *queue, c *consumer) (*delivery, <-chan struct{}) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if len(q.ready) == 0 || (c.prefetch > 0 && c.unacked >= c.prefetch) {
+		return nil, b.changed
+	}
+
+	d := q.ready[0]
+	q.ready = q.ready[1:]
+	q.unacked++
+	c.unacked++
+
+	return d, nil
+}
+
+// notify wakes everything waiting for a change, and must be called while holding the mutex
+func (b *Broker) notify() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// Published returns the messages published to the exchange, in the order they were published
+func (b *Broker) Published(exchangeName string) []*amqp.Publishing {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	var messages []*amqp.Publishing
+	for _, p := range b.published {
+		if p.exchangeName == exchangeName {
+			messages = append(messages, p.publishing)
+		}
+	}
+	return messages
+}
+
+// Queued returns the messages in the queue that are waiting to be delivered
+func (b *Broker) Queued(queueName string) []*amqp.Publishing {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	q, ok := b.queues[queueName]
+	if !ok {
+		return nil
+	}
+
+	var messages []*amqp.Publishing
+	for _, d := range q.ready {
+		messages = append(messages, d.publishing)
+	}
+	return messages
+}
+
+// Unacknowledged returns the number of messages from the queue that have been delivered but not yet acknowledged
+func (b *Broker) Unacknowledged(queueName string) int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	q, ok := b.queues[queueName]
+	if !ok {
+		return 0
+	}
+	return q.unacked
+}
+
+// AssertPublished asserts that the given number of messages were published to the exchange
+func (b *Broker) AssertPublished(t TestingT, exchangeName string, count int) bool {
+	actual := len(b.Published(exchangeName))
+	if actual != count {
+		t.Errorf("expected %d messages to be published to exchange '%s' but %d were", count, exchangeName, actual)
+		return false
+	}
+	return true
+}
+
+// AssertPublishedWithRoutingKey asserts that the given number of messages were published to the exchange with the
+// routing key
+func (b *Broker) AssertPublishedWithRoutingKey(t TestingT, exchangeName string, routingKey string, count int) bool {
+	actual := 0
+	for _, message := range b.Published(exchangeName) {
+		if message.RoutingKey == routingKey {
+			actual++
+		}
+	}
+
+	if actual != count {
+		t.Errorf("expected %d messages to be published to exchange '%s' with routing key '%s' but %d were", count, exchangeName, routingKey, actual)
+		return false
+	}
+	return true
+}
+
+// AssertQueued asserts that the given number of messages are waiting in the queue
+func (b *Broker) AssertQueued(t TestingT, queueName string, count int) bool {
+	actual := len(b.Queued(queueName))
+	if actual != count {
+		t.Errorf("expected %d messages to be waiting in queue '%s' but %d are", count, queueName, actual)
+		return false
+	}
+	return true
+}
+
+// WaitForIdle blocks until every message routed to a queue with consumers has been acknowledged or refused, and no
+// retries are pending, or until the context ends
+func (b *Broker) WaitForIdle(ctx context.Context) error {
+	for {
+		b.mutex.Lock()
+		idle := b.retrying == 0
+		for _, q := range b.queues {
+			if q.unacked > 0 || (q.consumers > 0 && len(q.ready) > 0) {
+				idle = false
+			}
+		}
+		changed := b.changed
+		b.mutex.Unlock()
+
+		if idle {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func matches(kind amqp.ExchangeKind, binding amqp.Binding, message *amqp.Publishing) bool {
+	switch kind {
+	case amqp.ExchangeFanout:
+		return true
+	case amqp.ExchangeDirect:
+		return binding.Key == message.RoutingKey
+	case amqp.ExchangeTopic:
+		return topicMatches(strings.Split(binding.Key, "."), strings.Split(message.RoutingKey, "."))
+	case amqp.ExchangeHeaders:
+		return headersMatch(binding.Arguments, message.Headers)
+	default:
+		return false
+	}
+}
+
+// topicMatches matches the words of a routing key against a binding key, where * matches exactly one word and #
+// matches zero or more words
+func topicMatches(pattern []string, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(words); i++ {
+			if topicMatches(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(words) > 0 && topicMatches(pattern[1:], words[1:])
+	default:
+		return len(words) > 0 && words[0] == pattern[0] && topicMatches(pattern[1:], words[1:])
+	}
+}
+
+// headersMatch matches the headers of a message against the arguments of a binding, requiring every argument to
+// match unless x-match is "any"
+func headersMatch(arguments map[string]interface{}, headers map[string]interface{}) bool {
+	matchAny := arguments["x-match"] == "any"
+
+	for key, expected := range arguments {
+		if strings.HasPrefix(key, "x-") {
+			continue
+		}
+
+		actual, ok := headers[key]
+		matched := ok && reflect.DeepEqual(expected, actual)
+		if matchAny && matched {
+			return true
+		}
+		if !matchAny && !matched {
+			return false
+		}
+	}
+
+	return !matchAny
+}
+
+func copyPublishing(message *amqp.Publishing) *amqp.Publishing {
+	copied := *message
+
+	if message.Headers != nil {
+		copied.Headers = map[string]interface{}{}
+		for k, v := range message.Headers {
+			copied.Headers[k] = v
+		}
+	}
+
+	if message.Body != nil {
+		copied.Body = append([]byte{}, message.Body...)
+	}
+
+	return &copied
+}
@@ -0,0 +1,373 @@
+package amqptest_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/syncromatics/go-kit/v2/amqp"
+	"github.com/syncromatics/go-kit/v2/amqp/amqptest"
+)
+
+type recordingT struct {
+	errors []string
+}
+
+func (t *recordingT) Errorf(format string, args ...interface{}) {
+	t.errors = append(t.errors, fmt.Sprintf(format, args...))
+}
+
+func Test_Broker_RoutesByExchangeKind(t *testing.T) {
+	tests := []struct {
+		name       string
+		kind       amqp.ExchangeKind
+		binding    amqp.Binding
+		routingKey string
+		headers    map[string]interface{}
+		routed     bool
+	}{
+		{"fanout ignores routing key", amqp.ExchangeFanout, amqp.Binding{Key: "a"}, "b", nil, true},
+		{"direct matches equal key", amqp.ExchangeDirect, amqp.Binding{Key: "vehicles"}, "vehicles", nil, true},
+		{"direct rejects other key", amqp.ExchangeDirect, amqp.Binding{Key: "vehicles"}, "vehicles.position", nil, false},
+		{"topic star matches one word", amqp.ExchangeTopic, amqp.Binding{Key: "vehicles.*"}, "vehicles.position", nil, true},
+		{"topic star rejects two words", amqp.ExchangeTopic, amqp.Binding{Key: "vehicles.*"}, "vehicles.1.position", nil, false},
+		{"topic hash matches many words", amqp.ExchangeTopic, amqp.Binding{Key: "vehicles.#"}, "vehicles.1.position", nil, true},
+		{"topic hash matches no words", amqp.ExchangeTopic, amqp.Binding{Key: "vehicles.#"}, "vehicles", nil, true},
+		{"topic hash in the middle", amqp.ExchangeTopic, amqp.Binding{Key: "#.position"}, "vehicles.1.position", nil, true},
+		{"headers all", amqp.ExchangeHeaders, amqp.Binding{Arguments: map[string]interface{}{
+			"x-match": "all", "type": "Position", "fleet": "A",
+		}}, "", map[string]interface{}{"type": "Position", "fleet": "A"}, true},
+		{"headers all missing one", amqp.ExchangeHeaders, amqp.Binding{Arguments: map[string]interface{}{
+			"type": "Position", "fleet": "A",
+		}}, "", map[string]interface{}{"type": "Position"}, false},
+		{"headers any", amqp.ExchangeHeaders, amqp.Binding{Arguments: map[string]interface{}{
+			"x-match": "any", "type": "Position", "fleet": "A",
+		}}, "", map[string]interface{}{"fleet": "A"}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Arrange
+			broker := amqptest.NewBroker()
+			test.binding.Exchange = "exchange"
+			test.binding.Queue = "queue"
+			err := broker.Apply(&amqp.Topology{
+				Exchanges: []amqp.Exchange{{Name: "exchange", Kind: test.kind}},
+				Queues:    []amqp.Queue{{Name: "queue"}},
+				Bindings:  []amqp.Binding{test.binding},
+			})
+			assert.Nil(t, err)
+
+			publisher := broker.NewPublisher()
+
+			// Act
+			err = publisher.PublishMessage(context.Background(), "exchange", &amqp.Publishing{
+				RoutingKey: test.routingKey,
+				Headers:    test.headers,
+				Body:       []byte(`{}`),
+			})
+
+			// Assert
+			assert.Nil(t, err)
+			broker.AssertPublished(t, "exchange", 1)
+			if test.routed {
+				broker.AssertQueued(t, "queue", 1)
+			} else {
+				broker.AssertQueued(t, "queue", 0)
+			}
+		})
+	}
+}
+
+func Test_Broker_PublishToMissingExchangeFails(t *testing.T) {
+	// Arrange
+	broker := amqptest.NewBroker()
+	publisher := broker.NewPublisher()
+
+	// Act
+	err := publisher.PublishWithRoutingKey("missing", "key", []byte(`{}`))
+
+	// Assert
+	assert.NotNil(t, err)
+	broker.AssertPublished(t, "missing", 0)
+}
+
+func Test_Broker_MandatoryPublishIsUnroutable(t *testing.T) {
+	// Arrange
+	broker := amqptest.NewBroker()
+	publisher, err := broker.NewPublisherWithSettings(&amqp.PublisherSettings{
+		Confirm:   true,
+		Mandatory: true,
+		Topology: &amqp.Topology{
+			Exchanges: []amqp.Exchange{{Name: "exchange", Kind: amqp.ExchangeTopic}},
+		},
+	})
+	assert.Nil(t, err)
+
+	// Act
+	err = publisher.PublishWithRoutingKey("exchange", "nobody", []byte(`{}`))
+
+	// Assert
+	_, ok := err.(*amqp.UnroutableError)
+	assert.True(t, ok, "expected an unroutable error but got %v", err)
+}
+
+func Test_Broker_AssertionsReportFailures(t *testing.T) {
+	// Arrange
+	broker := amqptest.NewBroker()
+	broker.DeclareExchange("exchange", amqp.ExchangeTopic)
+	publisher := broker.NewPublisher()
+
+	err := publisher.PublishWithRoutingKey("exchange", "vehicles.position", []byte(`{}`))
+	assert.Nil(t, err)
+
+	recorder := &recordingT{}
+
+	// Act
+	published := broker.AssertPublished(recorder, "exchange", 2)
+	withRoutingKey := broker.AssertPublishedWithRoutingKey(recorder, "exchange", "vehicles.position", 1)
+
+	// Assert
+	assert.False(t, published)
+	assert.True(t, withRoutingKey)
+	assert.Equal(t, []string{"expected 2 messages to be published to exchange 'exchange' but 1 were"}, recorder.errors)
+}
+
+func Test_Subscription_AcknowledgesAndRequeues(t *testing.T) {
+	// Arrange
+	broker := amqptest.NewBroker()
+	broker.DeclareExchange("exchange", amqp.ExchangeTopic)
+
+	subscription := broker.NewSubscriptionWithSettings("exchange", &amqp.SubscriptionSettings{
+		QueueName:   "queue",
+		BindingKeys: []string{"vehicles.#"},
+	})
+	err := subscription.EnsureExchangeSubscriptionIsReady()
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	messages, err := subscription.Consume(ctx)
+	assert.Nil(t, err)
+
+	publisher := broker.NewPublisher()
+	err = publisher.PublishWithRoutingKey("exchange", "vehicles.position", []byte("first"))
+	assert.Nil(t, err)
+
+	// Act
+	first := <-messages
+	assert.Equal(t, 1, broker.Unacknowledged("queue"))
+	assert.Nil(t, first.Nack())
+
+	redelivered := <-messages
+	assert.Nil(t, redelivered.Ack())
+
+	// Assert
+	assert.Equal(t, "first", string(redelivered.Body))
+	assert.Equal(t, 0, broker.Unacknowledged("queue"))
+	assert.NotNil(t, redelivered.Ack())
+	broker.AssertQueued(t, "queue", 0)
+}
+
+func Test_Subscription_DeadLettersAfterRetries(t *testing.T) {
+	// Arrange
+	broker := amqptest.NewBroker()
+	broker.DeclareExchange("exchange", amqp.ExchangeFanout)
+
+	subscription := broker.NewSubscriptionWithSettings("exchange", &amqp.SubscriptionSettings{
+		QueueName: "queue",
+		DeadLetter: &amqp.DeadLetterSettings{
+			MaxRetries:  2,
+			RetryDelays: []time.Duration{10 * time.Millisecond},
+		},
+	})
+	err := subscription.EnsureExchangeSubscriptionIsReady()
+	assert.Nil(t, err)
+
+	attempts := make(chan struct{}, 10)
+	handler := func(ctx context.Context, message *amqp.Message) error {
+		attempts <- struct{}{}
+		return errors.New("failed")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go subscription.ConsumeWithHandler(ctx, handler, 1)
+
+	publisher := broker.NewPublisher()
+
+	// Act
+	err = publisher.PublishWithRoutingKey("exchange", "", []byte("poison"))
+	assert.Nil(t, err)
+
+	for i := 0; i < 3; i++ {
+		select {
+		case <-attempts:
+		case <-time.After(time.Second):
+			assert.Fail(t, "message was not retried in a timely manner")
+			return
+		}
+	}
+
+	waitCtx, waitCancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer waitCancel()
+	err = broker.WaitForIdle(waitCtx)
+
+	assert.Nil(t, err)
+	assert.Len(t, attempts, 0)
+
+	deadLetters := broker.Queued("queue.dead-letter")
+	if assert.Len(t, deadLetters, 1) {
+		assert.Equal(t, "poison", string(deadLetters[0].Body))
+		assert.Equal(t, int32(2), deadLetters[0].Headers[amqp.RetryCountHeader])
+	}
+}
+
+func Test_Subscription_RetriesKeepRoutingKey(t *testing.T) {
+	// Arrange
+	broker := amqptest.NewBroker()
+	broker.DeclareExchange("exchange", amqp.ExchangeTopic)
+
+	subscription := broker.NewSubscriptionWithSettings("exchange", &amqp.SubscriptionSettings{
+		QueueName: "queue",
+		DeadLetter: &amqp.DeadLetterSettings{
+			MaxRetries:  1,
+			RetryDelays: []time.Duration{10 * time.Millisecond},
+		},
+	})
+	err := subscription.EnsureExchangeSubscriptionIsReady()
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	messages, err := subscription.Consume(ctx)
+	assert.Nil(t, err)
+
+	publisher := broker.NewPublisher()
+	err = publisher.PublishWithRoutingKey("exchange", "vehicles.position", []byte(`{}`))
+	assert.Nil(t, err)
+
+	first := <-messages
+	err = first.Nack()
+	assert.Nil(t, err)
+
+	// Act
+	var retried *amqp.Message
+	select {
+	case retried = <-messages:
+	case <-time.After(time.Second):
+		assert.Fail(t, "message was not retried in a timely manner")
+		return
+	}
+
+	// Assert
+	assert.Equal(t, "vehicles.position", retried.RoutingKey)
+	assert.Equal(t, "vehicles.position", retried.Headers[amqp.RoutingKeyHeader])
+	assert.Nil(t, retried.Ack())
+}
+
+func Test_Subscription_DeadLetterRejectsTransientQueue(t *testing.T) {
+	// Arrange
+	broker := amqptest.NewBroker()
+	broker.DeclareExchange("exchange", amqp.ExchangeFanout)
+
+	subscription := broker.NewSubscriptionWithSettings("exchange", &amqp.SubscriptionSettings{
+		AutoDelete: true,
+		Exclusive:  true,
+		DeadLetter: &amqp.DeadLetterSettings{
+			MaxRetries: 1,
+		},
+	})
+
+	// Act
+	err := subscription.EnsureExchangeSubscriptionIsReady()
+
+	// Assert
+	assert.Equal(t, amqp.ErrDeadLetterOnTransientQueue, err)
+}
+
+func Test_Subscription_PrefetchLimitsUnacknowledgedMessages(t *testing.T) {
+	// Arrange
+	broker := amqptest.NewBroker()
+	broker.DeclareExchange("exchange", amqp.ExchangeFanout)
+
+	subscription := broker.NewSubscriptionWithSettings("exchange", &amqp.SubscriptionSettings{
+		QueueName:     "queue",
+		PrefetchCount: 1,
+	})
+	err := subscription.EnsureExchangeSubscriptionIsReady()
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	messages, err := subscription.Consume(ctx)
+	assert.Nil(t, err)
+
+	publisher := broker.NewPublisher()
+	for i := 0; i < 2; i++ {
+		err = publisher.PublishWithRoutingKey("exchange", "", []byte(fmt.Sprintf("%d", i)))
+		assert.Nil(t, err)
+	}
+
+	// Act
+	first := <-messages
+
+	// Assert
+	select {
+	case <-messages:
+		assert.Fail(t, "received a message beyond the prefetch limit")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	assert.Nil(t, first.Ack())
+
+	select {
+	case second := <-messages:
+		assert.Equal(t, "1", string(second.Body))
+	case <-time.After(time.Second):
+		assert.Fail(t, "did not receive the next message once the first was acknowledged")
+	}
+}
+
+func Test_Subscription_CloseRequeuesUnacknowledgedMessages(t *testing.T) {
+	// Arrange
+	broker := amqptest.NewBroker()
+	broker.DeclareExchange("exchange", amqp.ExchangeFanout)
+
+	subscription := broker.NewSubscriptionWithSettings("exchange", &amqp.SubscriptionSettings{
+		QueueName: "queue",
+		Durable:   true,
+	})
+	err := subscription.EnsureExchangeSubscriptionIsReady()
+	assert.Nil(t, err)
+
+	messages, err := subscription.Consume(context.Background())
+	assert.Nil(t, err)
+
+	publisher := broker.NewPublisher()
+	err = publisher.PublishWithRoutingKey("exchange", "", []byte("unacknowledged"))
+	assert.Nil(t, err)
+
+	message := <-messages
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	// Act
+	err = subscription.Close(ctx)
+
+	// Assert
+	assert.NotNil(t, err)
+	broker.AssertQueued(t, "queue", 1)
+	assert.NotNil(t, message.Ack())
+
+	_, err = subscription.Consume(context.Background())
+	assert.Equal(t, amqp.ErrClosed, err)
+}
@@ -0,0 +1,131 @@
+package amqptest
+
+import (
+	"context"
+	"sync"
+
+	"github.com/syncromatics/go-kit/v2/amqp"
+)
+
+// Publisher is an in-memory amqp.Publisher that publishes to a Broker
+type Publisher struct {
+	broker    *Broker
+	mandatory bool
+
+	mutex  sync.Mutex
+	closed bool
+}
+
+var _ amqp.Publisher = (*Publisher)(nil)
+
+// NewPublisher creates a new Publisher
+func (b *Broker) NewPublisher() *Publisher {
+	return &Publisher{
+		broker: b,
+	}
+}
+
+// NewPublisherWithSettings creates a new Publisher that declares the settings' topology and, when both Confirm and
+// Mandatory are set, returns an *amqp.UnroutableError for messages that are not routed to any queue. Other settings
+// are ignored.
+func (b *Broker) NewPublisherWithSettings(settings *amqp.PublisherSettings) (*Publisher, error) {
+	if settings.Topology != nil {
+		err := b.Apply(settings.Topology)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &Publisher{
+		broker:    b,
+		mandatory: settings.Confirm && settings.Mandatory,
+	}, nil
+}
+
+// EnsurePublisherIsReady always succeeds, since the broker is in memory
+func (p *Publisher) EnsurePublisherIsReady() error {
+	return nil
+}
+
+// Publish publishes a message to the given exchange
+func (p *Publisher) Publish(exchangeName string, headers map[string]string, body []byte) error {
+	return p.PublishContext(context.Background(), exchangeName, headers, body)
+}
+
+// PublishContext publishes a message to the given exchange
+func (p *Publisher) PublishContext(ctx context.Context, exchangeName string, headers map[string]string, body []byte) error {
+	headersTable := make(map[string]interface{})
+	for k, v := range headers {
+		headersTable[k] = v
+	}
+
+	return p.PublishMessage(ctx, exchangeName, &amqp.Publishing{
+		Headers: headersTable,
+		Body:    body,
+	})
+}
+
+// PublishWithRoutingKey publishes a message to the given exchange, with a routing key to specify the queue
+func (p *Publisher) PublishWithRoutingKey(exchangeName string, routingKey string, body []byte) error {
+	return p.PublishWithRoutingKeyContext(context.Background(), exchangeName, routingKey, body)
+}
+
+// PublishWithRoutingKeyContext publishes a message to the given exchange, with a routing key to specify the queue
+func (p *Publisher) PublishWithRoutingKeyContext(ctx context.Context, exchangeName string, routingKey string, body []byte) error {
+	return p.PublishMessage(ctx, exchangeName, &amqp.Publishing{
+		RoutingKey: routingKey,
+		Body:       body,
+	})
+}
+
+// PublishMessage publishes a message with all of its properties to the given exchange
+func (p *Publisher) PublishMessage(ctx context.Context, exchangeName string, message *amqp.Publishing) error {
+	p.mutex.Lock()
+	closed := p.closed
+	p.mutex.Unlock()
+
+	if closed {
+		return amqp.ErrClosed
+	}
+
+	routed, err := p.broker.publish(exchangeName, message)
+	if err != nil {
+		return err
+	}
+
+	if p.mandatory && !routed {
+		return &amqp.UnroutableError{
+			Exchange:   exchangeName,
+			RoutingKey: message.RoutingKey,
+			ReplyCode:  312,
+			ReplyText:  "NO_ROUTE",
+		}
+	}
+
+	return nil
+}
+
+// PublishValue encodes the value with the codec and publishes it to the given exchange
+func (p *Publisher) PublishValue(ctx context.Context, exchangeName string, routingKey string, codec amqp.Codec, value interface{}) error {
+	publishing, err := amqp.Encode(codec, routingKey, value)
+	if err != nil {
+		return err
+	}
+
+	return p.PublishMessage(ctx, exchangeName, publishing)
+}
+
+// Confirms always reports true, since messages are delivered to the in-memory broker before publishing returns
+func (p *Publisher) Confirms() bool {
+	return true
+}
+
+// Close stops the publisher from publishing any more messages
+func (p *Publisher) Close(ctx context.Context) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.closed = true
+
+	return nil
+}
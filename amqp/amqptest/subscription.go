@@ -0,0 +1,395 @@
+package amqptest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/syncromatics/go-kit/v2/amqp"
+)
+
+// Subscription is an in-memory amqp.Subscriber that consumes from a queue of a Broker
+//
+// Like amqp.ExchangeSubscription, nacked messages are requeued, or retried after a delay and then dead-lettered to
+// "<queue>.dead-letter" when dead-lettering is enabled, and rejected messages are dead-lettered or discarded.
+type Subscription struct {
+	broker       *Broker
+	exchangeName string
+	queueName    string
+	settings     amqp.SubscriptionSettings
+
+	// guarded by the broker's mutex
+	ready       bool
+	closed      bool
+	consumers   map[*consumer]context.CancelFunc
+	outstanding map[*delivery]*consumer
+}
+
+type consumer struct {
+	prefetch int
+	unacked  int
+}
+
+var _ amqp.Subscriber = (*Subscription)(nil)
+
+// NewSubscription creates a new Subscription with a transient queue that receives every message published to the
+// exchange
+func (b *Broker) NewSubscription(exchangeName string) *Subscription {
+	return b.NewSubscriptionWithSettings(exchangeName, &amqp.SubscriptionSettings{
+		AutoDelete: true,
+		Exclusive:  true,
+	})
+}
+
+// NewSubscriptionWithSettings creates a new Subscription with the given queue settings. Settings that only apply to a
+// real broker, such as reconnection, are ignored.
+func (b *Broker) NewSubscriptionWithSettings(exchangeName string, settings *amqp.SubscriptionSettings) *Subscription {
+	queueName := settings.QueueName
+	if queueName == "" {
+		queueName = fmt.Sprintf("%s.%s", exchangeName, uuid.New())
+	}
+
+	return &Subscription{
+		broker:       b,
+		exchangeName: exchangeName,
+		queueName:    queueName,
+		settings:     *settings,
+		consumers:    map[*consumer]context.CancelFunc{},
+		outstanding:  map[*delivery]*consumer{},
+	}
+}
+
+// EnsureExchangeSubscriptionIsReady declares the queue and binds it to the exchange, which must already exist
+func (s *Subscription) EnsureExchangeSubscriptionIsReady() error {
+	if s.settings.DeadLetter != nil && (s.settings.QueueName == "" || s.settings.AutoDelete || s.settings.Exclusive) {
+		return amqp.ErrDeadLetterOnTransientQueue
+	}
+
+	s.broker.mutex.Lock()
+	defer s.broker.mutex.Unlock()
+
+	if s.settings.Topology != nil {
+		err := s.broker.apply(s.settings.Topology)
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, ok := s.broker.exchanges[s.exchangeName]; !ok {
+		return fmt.Errorf("exchange '%s' not found", s.exchangeName)
+	}
+
+	s.broker.declareQueue(s.queueName)
+	if s.settings.DeadLetter != nil {
+		s.broker.declareQueue(s.deadLetterQueueName())
+	}
+
+	bindingKeys := s.settings.BindingKeys
+	if len(bindingKeys) == 0 {
+		bindingKeys = []string{"#"}
+	}
+
+	for _, bindingKey := range bindingKeys {
+		err := s.broker.bind(amqp.Binding{
+			Exchange: s.exchangeName,
+			Queue:    s.queueName,
+			Key:      bindingKey,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	s.ready = true
+
+	return nil
+}
+
+func (s *Subscription) deadLetterQueueName() string {
+	return fmt.Sprintf("%s.dead-letter", s.queueName)
+}
+
+// Consume starts consuming messages
+//
+// Any messages that are not explicitly Acked or Nacked before the subscription is closed are requeued.
+func (s *Subscription) Consume(outerCtx context.Context) (<-chan *amqp.Message, error) {
+	s.broker.mutex.Lock()
+	if s.closed {
+		s.broker.mutex.Unlock()
+		return nil, amqp.ErrClosed
+	}
+	if !s.ready {
+		s.broker.mutex.Unlock()
+		return nil, amqp.ErrNotReady
+	}
+
+	q := s.broker.queues[s.queueName]
+	c := &consumer{prefetch: s.settings.PrefetchCount}
+	ctx, cancel := context.WithCancel(outerCtx)
+	s.consumers[c] = cancel
+	q.consumers++
+	s.broker.mutex.Unlock()
+
+	messages := make(chan *amqp.Message)
+	go func() {
+		defer func() {
+			s.broker.mutex.Lock()
+			delete(s.consumers, c)
+			q.consumers--
+			s.broker.notify()
+			s.broker.mutex.Unlock()
+
+			close(messages)
+		}()
+
+		for {
+			d, changed := s.broker.take(q, c)
+			if d == nil {
+				select {
+				case <-changed:
+					continue
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			s.broker.mutex.Lock()
+			s.outstanding[d] = c
+			s.broker.mutex.Unlock()
+
+			select {
+			case messages <- s.newMessage(q, d):
+			case <-ctx.Done():
+				s.settle(q, d, func() {
+					s.requeue(q, d)
+				})
+				return
+			}
+		}
+	}()
+
+	return messages, nil
+}
+
+func (s *Subscription) newMessage(q *queue, d *delivery) *amqp.Message {
+	publishing := copyPublishing(d.publishing)
+
+	return &amqp.Message{
+		Exchange:      d.exchangeName,
+		RoutingKey:    publishing.RoutingKey,
+		Headers:       publishing.Headers,
+		ContentType:   publishing.ContentType,
+		CorrelationID: publishing.CorrelationID,
+		ReplyTo:       publishing.ReplyTo,
+		MessageID:     publishing.MessageID,
+		Body:          publishing.Body,
+		Ack: func() error {
+			return s.settle(q, d, func() {})
+		},
+		Nack: func() error {
+			return s.settle(q, d, func() {
+				if s.settings.DeadLetter == nil {
+					s.requeue(q, d)
+					return
+				}
+				s.retry(d)
+			})
+		},
+		NackWithoutRequeue: func() error {
+			return s.settle(q, d, func() {
+				s.deadLetter(d)
+			})
+		},
+		Reject: func() error {
+			return s.settle(q, d, func() {
+				s.deadLetter(d)
+			})
+		},
+	}
+}
+
+// settle finishes an outstanding delivery with the given outcome, which is called while holding the broker's mutex
+func (s *Subscription) settle(q *queue, d *delivery, outcome func()) error {
+	s.broker.mutex.Lock()
+	defer s.broker.mutex.Unlock()
+
+	c, ok := s.outstanding[d]
+	if !ok {
+		return errors.New("delivery has already been acknowledged or requeued")
+	}
+	delete(s.outstanding, d)
+	c.unacked--
+	q.unacked--
+
+	outcome()
+	s.broker.notify()
+
+	return nil
+}
+
+// requeue returns the delivery to the front of its queue, and must be called while holding the broker's mutex
+func (s *Subscription) requeue(q *queue, d *delivery) {
+	if _, ok := s.broker.queues[q.name]; !ok {
+		return
+	}
+	q.ready = append([]*delivery{d}, q.ready...)
+}
+
+// deadLetter moves the delivery to the dead-letter queue when dead-lettering is enabled, and must be called while
+// holding the broker's mutex
+func (s *Subscription) deadLetter(d *delivery) {
+	if s.settings.DeadLetter == nil {
+		return
+	}
+
+	q, ok := s.broker.queues[s.deadLetterQueueName()]
+	if !ok {
+		return
+	}
+	q.ready = append(q.ready, d)
+}
+
+// retry delivers the message again after the delay for its attempt, or dead-letters it once it has been retried too
+// many times, and must be called while holding the broker's mutex
+func (s *Subscription) retry(d *delivery) {
+	attempt := 0
+	if count, ok := d.publishing.Headers[amqp.RetryCountHeader].(int32); ok {
+		attempt = int(count)
+	}
+
+	if attempt >= s.settings.DeadLetter.MaxRetries {
+		s.deadLetter(d)
+		return
+	}
+
+	retried := copyPublishing(d.publishing)
+	if retried.Headers == nil {
+		retried.Headers = map[string]interface{}{}
+	}
+	retried.Headers[amqp.RetryCountHeader] = int32(attempt + 1)
+	if _, ok := retried.Headers[amqp.RoutingKeyHeader]; !ok {
+		retried.Headers[amqp.RoutingKeyHeader] = retried.RoutingKey
+	}
+
+	delays := s.settings.DeadLetter.RetryDelays
+	delay := 5 * time.Second
+	if len(delays) > attempt {
+		delay = delays[attempt]
+	} else if len(delays) > 0 {
+		delay = delays[len(delays)-1]
+	}
+
+	s.broker.retrying++
+	time.AfterFunc(delay, func() {
+		s.broker.mutex.Lock()
+		defer s.broker.mutex.Unlock()
+
+		s.broker.retrying--
+		if q, ok := s.broker.queues[s.queueName]; ok {
+			s.broker.enqueue(q, &delivery{
+				exchangeName: d.exchangeName,
+				publishing:   retried,
+			})
+			return
+		}
+		s.broker.notify()
+	})
+}
+
+// ConsumeWithHandler consumes messages with the given number of concurrent workers, each passing messages to the
+// handler and acknowledging them according to its result, like amqp.ExchangeSubscription.ConsumeWithHandler
+func (s *Subscription) ConsumeWithHandler(ctx context.Context, handler amqp.MessageHandler, concurrency int) error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	messages, err := s.Consume(ctx)
+	if err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for message := range messages {
+				err := handler(ctx, message)
+				switch {
+				case err == nil:
+					message.Ack()
+				case amqp.IsPermanent(err):
+					message.Reject()
+				default:
+					message.Nack()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	return nil
+}
+
+// ExchangeName returns the name of the exchange
+func (s *Subscription) ExchangeName() string {
+	return s.exchangeName
+}
+
+// QueueName returns the name of the queue
+func (s *Subscription) QueueName() string {
+	return s.queueName
+}
+
+// Close stops every consumer and waits until the context ends for delivered messages to be acknowledged. Messages
+// that are still unacknowledged are then requeued, and the queue is deleted if it is auto-deleted or exclusive.
+func (s *Subscription) Close(ctx context.Context) error {
+	s.broker.mutex.Lock()
+	s.closed = true
+	for _, cancel := range s.consumers {
+		cancel()
+	}
+	s.broker.mutex.Unlock()
+
+	var drainErr error
+	for drainErr == nil {
+		s.broker.mutex.Lock()
+		drained := len(s.outstanding) == 0 && len(s.consumers) == 0
+		changed := s.broker.changed
+		s.broker.mutex.Unlock()
+
+		if drained {
+			break
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			drainErr = errors.Wrap(ctx.Err(), "timed out waiting for in-flight messages to be acknowledged")
+		}
+	}
+
+	s.broker.mutex.Lock()
+	defer s.broker.mutex.Unlock()
+
+	q := s.broker.queues[s.queueName]
+	for d, c := range s.outstanding {
+		delete(s.outstanding, d)
+		c.unacked--
+		if q != nil {
+			q.unacked--
+			s.requeue(q, d)
+		}
+	}
+
+	if s.settings.AutoDelete || s.settings.Exclusive {
+		s.broker.deleteQueue(s.queueName)
+	} else {
+		s.broker.notify()
+	}
+
+	return drainErr
+}
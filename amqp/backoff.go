@@ -0,0 +1,46 @@
+package amqp
+
+import (
+	"time"
+)
+
+const (
+	defaultBackoffInitialInterval = 500 * time.Millisecond
+	defaultBackoffMaxInterval     = 30 * time.Second
+	defaultBackoffMultiplier      = 2
+)
+
+// Backoff is an exponential backoff used between attempts to reconnect to the broker
+type Backoff struct {
+	// InitialInterval is how long to wait before the first reconnection attempt
+	InitialInterval time.Duration
+	// MaxInterval is the longest to wait between reconnection attempts
+	MaxInterval time.Duration
+	// Multiplier is applied to the interval after every failed attempt
+	Multiplier float64
+}
+
+func (b Backoff) withDefaults() Backoff {
+	if b.InitialInterval <= 0 {
+		b.InitialInterval = defaultBackoffInitialInterval
+	}
+	if b.MaxInterval <= 0 {
+		b.MaxInterval = defaultBackoffMaxInterval
+	}
+	if b.Multiplier < 1 {
+		b.Multiplier = defaultBackoffMultiplier
+	}
+	return b
+}
+
+// interval returns how long to wait before the given zero-based attempt
+func (b Backoff) interval(attempt int) time.Duration {
+	interval := float64(b.InitialInterval)
+	for i := 0; i < attempt; i++ {
+		interval *= b.Multiplier
+		if interval >= float64(b.MaxInterval) {
+			return b.MaxInterval
+		}
+	}
+	return time.Duration(interval)
+}
@@ -0,0 +1,120 @@
+package amqp
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/streadway/amqp"
+)
+
+// channelPool is a bounded set of long-lived channels shared by concurrent publishers
+type channelPool struct {
+	connection *connectionManager
+	confirm    bool
+	metrics    *metrics
+
+	idle  chan *publisherChannel
+	slots chan struct{}
+}
+
+func newChannelPool(connection *connectionManager, size int, confirm bool, metrics *metrics) *channelPool {
+	return &channelPool{
+		connection: connection,
+		confirm:    confirm,
+		metrics:    metrics,
+
+		idle:  make(chan *publisherChannel, size),
+		slots: make(chan struct{}, size),
+	}
+}
+
+// acquire takes exclusive use of a channel, waiting for one to be released if the pool is exhausted
+func (cp *channelPool) acquire(ctx context.Context) (*publisherChannel, error) {
+	start := time.Now()
+	select {
+	case cp.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, errors.Wrap(ctx.Err(), "timed out waiting for a channel from the pool")
+	}
+	cp.metrics.publisherChannelWait.Observe(time.Since(start).Seconds())
+	cp.metrics.publisherChannelsInUse.Inc()
+
+	for {
+		connection, err := cp.connection.get(ctx)
+		if err != nil {
+			cp.releaseSlot()
+			return nil, err
+		}
+
+		pc, err := cp.take(connection)
+		if errors.Cause(err) == amqp.ErrClosed {
+			// the connection dropped underneath us, so wait for it to be replaced and try again
+			cp.connection.invalidate(connection, err)
+			continue
+		}
+		if err != nil {
+			cp.releaseSlot()
+			return nil, err
+		}
+
+		return pc, nil
+	}
+}
+
+// take reuses an idle channel on the given connection or opens a new one
+func (cp *channelPool) take(connection *amqp.Connection) (*publisherChannel, error) {
+	for {
+		select {
+		case pc := <-cp.idle:
+			if pc.connection == connection && !pc.isClosed() {
+				return pc, nil
+			}
+			cp.closeChannel(pc)
+			continue
+		default:
+		}
+
+		pc, err := openPublisherChannel(connection, cp.confirm)
+		if err != nil {
+			return nil, err
+		}
+		cp.metrics.publisherChannels.Inc()
+
+		return pc, nil
+	}
+}
+
+// release returns a healthy channel to the pool
+func (cp *channelPool) release(pc *publisherChannel) {
+	cp.idle <- pc
+	cp.releaseSlot()
+}
+
+// discard closes a channel that can no longer be trusted instead of returning it to the pool
+func (cp *channelPool) discard(pc *publisherChannel) {
+	cp.closeChannel(pc)
+	cp.releaseSlot()
+}
+
+func (cp *channelPool) releaseSlot() {
+	cp.metrics.publisherChannelsInUse.Dec()
+	<-cp.slots
+}
+
+func (cp *channelPool) closeChannel(pc *publisherChannel) {
+	pc.close()
+	cp.metrics.publisherChannels.Dec()
+}
+
+// close closes every idle channel
+func (cp *channelPool) close() {
+	for {
+		select {
+		case pc := <-cp.idle:
+			cp.closeChannel(pc)
+		default:
+			return
+		}
+	}
+}
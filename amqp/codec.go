@@ -0,0 +1,179 @@
+package amqp
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+)
+
+// MessageTypeHeader is the header that names the type of a message encoded with a Codec
+const MessageTypeHeader = "message-type"
+
+// Codec encodes message values to and from the bodies of AMQP messages
+type Codec interface {
+	// ContentType is the MIME type of the encoded bodies
+	ContentType() string
+	// Marshal encodes the value
+	Marshal(value interface{}) ([]byte, error)
+	// Unmarshal decodes the body into the value, which is a pointer to a new value of the registered type
+	Unmarshal(body []byte, value interface{}) error
+}
+
+var (
+	// ProtoCodec encodes protobuf messages with the protobuf wire format
+	ProtoCodec Codec = protoCodec{}
+	// JSONCodec encodes values as JSON
+	JSONCodec Codec = jsonCodec{}
+)
+
+type protoCodec struct{}
+
+func (protoCodec) ContentType() string {
+	return "application/x-protobuf"
+}
+
+func (protoCodec) Marshal(value interface{}) ([]byte, error) {
+	message, ok := value.(proto.Message)
+	if !ok {
+		return nil, errors.Errorf("%T is not a protobuf message", value)
+	}
+	return proto.Marshal(message)
+}
+
+func (protoCodec) Unmarshal(body []byte, value interface{}) error {
+	message, ok := value.(proto.Message)
+	if !ok {
+		return errors.Errorf("%T is not a protobuf message", value)
+	}
+	return proto.Unmarshal(body, message)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string {
+	return "application/json"
+}
+
+func (jsonCodec) Marshal(value interface{}) ([]byte, error) {
+	return json.Marshal(value)
+}
+
+func (jsonCodec) Unmarshal(body []byte, value interface{}) error {
+	return json.Unmarshal(body, value)
+}
+
+// MessageType is the name of the type of the value that is written to the message-type header. Protobuf messages are
+// named by their fully qualified protobuf name, and other values by their Go package and type name.
+func MessageType(value interface{}) string {
+	if message, ok := value.(proto.Message); ok {
+		if name := proto.MessageName(message); name != "" {
+			return name
+		}
+	}
+
+	t := reflect.TypeOf(value)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.String()
+}
+
+// Encode encodes the value into a publishing with the codec's content type and the value's message type
+func Encode(codec Codec, routingKey string, value interface{}) (*Publishing, error) {
+	body, err := codec.Marshal(value)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to encode %s", MessageType(value))
+	}
+
+	return &Publishing{
+		RoutingKey: routingKey,
+		Headers: map[string]interface{}{
+			MessageTypeHeader: MessageType(value),
+		},
+		ContentType: codec.ContentType(),
+		Body:        body,
+	}, nil
+}
+
+// PublishValue encodes the value with the codec and publishes it to the given exchange
+func (p *ExchangePublisher) PublishValue(ctx context.Context, exchangeName string, routingKey string, codec Codec, value interface{}) error {
+	publishing, err := Encode(codec, routingKey, value)
+	if err != nil {
+		return err
+	}
+
+	return p.PublishMessage(ctx, exchangeName, publishing)
+}
+
+// Decoder decodes delivered messages into the types registered for their message-type headers, using the codec that
+// matches their content type
+type Decoder struct {
+	codecs map[string]Codec
+	types  map[string]reflect.Type
+}
+
+// NewDecoder creates a new Decoder that accepts messages encoded by the given codecs
+func NewDecoder(codecs ...Codec) *Decoder {
+	d := &Decoder{
+		codecs: map[string]Codec{},
+		types:  map[string]reflect.Type{},
+	}
+
+	for _, codec := range codecs {
+		d.codecs[codec.ContentType()] = codec
+	}
+
+	return d
+}
+
+// Register registers the type of the value so that messages of its message type can be decoded. The value is
+// typically the zero value of the type, such as (*pb.VehiclePosition)(nil) or Position{}.
+func (d *Decoder) Register(value interface{}) {
+	t := reflect.TypeOf(value)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	d.types[MessageType(value)] = t
+}
+
+// Decode decodes the message into a pointer to a new value of its registered type
+func (d *Decoder) Decode(message *Message) (interface{}, error) {
+	codec, ok := d.codecs[message.ContentType]
+	if !ok {
+		return nil, errors.Errorf("no codec for content type '%s'", message.ContentType)
+	}
+
+	messageType, _ := message.Headers[MessageTypeHeader].(string)
+	t, ok := d.types[messageType]
+	if !ok {
+		return nil, errors.Errorf("message type '%s' is not registered", messageType)
+	}
+
+	value := reflect.New(t).Interface()
+	err := codec.Unmarshal(message.Body, value)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to decode %s", messageType)
+	}
+
+	return value, nil
+}
+
+// ValueHandler processes a message that has been decoded into a value of its registered type
+type ValueHandler func(ctx context.Context, message *Message, value interface{}) error
+
+// Handler creates a MessageHandler that decodes each message before passing it to the given handler. Messages that
+// cannot be decoded are rejected, so that they are dead-lettered if the queue has a dead-letter exchange.
+func (d *Decoder) Handler(handler ValueHandler) MessageHandler {
+	return func(ctx context.Context, message *Message) error {
+		value, err := d.Decode(message)
+		if err != nil {
+			return Permanent(err)
+		}
+
+		return handler(ctx, message, value)
+	}
+}
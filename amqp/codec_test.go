@@ -0,0 +1,174 @@
+package amqp_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/google/uuid"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	sut "github.com/syncromatics/go-kit/v2/amqp"
+)
+
+type position struct {
+	VehicleID int
+	Latitude  float64
+	Longitude float64
+}
+
+func Test_Codec_ProtoRoundTrip(t *testing.T) {
+	// Arrange
+	decoder := sut.NewDecoder(sut.ProtoCodec)
+	decoder.Register((*wrappers.StringValue)(nil))
+
+	publishing, err := sut.Encode(sut.ProtoCodec, "codec.proto", &wrappers.StringValue{Value: "hello"})
+	assert.Nil(t, err)
+
+	// Act
+	value, err := decoder.Decode(&sut.Message{
+		Headers:     publishing.Headers,
+		ContentType: publishing.ContentType,
+		Body:        publishing.Body,
+	})
+
+	// Assert
+	assert.Nil(t, err)
+	assert.Equal(t, "application/x-protobuf", publishing.ContentType)
+	assert.Equal(t, "google.protobuf.StringValue", publishing.Headers[sut.MessageTypeHeader])
+	assert.Equal(t, "hello", value.(*wrappers.StringValue).Value)
+}
+
+func Test_Codec_JSONRoundTrip(t *testing.T) {
+	// Arrange
+	decoder := sut.NewDecoder(sut.JSONCodec, sut.ProtoCodec)
+	decoder.Register(position{})
+
+	expected := &position{VehicleID: 1, Latitude: 34.1, Longitude: -118.2}
+	publishing, err := sut.Encode(sut.JSONCodec, "codec.json", expected)
+	assert.Nil(t, err)
+
+	// Act
+	value, err := decoder.Decode(&sut.Message{
+		Headers:     publishing.Headers,
+		ContentType: publishing.ContentType,
+		Body:        publishing.Body,
+	})
+
+	// Assert
+	assert.Nil(t, err)
+	assert.Equal(t, "application/json", publishing.ContentType)
+	assert.Equal(t, "amqp_test.position", publishing.Headers[sut.MessageTypeHeader])
+	assert.Equal(t, expected, value)
+}
+
+func Test_Codec_DecodeFailures(t *testing.T) {
+	decoder := sut.NewDecoder(sut.JSONCodec)
+	decoder.Register(position{})
+
+	tests := []struct {
+		name    string
+		message *sut.Message
+	}{
+		{"unknown content type", &sut.Message{
+			Headers:     map[string]interface{}{sut.MessageTypeHeader: "amqp_test.position"},
+			ContentType: "text/plain",
+			Body:        []byte(`{}`),
+		}},
+		{"missing message type", &sut.Message{
+			ContentType: "application/json",
+			Body:        []byte(`{}`),
+		}},
+		{"unregistered message type", &sut.Message{
+			Headers:     map[string]interface{}{sut.MessageTypeHeader: "amqp_test.unknown"},
+			ContentType: "application/json",
+			Body:        []byte(`{}`),
+		}},
+		{"malformed body", &sut.Message{
+			Headers:     map[string]interface{}{sut.MessageTypeHeader: "amqp_test.position"},
+			ContentType: "application/json",
+			Body:        []byte(`{`),
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Act
+			value, err := decoder.Decode(test.message)
+
+			// Assert
+			assert.NotNil(t, err)
+			assert.Nil(t, value)
+		})
+	}
+}
+
+func Test_Codec_HandlerRejectsUndecodableMessages(t *testing.T) {
+	// Arrange
+	conn, err := amqp.Dial(amqpURL)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	channel, err := conn.Channel()
+	assert.Nil(t, err)
+	defer channel.Close()
+
+	settings := &sut.SubscriptionSettings{
+		QueueName:   fmt.Sprintf("test.codec.%s", uuid.NewString()),
+		BindingKeys: []string{"codec.#"},
+		DeadLetter:  &sut.DeadLetterSettings{},
+	}
+	defer channel.QueueDelete(settings.QueueName, false, false, false)
+	defer channel.QueueDelete(settings.QueueName+".dead-letter", false, false, false)
+	defer channel.QueueDelete(settings.QueueName+".retry.5s", false, false, false)
+	defer channel.ExchangeDelete(settings.QueueName+".dead-letter", false, false)
+
+	exchangeSubscription := sut.NewExchangeSubscriptionWithSettings(amqpURL, EXCHANGE_NAME, settings)
+	err = exchangeSubscription.EnsureExchangeSubscriptionIsReady()
+	assert.Nil(t, err)
+
+	publisher := sut.NewExchangePublisher(amqpURL)
+	err = publisher.EnsurePublisherIsReady()
+	assert.Nil(t, err)
+
+	decoder := sut.NewDecoder(sut.JSONCodec)
+	decoder.Register(position{})
+
+	decoded := make(chan *position, 1)
+	handler := decoder.Handler(func(ctx context.Context, message *sut.Message, value interface{}) error {
+		decoded <- value.(*position)
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go exchangeSubscription.ConsumeWithHandler(ctx, handler, 1)
+
+	// Act
+	err = publisher.PublishValue(context.Background(), EXCHANGE_NAME, "codec.position", sut.JSONCodec, &position{VehicleID: 5})
+	assert.Nil(t, err)
+
+	err = publisher.PublishWithRoutingKey(EXCHANGE_NAME, "codec.raw", []byte(`not json`))
+	assert.Nil(t, err)
+
+	// Assert
+	select {
+	case value := <-decoded:
+		assert.Equal(t, 5, value.VehicleID)
+	case <-time.After(3 * time.Second):
+		assert.Fail(t, "did not decode message in a timely manner")
+	}
+
+	deadLetters, err := channel.Consume(settings.QueueName+".dead-letter", uuid.NewString(), true, false, false, false, nil)
+	assert.Nil(t, err)
+
+	select {
+	case deadLetter := <-deadLetters:
+		assert.Equal(t, "not json", string(deadLetter.Body))
+	case <-time.After(3 * time.Second):
+		assert.Fail(t, "undecodable message was not rejected in a timely manner")
+	}
+}
@@ -0,0 +1,237 @@
+package amqp
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/streadway/amqp"
+	"github.com/syncromatics/go-kit/v2/log"
+)
+
+var (
+	// ErrNotReady is returned when the connection to the broker has not been established yet
+	ErrNotReady = errors.New("connection to broker has not been established")
+	// ErrConnectionLost is returned when the connection to the broker was lost and is not being re-established
+	ErrConnectionLost = errors.New("connection to broker was lost")
+	// ErrClosed is returned when the connection to the broker has been intentionally closed
+	ErrClosed = errors.New("connection to broker is closed")
+)
+
+// connectionManager owns a connection to the broker and, if reconnecting, replaces it whenever it is lost
+type connectionManager struct {
+	amqpURL   string
+	client    string
+	reconnect bool
+	backoff   Backoff
+	metrics   *metrics
+
+	// onConnect is called with every new connection before it is handed out, such as to declare topology. If it
+	// fails, the connection is closed and treated as a failed attempt.
+	onConnect func(*amqp.Connection) error
+
+	mutex      sync.Mutex
+	connection *amqp.Connection
+	started    bool
+	lost       bool
+	closed     bool
+	ready      chan struct{}
+	done       chan struct{}
+}
+
+func newConnectionManager(amqpURL string, client string, reconnect bool, backoff Backoff, metrics *metrics) *connectionManager {
+	return &connectionManager{
+		amqpURL:   amqpURL,
+		client:    client,
+		reconnect: reconnect,
+		backoff:   backoff.withDefaults(),
+		metrics:   metrics,
+
+		ready: make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+}
+
+// dial opens a new connection and prepares it with the onConnect callback
+func (cm *connectionManager) dial() (*amqp.Connection, error) {
+	connection, err := amqp.Dial(cm.amqpURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to connect to broker")
+	}
+
+	if cm.onConnect != nil {
+		err = cm.onConnect(connection)
+		if err != nil {
+			connection.Close()
+			return nil, err
+		}
+	}
+
+	return connection, nil
+}
+
+// connect establishes the initial connection to the broker
+func (cm *connectionManager) connect() error {
+	connection, err := cm.dial()
+	if err != nil {
+		return err
+	}
+
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	if cm.closed {
+		connection.Close()
+		return ErrClosed
+	}
+
+	if cm.connection != nil {
+		cm.connection.Close()
+	}
+
+	cm.started = true
+	cm.lost = false
+	cm.setConnection(connection)
+
+	return nil
+}
+
+// setConnection must be called while holding the mutex
+func (cm *connectionManager) setConnection(connection *amqp.Connection) {
+	cm.connection = connection
+	select {
+	case <-cm.ready:
+	default:
+		close(cm.ready)
+	}
+
+	go cm.watch(connection)
+}
+
+func (cm *connectionManager) watch(connection *amqp.Connection) {
+	err := <-connection.NotifyClose(make(chan *amqp.Error, 1))
+	cm.invalidate(connection, err)
+}
+
+// invalidate marks the given connection as lost and starts reconnecting, unless it has already been replaced
+func (cm *connectionManager) invalidate(connection *amqp.Connection, reason error) {
+	cm.mutex.Lock()
+	if cm.closed || cm.connection != connection {
+		cm.mutex.Unlock()
+		return
+	}
+	cm.connection = nil
+	cm.lost = !cm.reconnect
+	cm.ready = make(chan struct{})
+	cm.mutex.Unlock()
+
+	log.Warn("lost connection to broker",
+		"err", reason,
+		"client", cm.client,
+	)
+	cm.metrics.connectionOutages.WithLabelValues(cm.client).Inc()
+
+	if cm.reconnect {
+		go cm.redial()
+	}
+}
+
+func (cm *connectionManager) redial() {
+	for attempt := 0; ; attempt++ {
+		select {
+		case <-time.After(cm.backoff.interval(attempt)):
+		case <-cm.done:
+			return
+		}
+
+		cm.metrics.reconnectAttempts.WithLabelValues(cm.client).Inc()
+
+		connection, err := cm.dial()
+		if err != nil {
+			log.Warn("failed to reconnect to broker",
+				"err", err,
+				"client", cm.client,
+				"attempt", attempt+1,
+			)
+			continue
+		}
+
+		cm.mutex.Lock()
+		if cm.closed || cm.connection != nil {
+			// the connection was closed or re-established elsewhere while dialing
+			cm.mutex.Unlock()
+			connection.Close()
+			return
+		}
+		cm.setConnection(connection)
+		cm.mutex.Unlock()
+
+		log.Info("reconnected to broker",
+			"client", cm.client,
+			"attempt", attempt+1,
+		)
+		return
+	}
+}
+
+// get returns the current connection, waiting for a reconnection if the connection has been lost
+func (cm *connectionManager) get(ctx context.Context) (*amqp.Connection, error) {
+	for {
+		cm.mutex.Lock()
+		connection, ready, started, lost, closed := cm.connection, cm.ready, cm.started, cm.lost, cm.closed
+		cm.mutex.Unlock()
+
+		switch {
+		case closed:
+			return nil, ErrClosed
+		case !started:
+			return nil, ErrNotReady
+		case lost:
+			return nil, ErrConnectionLost
+		case connection != nil:
+			return connection, nil
+		}
+
+		select {
+		case <-ready:
+		case <-cm.done:
+			return nil, ErrClosed
+		case <-ctx.Done():
+			return nil, errors.Wrap(ctx.Err(), "timed out waiting for connection to broker")
+		}
+	}
+}
+
+// isConnected reports whether there is currently a usable connection
+func (cm *connectionManager) isConnected() bool {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	return cm.connection != nil
+}
+
+// close stops reconnecting and closes the current connection
+func (cm *connectionManager) close() error {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	if cm.closed {
+		return nil
+	}
+	cm.closed = true
+	close(cm.done)
+
+	connection := cm.connection
+	cm.connection = nil
+	if connection == nil {
+		return nil
+	}
+
+	err := connection.Close()
+	if err != nil && err != amqp.ErrClosed {
+		return errors.Wrap(err, "failed to close connection to broker")
+	}
+
+	return nil
+}
@@ -0,0 +1,186 @@
+package amqp
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/streadway/amqp"
+)
+
+const (
+	// RetryCountHeader is the header in which the number of times a message has been retried is tracked
+	RetryCountHeader = "retry-count"
+	// RoutingKeyHeader is the header in which the routing key that a retried message was originally published with
+	// is kept, since retrying routes the message to the subscription's queue by name
+	RoutingKeyHeader = "original-routing-key"
+
+	defaultRetryDelay = 5 * time.Second
+)
+
+// ErrDeadLetterOnTransientQueue is returned when dead-lettering is enabled for a queue that is generated, auto-deleted
+// or exclusive, since the dead-letter and retry queues would outlive it
+var ErrDeadLetterOnTransientQueue = errors.New("dead-lettering requires a named queue that is neither auto-deleted nor exclusive")
+
+// DeadLetterSettings enable delayed retries of failed messages, and dead-lettering of messages that are rejected or
+// that fail too many times
+//
+// When enabled, Nack republishes the message to a retry queue instead of requeueing it. Once the message expires from
+// the retry queue it is routed back to the subscription's queue. After MaxRetries attempts, Nack dead-letters the
+// message instead. Messages are held in a queue named "<queue>.dead-letter" once dead-lettered. Retried messages keep
+// the routing key that they were originally published with.
+//
+// The dead-letter and retry queues are not deleted along with the subscription's queue, so dead-lettering requires a
+// named queue that is neither auto-deleted nor exclusive.
+type DeadLetterSettings struct {
+	// MaxRetries is the number of times a message is retried before it is dead-lettered
+	MaxRetries int
+	// RetryDelays are how long to wait before each successive retry. The last delay is used for any further retries.
+	// Defaults to 5 seconds.
+	RetryDelays []time.Duration
+}
+
+// deadLetterTopology is the set of exchanges and queues that support retrying and dead-lettering a queue's messages
+type deadLetterTopology struct {
+	queueName string
+	durable   bool
+	settings  DeadLetterSettings
+}
+
+func newDeadLetterTopology(queueName string, durable bool, settings DeadLetterSettings) *deadLetterTopology {
+	if len(settings.RetryDelays) == 0 {
+		settings.RetryDelays = []time.Duration{defaultRetryDelay}
+	}
+
+	return &deadLetterTopology{
+		queueName: queueName,
+		durable:   durable,
+		settings:  settings,
+	}
+}
+
+func (t *deadLetterTopology) exchangeName() string {
+	return fmt.Sprintf("%s.dead-letter", t.queueName)
+}
+
+func (t *deadLetterTopology) deadLetterQueueName() string {
+	return fmt.Sprintf("%s.dead-letter", t.queueName)
+}
+
+func (t *deadLetterTopology) retryQueueName(delay time.Duration) string {
+	return fmt.Sprintf("%s.retry.%s", t.queueName, delay)
+}
+
+func (t *deadLetterTopology) retryDelay(attempt int) time.Duration {
+	if attempt >= len(t.settings.RetryDelays) {
+		return t.settings.RetryDelays[len(t.settings.RetryDelays)-1]
+	}
+	return t.settings.RetryDelays[attempt]
+}
+
+// queueArguments adds the dead-letter exchange to the arguments of the subscription's queue
+func (t *deadLetterTopology) queueArguments(arguments map[string]interface{}) amqp.Table {
+	table := amqp.Table{}
+	for k, v := range arguments {
+		table[k] = v
+	}
+	table["x-dead-letter-exchange"] = t.exchangeName()
+
+	return table
+}
+
+// declare declares the dead-letter exchange and queue, and a retry queue for each delay. The retry queues dead-letter
+// expired messages back to the subscription's queue through the default exchange.
+func (t *deadLetterTopology) declare(channel *amqp.Channel) error {
+	err := channel.ExchangeDeclare(t.exchangeName(), amqp.ExchangeFanout, t.durable, false, false, false, nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to declare dead-letter exchange")
+	}
+
+	_, err = channel.QueueDeclare(t.deadLetterQueueName(), t.durable, false, false, false, nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to declare dead-letter queue")
+	}
+
+	err = channel.QueueBind(t.deadLetterQueueName(), "", t.exchangeName(), false, nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to bind dead-letter queue to dead-letter exchange")
+	}
+
+	for _, delay := range t.settings.RetryDelays {
+		_, err = channel.QueueDeclare(t.retryQueueName(delay), t.durable, false, false, false, amqp.Table{
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": t.queueName,
+		})
+		if err != nil {
+			return errors.Wrapf(err, "failed to declare retry queue for delay %s", delay)
+		}
+	}
+
+	return nil
+}
+
+// retry republishes the delivery to the retry queue for its next attempt, or dead-letters it once it has been retried
+// too many times. It reports whether the message was dead-lettered.
+func (t *deadLetterTopology) retry(channel *amqp.Channel, delivery amqp.Delivery) (bool, error) {
+	attempt := retryCount(delivery.Headers)
+	if attempt >= t.settings.MaxRetries {
+		return true, delivery.Reject(false)
+	}
+
+	headers := amqp.Table{}
+	for k, v := range delivery.Headers {
+		headers[k] = v
+	}
+	headers[RetryCountHeader] = int32(attempt + 1)
+	if _, ok := headers[RoutingKeyHeader]; !ok {
+		headers[RoutingKeyHeader] = delivery.RoutingKey
+	}
+
+	delay := t.retryDelay(attempt)
+	err := channel.Publish("", t.retryQueueName(delay), false, false, amqp.Publishing{
+		Headers:         headers,
+		ContentType:     delivery.ContentType,
+		ContentEncoding: delivery.ContentEncoding,
+		DeliveryMode:    delivery.DeliveryMode,
+		Priority:        delivery.Priority,
+		CorrelationId:   delivery.CorrelationId,
+		ReplyTo:         delivery.ReplyTo,
+		MessageId:       delivery.MessageId,
+		Timestamp:       delivery.Timestamp,
+		Type:            delivery.Type,
+		AppId:           delivery.AppId,
+		Expiration:      strconv.FormatInt(int64(delay/time.Millisecond), 10),
+		Body:            delivery.Body,
+	})
+	if err != nil {
+		return false, errors.Wrap(err, "failed to publish message to retry queue")
+	}
+
+	return false, delivery.Ack(false)
+}
+
+// retryCount is the number of times a message has already been retried
+func retryCount(headers amqp.Table) int {
+	switch count := headers[RetryCountHeader].(type) {
+	case int32:
+		return int(count)
+	case int64:
+		return int(count)
+	case int16:
+		return int(count)
+	case int8:
+		return int(count)
+	default:
+		return 0
+	}
+}
+
+// routingKey is the routing key that a delivery was originally published with, before any retries
+func routingKey(delivery amqp.Delivery) string {
+	if key, ok := delivery.Headers[RoutingKeyHeader].(string); ok {
+		return key
+	}
+	return delivery.RoutingKey
+}
@@ -0,0 +1,152 @@
+package amqp
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	goredis "github.com/go-redis/redis"
+	"github.com/pkg/errors"
+	"github.com/syncromatics/go-kit/v2/log"
+)
+
+// DeduplicationStore records the IDs of messages that have been processed
+type DeduplicationStore interface {
+	// Reserve atomically records the ID until the TTL has passed, unless it is already recorded, and reports whether
+	// it was reserved by this call
+	Reserve(ctx context.Context, id string, ttl time.Duration) (bool, error)
+	// Release removes the ID, so that the message is processed again when it is redelivered
+	Release(ctx context.Context, id string) error
+}
+
+// Deduplicate creates middleware that skips messages whose IDs were recorded in the store within the TTL, so that a
+// message redelivered after a nack or a reconnect is only processed once. Skipped messages are acknowledged.
+//
+// The ID of a message is reserved before the handler is called, so that concurrent copies of a message are not
+// processed at the same time, and released if the handler fails so that the message is processed again. If the
+// process stops while handling a message, its redelivery is skipped until the TTL has passed. Messages published
+// without a message ID are always processed.
+func (es *ExchangeSubscription) Deduplicate(store DeduplicationStore, ttl time.Duration) MessageMiddleware {
+	hits := es.metrics.deduplicationHits.WithLabelValues(es.exchangeName)
+	misses := es.metrics.deduplicationMisses.WithLabelValues(es.exchangeName)
+
+	return func(next MessageHandler) MessageHandler {
+		return func(ctx context.Context, message *Message) error {
+			if message.MessageID == "" {
+				return next(ctx, message)
+			}
+
+			reserved, err := store.Reserve(ctx, message.MessageID, ttl)
+			if err != nil {
+				return errors.Wrap(err, "failed to reserve message id")
+			}
+			if !reserved {
+				hits.Inc()
+				log.Debug("skipping duplicate message",
+					"messageID", message.MessageID,
+					"queue", es.queueName,
+				)
+				return nil
+			}
+			misses.Inc()
+
+			err = next(ctx, message)
+			if err == nil {
+				return nil
+			}
+
+			// the handler failed, so the message must be processed when it is redelivered, even if this context has ended
+			releaseErr := store.Release(context.Background(), message.MessageID)
+			if releaseErr != nil {
+				log.Warn("failed to release message id, so its redelivery will be skipped",
+					"err", releaseErr,
+					"messageID", message.MessageID,
+					"queue", es.queueName,
+				)
+			}
+
+			return err
+		}
+	}
+}
+
+// MemoryDeduplicationStore is a DeduplicationStore held in memory, for subscriptions with a single consumer process
+type MemoryDeduplicationStore struct {
+	mutex     sync.Mutex
+	expiries  map[string]time.Time
+	lastSweep time.Time
+}
+
+// NewMemoryDeduplicationStore creates a new MemoryDeduplicationStore
+func NewMemoryDeduplicationStore() *MemoryDeduplicationStore {
+	return &MemoryDeduplicationStore{
+		expiries:  map[string]time.Time{},
+		lastSweep: time.Now(),
+	}
+}
+
+// Reserve records the ID until the TTL has passed, unless it is already recorded, and reports whether it was reserved
+func (s *MemoryDeduplicationStore) Reserve(ctx context.Context, id string, ttl time.Duration) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	if expiry, ok := s.expiries[id]; ok && now.Before(expiry) {
+		return false, nil
+	}
+	s.expiries[id] = now.Add(ttl)
+
+	// expired IDs are swept out periodically so that the store does not grow without bound
+	if now.Sub(s.lastSweep) >= ttl {
+		for id, expiry := range s.expiries {
+			if !now.Before(expiry) {
+				delete(s.expiries, id)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	return true, nil
+}
+
+// Release removes the ID
+func (s *MemoryDeduplicationStore) Release(ctx context.Context, id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.expiries, id)
+
+	return nil
+}
+
+// RedisDeduplicationStore is a DeduplicationStore held in Redis, which can be shared by every consumer of a queue
+type RedisDeduplicationStore struct {
+	client *goredis.Client
+	prefix string
+}
+
+// NewRedisDeduplicationStore creates a new RedisDeduplicationStore that records IDs under keys with the given prefix
+func NewRedisDeduplicationStore(client *goredis.Client, prefix string) *RedisDeduplicationStore {
+	return &RedisDeduplicationStore{
+		client: client,
+		prefix: prefix,
+	}
+}
+
+// Reserve records the ID until the TTL has passed, unless it is already recorded, and reports whether it was reserved
+func (s *RedisDeduplicationStore) Reserve(ctx context.Context, id string, ttl time.Duration) (bool, error) {
+	reserved, err := s.client.WithContext(ctx).SetNX(s.prefix+id, 1, ttl).Result()
+	if err != nil {
+		return false, errors.Wrap(err, "failed to reserve message id in redis")
+	}
+	return reserved, nil
+}
+
+// Release removes the ID
+func (s *RedisDeduplicationStore) Release(ctx context.Context, id string) error {
+	err := s.client.WithContext(ctx).Del(s.prefix + id).Err()
+	if err != nil {
+		return errors.Wrap(err, "failed to release message id in redis")
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+package amqp_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	goredis "github.com/go-redis/redis"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	sut "github.com/syncromatics/go-kit/v2/amqp"
+)
+
+func Test_DeduplicationStores_ReserveUntilExpired(t *testing.T) {
+	client := goredis.NewClient(redisOptions)
+	defer client.Close()
+
+	stores := map[string]sut.DeduplicationStore{
+		"memory": sut.NewMemoryDeduplicationStore(),
+		"redis":  sut.NewRedisDeduplicationStore(client, fmt.Sprintf("test.%s.", uuid.NewString())),
+	}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			// Arrange
+			ctx := context.Background()
+			id := uuid.NewString()
+
+			// Act
+			first, err := store.Reserve(ctx, id, 500*time.Millisecond)
+			assert.Nil(t, err)
+
+			second, err := store.Reserve(ctx, id, 500*time.Millisecond)
+			assert.Nil(t, err)
+
+			time.Sleep(time.Second)
+
+			expired, err := store.Reserve(ctx, id, 500*time.Millisecond)
+			assert.Nil(t, err)
+
+			// Assert
+			assert.True(t, first)
+			assert.False(t, second)
+			assert.True(t, expired)
+		})
+	}
+}
+
+func Test_DeduplicationStores_Release(t *testing.T) {
+	client := goredis.NewClient(redisOptions)
+	defer client.Close()
+
+	stores := map[string]sut.DeduplicationStore{
+		"memory": sut.NewMemoryDeduplicationStore(),
+		"redis":  sut.NewRedisDeduplicationStore(client, fmt.Sprintf("test.%s.", uuid.NewString())),
+	}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			// Arrange
+			ctx := context.Background()
+			id := uuid.NewString()
+
+			_, err := store.Reserve(ctx, id, time.Minute)
+			assert.Nil(t, err)
+
+			// Act
+			err = store.Release(ctx, id)
+
+			// Assert
+			assert.Nil(t, err)
+
+			reserved, err := store.Reserve(ctx, id, time.Minute)
+			assert.Nil(t, err)
+			assert.True(t, reserved)
+		})
+	}
+}
+
+func Test_Deduplicate_ProcessesConcurrentCopiesOnce(t *testing.T) {
+	// Arrange
+	exchangeSubscription := sut.NewExchangeSubscriptionWithSettings(amqpURL, EXCHANGE_NAME, &sut.SubscriptionSettings{
+		Registerer: prometheus.NewRegistry(),
+	})
+	defer exchangeSubscription.Close(context.Background())
+
+	var handled int32
+	release := make(chan struct{})
+	handler := exchangeSubscription.Deduplicate(sut.NewMemoryDeduplicationStore(), time.Minute)(
+		func(ctx context.Context, message *sut.Message) error {
+			atomic.AddInt32(&handled, 1)
+			<-release
+			return nil
+		})
+
+	messageID := uuid.NewString()
+	results := make(chan error, 2)
+
+	// Act
+	for i := 0; i < 2; i++ {
+		go func() {
+			results <- handler(context.Background(), &sut.Message{MessageID: messageID})
+		}()
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+
+	// Assert
+	for i := 0; i < 2; i++ {
+		assert.Nil(t, <-results)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&handled))
+}
+
+func Test_Deduplicate_ProcessesMessageAgainAfterFailure(t *testing.T) {
+	// Arrange
+	exchangeSubscription := sut.NewExchangeSubscriptionWithSettings(amqpURL, EXCHANGE_NAME, &sut.SubscriptionSettings{
+		Registerer: prometheus.NewRegistry(),
+	})
+	defer exchangeSubscription.Close(context.Background())
+
+	var handled int32
+	handler := exchangeSubscription.Deduplicate(sut.NewMemoryDeduplicationStore(), time.Minute)(
+		func(ctx context.Context, message *sut.Message) error {
+			if atomic.AddInt32(&handled, 1) == 1 {
+				return errors.New("database unavailable")
+			}
+			return nil
+		})
+
+	message := &sut.Message{MessageID: uuid.NewString()}
+
+	// Act
+	firstErr := handler(context.Background(), message)
+	secondErr := handler(context.Background(), message)
+
+	// Assert
+	assert.NotNil(t, firstErr)
+	assert.Nil(t, secondErr)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&handled))
+}
+
+func Test_Deduplicate_SkipsAndAcknowledgesDuplicates(t *testing.T) {
+	// Arrange
+	conn, err := amqp.Dial(amqpURL)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	channel, err := conn.Channel()
+	assert.Nil(t, err)
+	defer channel.Close()
+
+	registry := prometheus.NewRegistry()
+	settings := &sut.SubscriptionSettings{
+		QueueName:   fmt.Sprintf("test.dedup.%s", uuid.NewString()),
+		BindingKeys: []string{"dedup.#"},
+		Registerer:  registry,
+	}
+	defer channel.QueueDelete(settings.QueueName, false, false, false)
+
+	exchangeSubscription := sut.NewExchangeSubscriptionWithSettings(amqpURL, EXCHANGE_NAME, settings)
+	err = exchangeSubscription.EnsureExchangeSubscriptionIsReady()
+	assert.Nil(t, err)
+	defer exchangeSubscription.Close(context.Background())
+
+	var handled int32
+	deduplicate := exchangeSubscription.Deduplicate(sut.NewMemoryDeduplicationStore(), time.Minute)
+	handler := deduplicate(func(ctx context.Context, message *sut.Message) error {
+		atomic.AddInt32(&handled, 1)
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go exchangeSubscription.ConsumeWithHandler(ctx, handler, 1)
+
+	// Act
+	messageID := uuid.NewString()
+	for _, id := range []string{messageID, messageID, uuid.NewString()} {
+		err = channel.Publish(EXCHANGE_NAME, "dedup.job", false, false, amqp.Publishing{
+			MessageId: id,
+			Body:      []byte(`{}`),
+		})
+		assert.Nil(t, err)
+	}
+
+	// Assert
+	time.Sleep(500 * time.Millisecond)
+
+	assert.Equal(t, int32(2), atomic.LoadInt32(&handled))
+
+	inspected, err := channel.QueueInspect(settings.QueueName)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, inspected.Messages)
+
+	families, err := registry.Gather()
+	assert.Nil(t, err)
+
+	hits := findMetricFamily(families, "amqp_deduplication_hits_total")
+	if assert.NotNil(t, hits) {
+		assert.Equal(t, float64(1), hits.Metric[0].GetCounter().GetValue())
+	}
+
+	misses := findMetricFamily(families, "amqp_deduplication_misses_total")
+	if assert.NotNil(t, misses) {
+		assert.Equal(t, float64(2), misses.Metric[0].GetCounter().GetValue())
+	}
+}
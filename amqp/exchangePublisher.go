@@ -1,30 +1,126 @@
 package amqp
 
 import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/streadway/amqp"
+	"github.com/syncromatics/go-kit/v2/log"
 )
 
+// PublisherSettings are the settings for an ExchangePublisher
+type PublisherSettings struct {
+	// ReconnectBackoff controls how long to wait between attempts to reconnect after the connection is lost
+	ReconnectBackoff Backoff
+	// BufferSize is the number of messages held in memory while reconnecting to the broker.
+	// When zero, publishing blocks until the connection has been re-established. Buffered messages that fail to
+	// publish are retried with the ReconnectBackoff until they are published or the publisher is closed. In confirm
+	// mode, publishing still waits for the broker to acknowledge each buffered message, up to the ConfirmTimeout when
+	// the context has no deadline, and returns ErrClosed if the publisher is closed first. Otherwise, messages still
+	// buffered when Close gives up waiting for them are dropped and logged.
+	BufferSize int
+	// Confirm puts the publishing channel into confirm mode, so that publishing waits for the broker to acknowledge
+	// each message and returns a *NackError if the broker rejects it.
+	Confirm bool
+	// ConfirmTimeout is how long publishing waits for the broker to acknowledge a message. Defaults to 30 seconds.
+	ConfirmTimeout time.Duration
+	// Mandatory asks the broker to return messages that cannot be routed to any queue. In confirm mode these are
+	// reported as an *UnroutableError.
+	Mandatory bool
+	// ChannelPoolSize is the maximum number of long-lived channels shared by concurrent publishes. When zero, a
+	// channel is opened for every message, unless Confirm is set, in which case a single channel is shared.
+	ChannelPoolSize int
+	// Registerer is where the publisher's metrics are registered. Defaults to prometheus.DefaultRegisterer.
+	Registerer prometheus.Registerer
+	// Topology is declared on connect and on every reconnect, such as to declare the exchanges that are published to
+	Topology *Topology
+}
+
+const defaultConfirmTimeout = 30 * time.Second
+
 // ExchangePublisher is a service for publishing messages to an exchange
 type ExchangePublisher struct {
-	amqpURL string
+	connection     *connectionManager
+	confirm        bool
+	confirmTimeout time.Duration
+	mandatory      bool
+
+	pool           *channelPool
+	inFlight       *inFlight
+	metrics        *metrics
+	releaseMetrics sync.Once
+
+	buffer chan *pendingPublishing
+	// buffered counts the messages that have been buffered but not yet flushed, including the one being flushed
+	buffered int32
+	// bufferMutex is held for reading while adding to the buffer and for writing while emptying it on close, so that
+	// no message is buffered once the buffer has been emptied
+	bufferMutex  sync.RWMutex
+	bufferClosed bool
+}
 
-	connection *amqp.Connection
+type pendingPublishing struct {
+	exchangeName string
+	routingKey   string
+	publishing   amqp.Publishing
+	// result receives the outcome of publishing in confirm mode, so that the caller learns whether the broker
+	// acknowledged the message
+	result chan error
 }
 
 // NewExchangePublisher creates a Publisher
 func NewExchangePublisher(amqpURL string) *ExchangePublisher {
-	return &ExchangePublisher{
-		amqpURL: amqpURL,
+	return NewExchangePublisherWithSettings(amqpURL, &PublisherSettings{})
+}
+
+// NewExchangePublisherWithSettings creates a Publisher with the given settings
+func NewExchangePublisherWithSettings(amqpURL string, settings *PublisherSettings) *ExchangePublisher {
+	metrics := acquireMetrics(settings.Registerer)
+
+	publisher := &ExchangePublisher{
+		connection:     newConnectionManager(amqpURL, "publisher", true, settings.ReconnectBackoff, metrics),
+		inFlight:       newInFlight(),
+		metrics:        metrics,
+		confirm:        settings.Confirm,
+		confirmTimeout: settings.ConfirmTimeout,
+		mandatory:      settings.Mandatory,
+	}
+
+	if publisher.confirmTimeout <= 0 {
+		publisher.confirmTimeout = defaultConfirmTimeout
 	}
+
+	poolSize := settings.ChannelPoolSize
+	if poolSize == 0 && settings.Confirm {
+		poolSize = 1
+	}
+	if poolSize > 0 {
+		publisher.pool = newChannelPool(publisher.connection, poolSize, settings.Confirm, metrics)
+	}
+
+	if settings.BufferSize > 0 {
+		publisher.buffer = make(chan *pendingPublishing, settings.BufferSize)
+		go publisher.flushBuffer()
+	}
+
+	if settings.Topology != nil {
+		publisher.connection.onConnect = settings.Topology.declareOnConnection
+	}
+
+	return publisher
 }
 
 // EnsurePublisherIsReady ensures that the publisher is ready to send messages
+//
+// Once ready, the publisher reconnects to the broker whenever the connection is lost.
 func (p *ExchangePublisher) EnsurePublisherIsReady() error {
-	var err error
-	p.connection, err = amqp.Dial(p.amqpURL)
+	err := p.connection.connect()
 	if err != nil {
-		return errors.Wrap(err, "failed to connect to broker")
+		return err
 	}
 
 	return nil
@@ -32,41 +128,284 @@ func (p *ExchangePublisher) EnsurePublisherIsReady() error {
 
 // Publish publishes a message to the given exchange
 func (p *ExchangePublisher) Publish(exchangeName string, headers map[string]string, body []byte) error {
-	channel, err := p.connection.Channel()
-	if err != nil {
-		return errors.Wrap(err, "failed to open channel to broker")
-	}
-	defer channel.Close()
+	return p.PublishContext(context.Background(), exchangeName, headers, body)
+}
 
-	headersTable := make(amqp.Table)
+// PublishContext publishes a message to the given exchange, propagating the span in the context to consumers
+func (p *ExchangePublisher) PublishContext(ctx context.Context, exchangeName string, headers map[string]string, body []byte) error {
+	headersTable := make(map[string]interface{})
 	for k, v := range headers {
 		headersTable[k] = v
 	}
-	err = channel.Publish(exchangeName, "", false, false, amqp.Publishing{
+
+	return p.PublishMessage(ctx, exchangeName, &Publishing{
 		Headers: headersTable,
 		Body:    body,
 	})
-	if err != nil {
-		return errors.Wrap(err, "failed to publish message")
-	}
-
-	return nil
 }
 
 // PublishWithRoutingKey publishes a message to the given exchange, with a routing key to specify the queue
 func (p *ExchangePublisher) PublishWithRoutingKey(exchangeName string, routingKey string, body []byte) error {
-	channel, err := p.connection.Channel()
+	return p.PublishWithRoutingKeyContext(context.Background(), exchangeName, routingKey, body)
+}
+
+// PublishWithRoutingKeyContext publishes a message to the given exchange, with a routing key to specify the queue,
+// propagating the span in the context to consumers
+func (p *ExchangePublisher) PublishWithRoutingKeyContext(ctx context.Context, exchangeName string, routingKey string, body []byte) error {
+	return p.PublishMessage(ctx, exchangeName, &Publishing{
+		RoutingKey: routingKey,
+		Body:       body,
+	})
+}
+
+// PublishMessage publishes a message with all of its properties to the given exchange
+//
+// The context bounds how long publishing waits for the broker to become available and, in confirm mode, for the
+// broker to acknowledge the message. When the context has no deadline in confirm mode, the ConfirmTimeout is used.
+//
+// When the context carries an opentracing span, a child span is injected into the message headers so that the trace
+// continues in the consumers of the message.
+func (p *ExchangePublisher) PublishMessage(ctx context.Context, exchangeName string, message *Publishing) error {
+	if !p.inFlight.start() {
+		return ErrClosed
+	}
+
+	span, headers := startPublishSpan(ctx, exchangeName, message.Headers)
+
+	publishing := message.toAMQP()
+	publishing.Headers = amqp.Table(headers)
+
+	err := p.send(ctx, exchangeName, message.RoutingKey, publishing)
+	finishSpan(span, err)
+
+	return err
+}
+
+// send publishes the message, or buffers it while the broker is unavailable, and finishes its in-flight work once done
+func (p *ExchangePublisher) send(ctx context.Context, exchangeName string, routingKey string, publishing amqp.Publishing) error {
+	if p.buffer != nil && (atomic.LoadInt32(&p.buffered) > 0 || !p.connection.isConnected()) {
+		pending := &pendingPublishing{
+			exchangeName: exchangeName,
+			routingKey:   routingKey,
+			publishing:   publishing,
+		}
+		if p.confirm {
+			pending.result = make(chan error, 1)
+		}
+
+		err := p.enqueue(ctx, pending)
+		if err != nil || pending.result == nil {
+			return err
+		}
+
+		if _, ok := ctx.Deadline(); !ok {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, p.confirmTimeout)
+			defer cancel()
+		}
+
+		select {
+		case err := <-pending.result:
+			return err
+		case <-ctx.Done():
+			return errors.Wrap(ctx.Err(), "timed out waiting for buffered message to be confirmed")
+		}
+	}
+	defer p.inFlight.done()
+
+	return p.publish(ctx, exchangeName, routingKey, publishing)
+}
+
+// enqueue adds the message to the buffer, after which the flusher finishes its in-flight work
+func (p *ExchangePublisher) enqueue(ctx context.Context, pending *pendingPublishing) error {
+	p.bufferMutex.RLock()
+	defer p.bufferMutex.RUnlock()
+
+	if p.bufferClosed {
+		p.inFlight.done()
+		return ErrClosed
+	}
+
+	atomic.AddInt32(&p.buffered, 1)
+	select {
+	case p.buffer <- pending:
+		return nil
+	case <-ctx.Done():
+		atomic.AddInt32(&p.buffered, -1)
+		p.inFlight.done()
+		return errors.Wrap(ctx.Err(), "timed out waiting for room in the publish buffer")
+	case <-p.connection.done:
+		atomic.AddInt32(&p.buffered, -1)
+		p.inFlight.done()
+		return ErrClosed
+	}
+}
+
+func (p *ExchangePublisher) publish(ctx context.Context, exchangeName string, routingKey string, publishing amqp.Publishing) error {
+	if _, ok := ctx.Deadline(); p.confirm && !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.confirmTimeout)
+		defer cancel()
+	}
+
+	if p.pool != nil {
+		return p.publishPooled(ctx, exchangeName, routingKey, publishing)
+	}
+
+	for {
+		connection, err := p.connection.get(ctx)
+		if err != nil {
+			return err
+		}
+
+		err = p.publishOnConnection(connection, exchangeName, routingKey, publishing)
+		if errors.Cause(err) == amqp.ErrClosed {
+			// the connection dropped underneath us, so wait for it to be replaced and try again
+			p.connection.invalidate(connection, err)
+			continue
+		}
+
+		return err
+	}
+}
+
+func (p *ExchangePublisher) publishOnConnection(connection *amqp.Connection, exchangeName string, routingKey string, publishing amqp.Publishing) error {
+	channel, err := connection.Channel()
 	if err != nil {
 		return errors.Wrap(err, "failed to open channel to broker")
 	}
 	defer channel.Close()
 
-	err = channel.Publish(exchangeName, routingKey, false, false, amqp.Publishing{
-		Body: body,
-	})
+	err = channel.Publish(exchangeName, routingKey, p.mandatory, false, publishing)
 	if err != nil {
 		return errors.Wrap(err, "failed to publish message")
 	}
 
 	return nil
 }
+
+// publishPooled publishes on a channel from the pool, waiting for the broker to acknowledge the message in confirm mode
+func (p *ExchangePublisher) publishPooled(ctx context.Context, exchangeName string, routingKey string, publishing amqp.Publishing) error {
+	for {
+		channel, err := p.pool.acquire(ctx)
+		if err != nil {
+			return err
+		}
+
+		err = channel.publish(ctx, exchangeName, routingKey, p.mandatory, publishing)
+		switch {
+		case errors.Cause(err) == amqp.ErrClosed:
+			// the message never left, so it is safe to try again on a fresh channel
+			p.pool.discard(channel)
+			continue
+		case errors.Cause(err) == context.DeadlineExceeded || errors.Cause(err) == context.Canceled:
+			// a late confirmation would be mistaken for the next message's, so the channel cannot be reused
+			p.pool.discard(channel)
+		default:
+			p.pool.release(channel)
+		}
+
+		return err
+	}
+}
+
+// flushBuffer publishes buffered messages in order, retrying each one until it is published or the publisher is closed
+func (p *ExchangePublisher) flushBuffer() {
+	for {
+		select {
+		case pending := <-p.buffer:
+			err := p.flush(pending)
+			if pending.result != nil {
+				pending.result <- err
+			}
+			atomic.AddInt32(&p.buffered, -1)
+			p.inFlight.done()
+		case <-p.connection.done:
+			p.closeBuffer()
+			return
+		}
+	}
+}
+
+// closeBuffer empties the buffer once the publisher has been closed, failing the messages that were still waiting
+func (p *ExchangePublisher) closeBuffer() {
+	p.bufferMutex.Lock()
+	defer p.bufferMutex.Unlock()
+
+	p.bufferClosed = true
+
+	dropped := 0
+	for {
+		select {
+		case pending := <-p.buffer:
+			if pending.result != nil {
+				pending.result <- ErrClosed
+			} else {
+				dropped++
+			}
+			atomic.AddInt32(&p.buffered, -1)
+			p.inFlight.done()
+		default:
+			if dropped > 0 {
+				log.Warn("dropped buffered messages that were not published before closing", "count", dropped)
+			}
+			return
+		}
+	}
+}
+
+func (p *ExchangePublisher) flush(pending *pendingPublishing) error {
+	for attempt := 0; ; attempt++ {
+		err := p.publish(context.Background(), pending.exchangeName, pending.routingKey, pending.publishing)
+		switch errors.Cause(err).(type) {
+		case nil:
+			return nil
+		case *NackError, *UnroutableError:
+			// the broker has made up its mind, so publishing again would not change the outcome
+			return err
+		}
+
+		if errors.Cause(err) == ErrClosed {
+			return err
+		}
+
+		log.Warn("failed to publish buffered message, retrying",
+			"err", err,
+			"exchange", pending.exchangeName,
+			"routingKey", pending.routingKey,
+		)
+
+		select {
+		case <-time.After(p.connection.backoff.interval(attempt)):
+		case <-p.connection.done:
+			return ErrClosed
+		}
+	}
+}
+
+// Confirms reports whether the publisher waits for the broker to acknowledge each message
+func (p *ExchangePublisher) Confirms() bool {
+	return p.confirm
+}
+
+// Close stops accepting new messages, waits for in-flight and buffered messages to be published until the context
+// ends, and then closes the connection to the broker and unregisters the publisher's metrics
+//
+// To shut down with a cmd.ProcessGroup, close the publisher with a fresh context once the group's context is done.
+func (p *ExchangePublisher) Close(ctx context.Context) error {
+	p.inFlight.close()
+	drainErr := p.inFlight.wait(ctx)
+
+	if p.pool != nil {
+		p.pool.close()
+	}
+
+	err := p.connection.close()
+	p.releaseMetrics.Do(p.metrics.release)
+
+	if drainErr != nil {
+		return errors.Wrap(drainErr, "timed out waiting for in-flight messages to be published")
+	}
+
+	return err
+}
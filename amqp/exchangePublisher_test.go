@@ -1,11 +1,13 @@
 package amqp_test
 
 import (
+	"context"
 	"fmt"
 	"testing"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/pkg/errors"
 	"github.com/streadway/amqp"
 	"github.com/stretchr/testify/assert"
 	sut "github.com/syncromatics/go-kit/v2/amqp"
@@ -129,3 +131,547 @@ func Test_PublishWithRoutingKey_MatchSuccessful(t *testing.T) {
 		assert.Fail(t, "expected to receive message within a timely manner")
 	}
 }
+
+func Test_Publish_ReconnectsAfterConnectionLoss(t *testing.T) {
+	// Arrange
+	conn, err := amqp.Dial(amqpURL)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	channel, err := conn.Channel()
+	assert.Nil(t, err)
+	defer channel.Close()
+
+	testQueueName := fmt.Sprintf("test.%v", uuid.NewString())
+	_, err = channel.QueueDeclare(testQueueName, false, true, true, false, nil)
+	assert.Nil(t, err)
+
+	err = channel.QueueBind(testQueueName, "reconnect.#", EXCHANGE_NAME, false, nil)
+	assert.Nil(t, err)
+
+	actualMessages, err := channel.Consume(testQueueName, uuid.NewString(), true, true, false, false, nil)
+	assert.Nil(t, err)
+
+	proxy := newFlakyProxy(t, amqpURL)
+	defer proxy.Close()
+
+	publisher := sut.NewExchangePublisherWithSettings(proxy.url, &sut.PublisherSettings{
+		ReconnectBackoff: sut.Backoff{
+			InitialInterval: 10 * time.Millisecond,
+		},
+	})
+
+	err = publisher.EnsurePublisherIsReady()
+	assert.Nil(t, err)
+
+	// Act
+	proxy.Sever()
+
+	expectedBody := []byte(`{"VehicleId":2}`)
+	err = publisher.PublishWithRoutingKey(EXCHANGE_NAME, "reconnect.blocking", expectedBody)
+
+	// Assert
+	assert.Nil(t, err)
+
+	select {
+	case actual := <-actualMessages:
+		assert.Equal(t, expectedBody, actual.Body)
+	case <-time.After(3 * time.Second):
+		assert.Fail(t, "expected to receive message within a timely manner")
+	}
+}
+
+func Test_Publish_BuffersWhileReconnecting(t *testing.T) {
+	// Arrange
+	conn, err := amqp.Dial(amqpURL)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	channel, err := conn.Channel()
+	assert.Nil(t, err)
+	defer channel.Close()
+
+	testQueueName := fmt.Sprintf("test.%v", uuid.NewString())
+	_, err = channel.QueueDeclare(testQueueName, false, true, true, false, nil)
+	assert.Nil(t, err)
+
+	err = channel.QueueBind(testQueueName, "reconnect.#", EXCHANGE_NAME, false, nil)
+	assert.Nil(t, err)
+
+	actualMessages, err := channel.Consume(testQueueName, uuid.NewString(), true, true, false, false, nil)
+	assert.Nil(t, err)
+
+	proxy := newFlakyProxy(t, amqpURL)
+	defer proxy.Close()
+
+	publisher := sut.NewExchangePublisherWithSettings(proxy.url, &sut.PublisherSettings{
+		ReconnectBackoff: sut.Backoff{
+			InitialInterval: 500 * time.Millisecond,
+		},
+		BufferSize: 10,
+	})
+
+	err = publisher.EnsurePublisherIsReady()
+	assert.Nil(t, err)
+
+	proxy.Sever()
+	time.Sleep(100 * time.Millisecond)
+
+	// Act
+	expectedBodies := [][]byte{
+		[]byte(`{"VehicleId":3}`),
+		[]byte(`{"VehicleId":4}`),
+	}
+	for _, body := range expectedBodies {
+		err = publisher.PublishWithRoutingKey(EXCHANGE_NAME, "reconnect.buffered", body)
+		assert.Nil(t, err)
+	}
+
+	// Assert
+	for _, expectedBody := range expectedBodies {
+		select {
+		case actual := <-actualMessages:
+			assert.Equal(t, expectedBody, actual.Body)
+		case <-time.After(3 * time.Second):
+			assert.Fail(t, "expected to receive message within a timely manner")
+		}
+	}
+}
+
+func Test_Publish_BuffersBeforeReady(t *testing.T) {
+	// Arrange
+	conn, err := amqp.Dial(amqpURL)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	channel, err := conn.Channel()
+	assert.Nil(t, err)
+	defer channel.Close()
+
+	testQueueName := fmt.Sprintf("test.%v", uuid.NewString())
+	_, err = channel.QueueDeclare(testQueueName, false, true, true, false, nil)
+	assert.Nil(t, err)
+
+	err = channel.QueueBind(testQueueName, "ready.#", EXCHANGE_NAME, false, nil)
+	assert.Nil(t, err)
+
+	actualMessages, err := channel.Consume(testQueueName, uuid.NewString(), true, true, false, false, nil)
+	assert.Nil(t, err)
+
+	publisher := sut.NewExchangePublisherWithSettings(amqpURL, &sut.PublisherSettings{
+		ReconnectBackoff: sut.Backoff{
+			InitialInterval: 10 * time.Millisecond,
+		},
+		BufferSize: 10,
+	})
+
+	expectedBody := []byte(`{"VehicleId":6}`)
+	err = publisher.PublishWithRoutingKey(EXCHANGE_NAME, "ready.buffered", expectedBody)
+	assert.Nil(t, err)
+
+	// Act
+	err = publisher.EnsurePublisherIsReady()
+
+	// Assert
+	assert.Nil(t, err)
+
+	select {
+	case actual := <-actualMessages:
+		assert.Equal(t, expectedBody, actual.Body)
+	case <-time.After(3 * time.Second):
+		assert.Fail(t, "expected to receive message within a timely manner")
+	}
+}
+
+func Test_Publish_Buffered_Confirm_ReportsResult(t *testing.T) {
+	// Arrange
+	publisher := sut.NewExchangePublisherWithSettings(amqpURL, &sut.PublisherSettings{
+		ReconnectBackoff: sut.Backoff{
+			InitialInterval: 10 * time.Millisecond,
+		},
+		BufferSize: 10,
+		Confirm:    true,
+		Mandatory:  true,
+	})
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		publisher.EnsurePublisherIsReady()
+	}()
+
+	routingKey := fmt.Sprintf("unroutable.%v", uuid.NewString())
+
+	// Act
+	err := publisher.PublishWithRoutingKey(EXCHANGE_NAME, routingKey, []byte(`{}`))
+
+	// Assert
+	_, ok := err.(*sut.UnroutableError)
+	assert.True(t, ok, "expected an unroutable error but got %v", err)
+}
+
+func Test_Publish_Buffered_Confirm_ClosedBeforePublished(t *testing.T) {
+	// Arrange
+	publisher := sut.NewExchangePublisherWithSettings("amqp://localhost:80", &sut.PublisherSettings{
+		BufferSize: 10,
+		Confirm:    true,
+	})
+
+	// the first message is being flushed while the second waits in the buffer
+	results := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			results <- publisher.PublishWithRoutingKey(EXCHANGE_NAME, "closed.buffered", []byte(`{}`))
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	// Act
+	closeErr := publisher.Close(ctx)
+
+	// Assert
+	assert.NotNil(t, closeErr)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-results:
+			assert.Equal(t, sut.ErrClosed, err)
+		case <-time.After(3 * time.Second):
+			assert.Fail(t, "expected publishing to fail once the publisher was closed")
+		}
+	}
+}
+
+func Test_Publish_Buffered_Confirm_TimesOut(t *testing.T) {
+	// Arrange
+	publisher := sut.NewExchangePublisherWithSettings("amqp://localhost:80", &sut.PublisherSettings{
+		BufferSize:     10,
+		Confirm:        true,
+		ConfirmTimeout: 100 * time.Millisecond,
+	})
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		publisher.Close(ctx)
+	}()
+
+	result := make(chan error, 1)
+
+	// Act
+	go func() {
+		result <- publisher.PublishWithRoutingKey(EXCHANGE_NAME, "timeout.buffered", []byte(`{}`))
+	}()
+
+	// Assert
+	select {
+	case err := <-result:
+		assert.Equal(t, context.DeadlineExceeded, errors.Cause(err))
+	case <-time.After(3 * time.Second):
+		assert.Fail(t, "expected publishing to time out waiting for the buffered message to be confirmed")
+	}
+}
+
+func Test_Publish_Confirm_Successful(t *testing.T) {
+	// Arrange
+	conn, err := amqp.Dial(amqpURL)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	channel, err := conn.Channel()
+	assert.Nil(t, err)
+	defer channel.Close()
+
+	testQueueName := fmt.Sprintf("test.%v", uuid.NewString())
+	_, err = channel.QueueDeclare(testQueueName, false, true, true, false, nil)
+	assert.Nil(t, err)
+
+	err = channel.QueueBind(testQueueName, "confirm.#", EXCHANGE_NAME, false, nil)
+	assert.Nil(t, err)
+
+	actualMessages, err := channel.Consume(testQueueName, uuid.NewString(), true, true, false, false, nil)
+	assert.Nil(t, err)
+
+	publisher := sut.NewExchangePublisherWithSettings(amqpURL, &sut.PublisherSettings{
+		Confirm:   true,
+		Mandatory: true,
+	})
+
+	err = publisher.EnsurePublisherIsReady()
+	assert.Nil(t, err)
+
+	expectedBody := []byte(`{"VehicleId":5}`)
+
+	// Act
+	err = publisher.PublishWithRoutingKey(EXCHANGE_NAME, "confirm.acked", expectedBody)
+
+	// Assert
+	assert.Nil(t, err)
+
+	select {
+	case actual := <-actualMessages:
+		assert.Equal(t, expectedBody, actual.Body)
+	case <-time.After(3 * time.Second):
+		assert.Fail(t, "expected to receive message within a timely manner")
+	}
+}
+
+func Test_Publish_Confirm_Unroutable(t *testing.T) {
+	// Arrange
+	publisher := sut.NewExchangePublisherWithSettings(amqpURL, &sut.PublisherSettings{
+		Confirm:   true,
+		Mandatory: true,
+	})
+
+	err := publisher.EnsurePublisherIsReady()
+	assert.Nil(t, err)
+
+	routingKey := fmt.Sprintf("unroutable.%v", uuid.NewString())
+
+	// Act
+	err = publisher.PublishWithRoutingKey(EXCHANGE_NAME, routingKey, []byte(`{}`))
+
+	// Assert
+	unroutable, ok := err.(*sut.UnroutableError)
+	assert.True(t, ok, "expected an UnroutableError but got %v", err)
+	if ok {
+		assert.Equal(t, EXCHANGE_NAME, unroutable.Exchange)
+		assert.Equal(t, routingKey, unroutable.RoutingKey)
+		assert.Equal(t, uint16(amqp.NoRoute), unroutable.ReplyCode)
+	}
+}
+
+func Test_Publish_Confirm_Nacked(t *testing.T) {
+	// Arrange
+	conn, err := amqp.Dial(amqpURL)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	channel, err := conn.Channel()
+	assert.Nil(t, err)
+	defer channel.Close()
+
+	testQueueName := fmt.Sprintf("test.%v", uuid.NewString())
+	_, err = channel.QueueDeclare(testQueueName, false, true, true, false, amqp.Table{
+		"x-max-length": int32(0),
+		"x-overflow":   "reject-publish",
+	})
+	assert.Nil(t, err)
+
+	err = channel.QueueBind(testQueueName, "nack.#", EXCHANGE_NAME, false, nil)
+	assert.Nil(t, err)
+
+	publisher := sut.NewExchangePublisherWithSettings(amqpURL, &sut.PublisherSettings{
+		Confirm: true,
+	})
+
+	err = publisher.EnsurePublisherIsReady()
+	assert.Nil(t, err)
+
+	// Act
+	err = publisher.PublishWithRoutingKey(EXCHANGE_NAME, "nack.full", []byte(`{}`))
+
+	// Assert
+	_, ok := err.(*sut.NackError)
+	assert.True(t, ok, "expected a NackError but got %v", err)
+}
+
+func Test_Publish_Pooled_Concurrently(t *testing.T) {
+	// Arrange
+	conn, err := amqp.Dial(amqpURL)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	channel, err := conn.Channel()
+	assert.Nil(t, err)
+	defer channel.Close()
+
+	testQueueName := fmt.Sprintf("test.%v", uuid.NewString())
+	_, err = channel.QueueDeclare(testQueueName, false, true, true, false, nil)
+	assert.Nil(t, err)
+
+	err = channel.QueueBind(testQueueName, "pooled.#", EXCHANGE_NAME, false, nil)
+	assert.Nil(t, err)
+
+	actualMessages, err := channel.Consume(testQueueName, uuid.NewString(), true, true, false, false, nil)
+	assert.Nil(t, err)
+
+	publisher := sut.NewExchangePublisherWithSettings(amqpURL, &sut.PublisherSettings{
+		Confirm:         true,
+		ChannelPoolSize: 4,
+	})
+
+	err = publisher.EnsurePublisherIsReady()
+	assert.Nil(t, err)
+
+	// Act
+	const messageCount = 50
+	errs := make(chan error, messageCount)
+	for i := 0; i < messageCount; i++ {
+		go func(i int) {
+			errs <- publisher.PublishWithRoutingKey(EXCHANGE_NAME, "pooled.concurrent", []byte(fmt.Sprintf(`{"VehicleId":%d}`, i)))
+		}(i)
+	}
+
+	// Assert
+	for i := 0; i < messageCount; i++ {
+		assert.Nil(t, <-errs)
+	}
+
+	for i := 0; i < messageCount; i++ {
+		select {
+		case <-actualMessages:
+		case <-time.After(3 * time.Second):
+			assert.Fail(t, "expected to receive message within a timely manner")
+			return
+		}
+	}
+}
+
+func Benchmark_Publish_ChannelPerMessage(b *testing.B) {
+	benchmarkPublish(b, &sut.PublisherSettings{})
+}
+
+func Benchmark_Publish_Pooled(b *testing.B) {
+	benchmarkPublish(b, &sut.PublisherSettings{
+		ChannelPoolSize: 8,
+	})
+}
+
+func benchmarkPublish(b *testing.B, settings *sut.PublisherSettings) {
+	publisher := sut.NewExchangePublisherWithSettings(amqpURL, settings)
+
+	err := publisher.EnsurePublisherIsReady()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	body := []byte(`{"VehicleId":1}`)
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			err := publisher.PublishWithRoutingKey(EXCHANGE_NAME, "benchmark", body)
+			if err != nil {
+				b.Error(err)
+			}
+		}
+	})
+}
+
+func Test_PublishMessage_Successful(t *testing.T) {
+	// Arrange
+	conn, err := amqp.Dial(amqpURL)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	channel, err := conn.Channel()
+	assert.Nil(t, err)
+	defer channel.Close()
+
+	testQueueName := fmt.Sprintf("test.%v", uuid.NewString())
+	_, err = channel.QueueDeclare(testQueueName, false, true, true, false, nil)
+	assert.Nil(t, err)
+
+	err = channel.QueueBind(testQueueName, "options.#", EXCHANGE_NAME, false, nil)
+	assert.Nil(t, err)
+
+	actualMessages, err := channel.Consume(testQueueName, uuid.NewString(), true, true, false, false, nil)
+	assert.Nil(t, err)
+
+	publisher := sut.NewExchangePublisher(amqpURL)
+
+	err = publisher.EnsurePublisherIsReady()
+	assert.Nil(t, err)
+
+	timestamp := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	expected := &sut.Publishing{
+		RoutingKey: "options.all",
+		Headers: map[string]interface{}{
+			"messageType": "Position",
+			"attempt":     int32(3),
+			"urgent":      true,
+		},
+		ContentType:     "application/json",
+		ContentEncoding: "identity",
+		Persistent:      true,
+		Priority:        5,
+		CorrelationID:   uuid.NewString(),
+		ReplyTo:         "replies",
+		MessageID:       uuid.NewString(),
+		Timestamp:       timestamp,
+		Expiration:      time.Minute,
+		Body:            []byte(`{"VehicleId":1}`),
+	}
+
+	// Act
+	err = publisher.PublishMessage(context.Background(), EXCHANGE_NAME, expected)
+
+	// Assert
+	assert.Nil(t, err)
+
+	select {
+	case actual := <-actualMessages:
+		assert.Equal(t, expected.RoutingKey, actual.RoutingKey)
+		assert.Equal(t, amqp.Table(expected.Headers), actual.Headers)
+		assert.Equal(t, expected.ContentType, actual.ContentType)
+		assert.Equal(t, expected.ContentEncoding, actual.ContentEncoding)
+		assert.Equal(t, amqp.Persistent, actual.DeliveryMode)
+		assert.Equal(t, expected.Priority, actual.Priority)
+		assert.Equal(t, expected.CorrelationID, actual.CorrelationId)
+		assert.Equal(t, expected.ReplyTo, actual.ReplyTo)
+		assert.Equal(t, expected.MessageID, actual.MessageId)
+		assert.Equal(t, timestamp, actual.Timestamp.UTC())
+		assert.Equal(t, "60000", actual.Expiration)
+		assert.Equal(t, expected.Body, actual.Body)
+	case <-time.After(3 * time.Second):
+		assert.Fail(t, "expected to receive message within a timely manner")
+	}
+}
+
+func Test_Close_DrainsBufferedMessagesThenRejectsPublishes(t *testing.T) {
+	// Arrange
+	conn, err := amqp.Dial(amqpURL)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	channel, err := conn.Channel()
+	assert.Nil(t, err)
+	defer channel.Close()
+
+	queue, err := channel.QueueDeclare("", false, true, true, false, nil)
+	assert.Nil(t, err)
+
+	err = channel.QueueBind(queue.Name, "close.#", EXCHANGE_NAME, false, nil)
+	assert.Nil(t, err)
+
+	publisher := sut.NewExchangePublisherWithSettings(amqpURL, &sut.PublisherSettings{
+		BufferSize: 10,
+	})
+
+	err = publisher.EnsurePublisherIsReady()
+	assert.Nil(t, err)
+
+	const messageCount = 5
+	for i := 0; i < messageCount; i++ {
+		err = publisher.PublishWithRoutingKey(EXCHANGE_NAME, "close.drain", []byte(fmt.Sprintf("%d", i)))
+		assert.Nil(t, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	// Act
+	err = publisher.Close(ctx)
+
+	// Assert
+	assert.Nil(t, err)
+
+	err = publisher.PublishWithRoutingKey(EXCHANGE_NAME, "close.drain", []byte(`{}`))
+	assert.Equal(t, sut.ErrClosed, err)
+
+	inspected, err := channel.QueueInspect(queue.Name)
+	assert.Nil(t, err)
+	assert.Equal(t, messageCount, inspected.Messages)
+}
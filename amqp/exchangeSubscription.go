@@ -3,104 +3,182 @@ package amqp
 import (
 	"context"
 	"fmt"
+	"sync"
+	"time"
 
 	uuid "github.com/google/uuid"
+	opentracing "github.com/opentracing/opentracing-go"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/streadway/amqp"
 	"github.com/syncromatics/go-kit/v2/log"
 )
 
+// SubscriptionSettings are the settings for the queue that an ExchangeSubscription binds to the exchange
+type SubscriptionSettings struct {
+	// QueueName is the name of the queue. When empty, a unique name is generated from the exchange name.
+	QueueName string
+	// Durable queues survive a broker restart
+	Durable bool
+	// AutoDelete queues are deleted once their last consumer has gone away
+	AutoDelete bool
+	// Exclusive queues are only accessible by this subscription's connection and are deleted when it closes.
+	// Consumers of an exclusive queue are also exclusive.
+	Exclusive bool
+	// Arguments are the optional arguments used when declaring the queue, such as x-message-ttl
+	Arguments map[string]interface{}
+	// BindingKeys are the routing keys with which the queue is bound to the exchange. Defaults to "#".
+	BindingKeys []string
+	// DeadLetter opts in to delayed retries and dead-lettering of failed messages. Because it changes the arguments
+	// of the queue, it cannot be enabled on an existing durable queue without deleting the queue first. It requires a
+	// QueueName and cannot be used with AutoDelete or Exclusive queues.
+	DeadLetter *DeadLetterSettings
+	// PrefetchCount is the maximum number of unacknowledged messages the broker delivers to each consumer. When zero,
+	// the broker delivers messages as fast as it can.
+	PrefetchCount int
+	// Reconnect keeps consumers alive across broker restarts and network failures. When the connection or a
+	// consumer's channel closes, the queue and its bindings are declared again and messages resume on the same
+	// channel returned by Consume. Otherwise, that channel is closed.
+	Reconnect bool
+	// ReconnectBackoff controls how long to wait between attempts to reconnect after the connection is lost
+	ReconnectBackoff Backoff
+	// Registerer is where the subscription's metrics are registered. Defaults to prometheus.DefaultRegisterer.
+	Registerer prometheus.Registerer
+	// Topology is declared before the subscription's queue on connect and on every reconnect, such as to declare the
+	// exchange that the queue is bound to
+	Topology *Topology
+	// Tracer starts a span for each delivered message, continuing the trace propagated by the publisher.
+	// Defaults to opentracing.GlobalTracer(), which is set by grpc.CreateServer.
+	Tracer opentracing.Tracer
+}
+
 // ExchangeSubscription is a service for subscribing to an AMQP exchange
 type ExchangeSubscription struct {
-	amqpURL      string
 	queueName    string
 	exchangeName string
+	settings     SubscriptionSettings
+	deadLetter   *deadLetterTopology
+
+	connection *connectionManager
+	inFlight   *inFlight
+	metrics    *metrics
+
+	consumersMutex sync.Mutex
+	consumers      map[int]context.CancelFunc
+	nextConsumerID int
 
-	connection *amqp.Connection
+	releaseMetrics sync.Once
 
 	activeConsumers  prometheus.Gauge
 	messagesConsumed prometheus.Counter
 	messagesAcked    prometheus.Counter
 	messagesNacked   prometheus.Counter
 	messagesRejected prometheus.Counter
+	messagesRetried  prometheus.Counter
+	messagesInFlight prometheus.Gauge
+	handlerDuration  prometheus.ObserverVec
+	consumerRestarts prometheus.Counter
 }
 
-// NewExchangeSubscription creates a new ExchangeSubscription
+// NewExchangeSubscription creates a new ExchangeSubscription with a transient queue that receives every message
+// published to the exchange
 func NewExchangeSubscription(amqpURL string, exchangeName string) *ExchangeSubscription {
-	queueName := fmt.Sprintf("%s.%s", exchangeName, uuid.New())
-
-	labels := prometheus.Labels{
-		"amqp_queue":    queueName,
-		"amqp_exchange": exchangeName,
-	}
-
-	activeConsumers := promauto.NewGauge(prometheus.GaugeOpts{
-		Name:        "amqp_consumers_total",
-		Help:        "The total number of consumers connected to the queue that is subscribed to the exchange",
-		ConstLabels: labels,
-	})
-
-	messagesConsumed := promauto.NewCounter(prometheus.CounterOpts{
-		Name:        "amqp_messages_recv_total",
-		Help:        "The total number of received messages",
-		ConstLabels: labels,
+	return NewExchangeSubscriptionWithSettings(amqpURL, exchangeName, &SubscriptionSettings{
+		AutoDelete: true,
+		Exclusive:  true,
 	})
+}
 
-	messagesAcked := promauto.NewCounter(prometheus.CounterOpts{
-		Name:        "amqp_messages_ack_total",
-		Help:        "The total number of acknowledged messages",
-		ConstLabels: labels,
-	})
+// NewExchangeSubscriptionWithSettings creates a new ExchangeSubscription with the given queue settings
+//
+// A durable, non-exclusive queue with a fixed name can be shared by several subscriptions, in which case each message
+// is delivered to only one of them.
+func NewExchangeSubscriptionWithSettings(amqpURL string, exchangeName string, settings *SubscriptionSettings) *ExchangeSubscription {
+	queueName := settings.QueueName
+	if queueName == "" {
+		queueName = fmt.Sprintf("%s.%s", exchangeName, uuid.New())
+	}
 
-	messagesNacked := promauto.NewCounter(prometheus.CounterOpts{
-		Name:        "amqp_messages_nack_total",
-		Help:        "The total number of negatively acknowledged messages",
-		ConstLabels: labels,
-	})
+	var deadLetter *deadLetterTopology
+	if settings.DeadLetter != nil {
+		deadLetter = newDeadLetterTopology(queueName, settings.Durable, *settings.DeadLetter)
+	}
 
-	messagesRejected := promauto.NewCounter(prometheus.CounterOpts{
-		Name:        "amqp_messages_reject_total",
-		Help:        "The total number of rejected messages",
-		ConstLabels: labels,
-	})
+	metrics := acquireMetrics(settings.Registerer)
 
-	return &ExchangeSubscription{
-		amqpURL:      amqpURL,
+	es := &ExchangeSubscription{
 		queueName:    queueName,
 		exchangeName: exchangeName,
+		settings:     *settings,
+		deadLetter:   deadLetter,
+		connection:   newConnectionManager(amqpURL, "subscription", settings.Reconnect, settings.ReconnectBackoff, metrics),
+		inFlight:     newInFlight(),
+		metrics:      metrics,
+		consumers:    map[int]context.CancelFunc{},
 
-		activeConsumers:  activeConsumers,
-		messagesConsumed: messagesConsumed,
-		messagesAcked:    messagesAcked,
-		messagesNacked:   messagesNacked,
-		messagesRejected: messagesRejected,
+		activeConsumers:  metrics.activeConsumers.WithLabelValues(exchangeName),
+		messagesConsumed: metrics.messagesConsumed.WithLabelValues(exchangeName),
+		messagesAcked:    metrics.messagesAcked.WithLabelValues(exchangeName),
+		messagesNacked:   metrics.messagesNacked.WithLabelValues(exchangeName),
+		messagesRejected: metrics.messagesRejected.WithLabelValues(exchangeName),
+		messagesRetried:  metrics.messagesRetried.WithLabelValues(exchangeName),
+		messagesInFlight: metrics.messagesInFlight.WithLabelValues(exchangeName),
+		handlerDuration:  metrics.handlerDuration.MustCurryWith(prometheus.Labels{"amqp_exchange": exchangeName}),
+		consumerRestarts: metrics.consumerRestarts.WithLabelValues(exchangeName),
 	}
+	es.connection.onConnect = es.declare
+
+	return es
 }
 
-// EnsureExchangeSubscriptionIsReady ensures that the necessary transient queue exists and is bound to the exchange
+// EnsureExchangeSubscriptionIsReady ensures that the necessary queue exists and is bound to the exchange
 func (es *ExchangeSubscription) EnsureExchangeSubscriptionIsReady() error {
-	var err error
-	es.connection, err = amqp.Dial(es.amqpURL)
-	if err != nil {
-		return errors.Wrap(err, "failed to connect to broker")
+	if es.deadLetter != nil && (es.settings.QueueName == "" || es.settings.AutoDelete || es.settings.Exclusive) {
+		return ErrDeadLetterOnTransientQueue
 	}
 
-	channel, err := es.connection.Channel()
+	return es.connection.connect()
+}
+
+// declare declares the topology, the queue and its bindings on a new connection
+func (es *ExchangeSubscription) declare(connection *amqp.Connection) error {
+	channel, err := connection.Channel()
 	if err != nil {
 		return errors.Wrap(err, "failed to open channel to broker")
 	}
 	defer channel.Close()
 
-	_, err = channel.QueueDeclare(es.queueName, false, true, true, false, nil)
+	if es.settings.Topology != nil {
+		err = es.settings.Topology.declare(channel)
+		if err != nil {
+			return err
+		}
+	}
+
+	arguments := amqp.Table(es.settings.Arguments)
+	if es.deadLetter != nil {
+		err = es.deadLetter.declare(channel)
+		if err != nil {
+			return err
+		}
+		arguments = es.deadLetter.queueArguments(es.settings.Arguments)
+	}
+
+	_, err = channel.QueueDeclare(es.queueName, es.settings.Durable, es.settings.AutoDelete, es.settings.Exclusive, false, arguments)
 	if err != nil {
 		return errors.Wrap(err, "failed to declare queue")
 	}
 
-	err = channel.QueueBind(es.queueName, "#", es.exchangeName, false, nil)
-	if err != nil {
-		return errors.Wrap(err, "failed to bind queue to exchange")
+	bindingKeys := es.settings.BindingKeys
+	if len(bindingKeys) == 0 {
+		bindingKeys = []string{"#"}
+	}
+
+	for _, bindingKey := range bindingKeys {
+		err = channel.QueueBind(es.queueName, bindingKey, es.exchangeName, false, nil)
+		if err != nil {
+			return errors.Wrapf(err, "failed to bind queue to exchange with key '%s'", bindingKey)
+		}
 	}
 
 	return nil
@@ -108,73 +186,179 @@ func (es *ExchangeSubscription) EnsureExchangeSubscriptionIsReady() error {
 
 // Message represents a message in-flight from an AMQP broker
 type Message struct {
+	// Exchange is the name of the exchange that the message was published to
+	Exchange string
+	// RoutingKey is the routing key that the message was published with
+	RoutingKey string
 	// Headers are the collection of metadata passed along with the Body
 	Headers map[string]interface{}
+	// ContentType is the MIME type of the Body
+	ContentType string
+	// CorrelationID correlates a reply with its request
+	CorrelationID string
+	// ReplyTo is the queue to which replies should be sent
+	ReplyTo string
+	// MessageID uniquely identifies the message
+	MessageID string
 	// Body is the unmodified byte array containing the message
 	Body []byte
 	// Ack acknowledges the successful processing of the message
 	Ack func() error
-	// Nack acknowledges the failed processing of the message and instructs the message to be requeued
+	// Nack acknowledges the failed processing of the message and instructs the message to be requeued. When
+	// dead-lettering is enabled, the message is instead retried after a delay, or dead-lettered once it has been
+	// retried too many times.
 	Nack func() error
+	// NackWithoutRequeue acknowledges the failed processing of the message without requeueing it, so that it is
+	// dead-lettered if the queue has a dead-letter exchange and discarded otherwise
+	NackWithoutRequeue func() error
+	// Reject refuses the message without requeueing it, so that it is dead-lettered if the queue has a dead-letter
+	// exchange and discarded otherwise
+	Reject func() error
+
+	ctx    context.Context
+	settle func()
+	// timed is set once the handler's duration has been observed by a MetricsMiddleware
+	timed bool
+}
+
+// Context returns a context carrying the span that traces the processing of the message. The span is finished once
+// the message is acknowledged or refused.
+func (m *Message) Context() context.Context {
+	if m.ctx == nil {
+		return context.Background()
+	}
+	return m.ctx
+}
+
+func (es *ExchangeSubscription) newMessage(channel *amqp.Channel, msg amqp.Delivery) *Message {
+	tracer := es.settings.Tracer
+	if tracer == nil {
+		tracer = opentracing.GlobalTracer()
+	}
+	span := startConsumeSpan(tracer, es.exchangeName, msg.Headers)
+
+	var settled sync.Once
+	settle := func() {
+		settled.Do(func() {
+			span.Finish()
+			es.inFlight.done()
+		})
+	}
+
+	return &Message{
+		Exchange:      msg.Exchange,
+		RoutingKey:    routingKey(msg),
+		Headers:       msg.Headers,
+		ContentType:   msg.ContentType,
+		CorrelationID: msg.CorrelationId,
+		ReplyTo:       msg.ReplyTo,
+		MessageID:     msg.MessageId,
+		Body:          msg.Body,
+		ctx:           opentracing.ContextWithSpan(context.Background(), span),
+		settle:        settle,
+		Ack: func() error {
+			defer settle()
+			es.messagesAcked.Inc()
+			return msg.Ack(false)
+		},
+		Nack: func() error {
+			defer settle()
+			if es.deadLetter == nil {
+				es.messagesNacked.Inc()
+				return msg.Nack(false, true)
+			}
+
+			deadLettered, err := es.deadLetter.retry(channel, msg)
+			if deadLettered {
+				es.messagesRejected.Inc()
+			} else {
+				es.messagesRetried.Inc()
+			}
+			return err
+		},
+		NackWithoutRequeue: func() error {
+			defer settle()
+			es.messagesNacked.Inc()
+			return msg.Nack(false, false)
+		},
+		Reject: func() error {
+			defer settle()
+			es.messagesRejected.Inc()
+			return msg.Reject(false)
+		},
+	}
 }
 
 // Consume starts consuming messages
 //
 // Any messages that are not explicitly Acked or Nacked by this consumer before the connection is terminated will be automatically requeued.
 func (es *ExchangeSubscription) Consume(outerCtx context.Context) (<-chan *Message, error) {
-	channel, err := es.connection.Channel()
+	if es.inFlight.isClosed() {
+		return nil, ErrClosed
+	}
+
+	connection, err := es.connection.get(outerCtx)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to open channel for consumer")
+		return nil, err
 	}
 
 	consumer := fmt.Sprintf("%s.consumer", es.queueName)
-	rawMessages, err := channel.Consume(es.queueName, consumer, false, true, false, false, nil)
+	channel, rawMessages, err := es.startConsumer(connection, consumer)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to start consuming messages from queue")
+		return nil, err
 	}
 
 	ctx, cancel := context.WithCancel(outerCtx)
+	unregister := es.registerConsumer(cancel)
 	messages := make(chan *Message)
 	go func() {
 		es.activeConsumers.Inc()
 		defer es.activeConsumers.Dec()
+		defer unregister()
 		for {
 			select {
 			case msg, ok := <-rawMessages:
 				if !ok {
-					cancel()
+					if !es.settings.Reconnect {
+						cancel()
+						continue
+					}
+
+					log.Warn("consumer stopped receiving messages, resuming",
+						"consumer", consumer,
+					)
+					channel, rawMessages, err = es.resumeConsumer(ctx, consumer)
+					if err != nil {
+						cancel()
+						continue
+					}
+					es.consumerRestarts.Inc()
 					continue
 				}
 
 				es.messagesConsumed.Inc()
 
-				message := &Message{
-					Headers: msg.Headers,
-					Body:    msg.Body,
-					Ack: func() error {
-						es.messagesAcked.Inc()
-						return msg.Ack(false)
-					},
-					Nack: func() error {
-						es.messagesNacked.Inc()
-						return msg.Nack(false, true)
-					},
+				if !es.inFlight.start() {
+					// closing has begun, so leave the message for another consumer
+					es.requeue(msg, consumer)
+					continue
 				}
 
+				message := es.newMessage(channel, msg)
+
 				select {
 				case messages <- message:
 				case <-ctx.Done():
-					err = message.Nack()
-					if err != nil {
-						log.Warn("failed to nack in-flight message",
-							"err", err,
-							"consumer", consumer,
-						)
-					}
+					es.requeue(msg, consumer)
+					message.settle()
 				}
 			case <-ctx.Done():
 				close(messages)
 
+				if channel == nil {
+					return
+				}
+
 				err := channel.Cancel(consumer, false)
 				if err != nil {
 					log.Error("failed to cancel consumer",
@@ -183,6 +367,11 @@ func (es *ExchangeSubscription) Consume(outerCtx context.Context) (<-chan *Messa
 					)
 				}
 
+				if es.inFlight.isClosed() {
+					// the channel stays open so that in-flight messages can still be acknowledged while closing
+					return
+				}
+
 				err = channel.Close()
 				if err != nil {
 					log.Error("failed to close channel for consumer",
@@ -198,7 +387,125 @@ func (es *ExchangeSubscription) Consume(outerCtx context.Context) (<-chan *Messa
 	return messages, nil
 }
 
+func (es *ExchangeSubscription) requeue(msg amqp.Delivery, consumer string) {
+	es.messagesNacked.Inc()
+	err := msg.Nack(false, true)
+	if err != nil {
+		log.Warn("failed to nack in-flight message",
+			"err", err,
+			"consumer", consumer,
+		)
+	}
+}
+
+// registerConsumer tracks a running consumer so that closing can stop it
+func (es *ExchangeSubscription) registerConsumer(cancel context.CancelFunc) func() {
+	es.consumersMutex.Lock()
+	defer es.consumersMutex.Unlock()
+
+	id := es.nextConsumerID
+	es.nextConsumerID++
+	es.consumers[id] = cancel
+
+	return func() {
+		es.consumersMutex.Lock()
+		defer es.consumersMutex.Unlock()
+
+		delete(es.consumers, id)
+	}
+}
+
+func (es *ExchangeSubscription) startConsumer(connection *amqp.Connection, consumer string) (*amqp.Channel, <-chan amqp.Delivery, error) {
+	channel, err := connection.Channel()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to open channel for consumer")
+	}
+
+	if es.settings.PrefetchCount > 0 {
+		err = channel.Qos(es.settings.PrefetchCount, 0, false)
+		if err != nil {
+			channel.Close()
+			return nil, nil, errors.Wrap(err, "failed to set prefetch count for consumer")
+		}
+	}
+
+	rawMessages, err := channel.Consume(es.queueName, consumer, false, es.settings.Exclusive, false, false, nil)
+	if err != nil {
+		channel.Close()
+		return nil, nil, errors.Wrap(err, "failed to start consuming messages from queue")
+	}
+
+	return channel, rawMessages, nil
+}
+
+// resumeConsumer starts consuming again once the broker is available, returning an error only if the context ends first
+func (es *ExchangeSubscription) resumeConsumer(ctx context.Context, consumer string) (*amqp.Channel, <-chan amqp.Delivery, error) {
+	for attempt := 0; ; attempt++ {
+		connection, err := es.connection.get(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		channel, rawMessages, err := es.startConsumer(connection, consumer)
+		if err == nil {
+			log.Info("consumer resumed",
+				"consumer", consumer,
+				"attempt", attempt+1,
+			)
+			return channel, rawMessages, nil
+		}
+
+		if errors.Cause(err) == amqp.ErrClosed {
+			es.connection.invalidate(connection, err)
+			continue
+		}
+
+		log.Warn("failed to resume consumer",
+			"err", err,
+			"consumer", consumer,
+			"attempt", attempt+1,
+		)
+
+		select {
+		case <-time.After(es.connection.backoff.interval(attempt)):
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+	}
+}
+
+// Close stops every consumer from receiving new messages, waits until the context ends for messages that have already
+// been delivered to be acknowledged, and then closes the connection to the broker and unregisters the subscription's
+// metrics. Messages that are still unacknowledged when the connection closes are requeued by the broker.
+//
+// To shut down with a cmd.ProcessGroup, close the subscription with a fresh context once the group's context is done.
+func (es *ExchangeSubscription) Close(ctx context.Context) error {
+	es.inFlight.close()
+
+	es.consumersMutex.Lock()
+	for _, cancel := range es.consumers {
+		cancel()
+	}
+	es.consumersMutex.Unlock()
+
+	drainErr := es.inFlight.wait(ctx)
+
+	err := es.connection.close()
+	es.releaseMetrics.Do(es.metrics.release)
+
+	if drainErr != nil {
+		return errors.Wrap(drainErr, "timed out waiting for in-flight messages to be acknowledged")
+	}
+
+	return err
+}
+
 // ExchangeName is the name of the exchange to which this is subscribed
 func (es *ExchangeSubscription) ExchangeName() string {
 	return es.exchangeName
 }
+
+// QueueName is the name of the queue from which this consumes
+func (es *ExchangeSubscription) QueueName() string {
+	return es.queueName
+}
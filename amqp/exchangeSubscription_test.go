@@ -2,12 +2,14 @@ package amqp_test
 
 import (
 	"context"
+	"fmt"
 	"testing"
 	"time"
 
 	sut "github.com/syncromatics/go-kit/v2/amqp"
 
 	"github.com/google/uuid"
+	"github.com/pkg/errors"
 	"github.com/streadway/amqp"
 	"github.com/stretchr/testify/assert"
 	"github.com/syncromatics/go-kit/v2/testing/docker"
@@ -217,3 +219,454 @@ func Test_ExchangeName_should_return_the_name_of_the_exchange(t *testing.T) {
 	// Assert
 	assert.Equal(t, expected, actual)
 }
+
+func Test_Consume_DurableQueue_WithBindingKeys(t *testing.T) {
+	// Arrange
+	conn, err := amqp.Dial(amqpURL)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	channel, err := conn.Channel()
+	assert.Nil(t, err)
+	defer channel.Close()
+
+	settings := &sut.SubscriptionSettings{
+		QueueName:   fmt.Sprintf("test.durable.%s", uuid.NewString()),
+		Durable:     true,
+		BindingKeys: []string{"durable.vehicle", "durable.route"},
+	}
+	defer channel.QueueDelete(settings.QueueName, false, false, false)
+
+	exchangeSubscription := sut.NewExchangeSubscriptionWithSettings(amqpURL, EXCHANGE_NAME, settings)
+
+	// Act
+	err = exchangeSubscription.EnsureExchangeSubscriptionIsReady()
+
+	// Assert
+	assert.Nil(t, err)
+	assert.Equal(t, settings.QueueName, exchangeSubscription.QueueName())
+
+	_, err = channel.QueueDeclarePassive(settings.QueueName, true, false, false, false, nil)
+	assert.Nil(t, err)
+
+	// Act
+	for _, routingKey := range []string{"durable.vehicle", "durable.ignored", "durable.route"} {
+		err = channel.Publish(EXCHANGE_NAME, routingKey, false, false, amqp.Publishing{
+			Body: []byte(routingKey),
+		})
+		assert.Nil(t, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	messages, err := exchangeSubscription.Consume(ctx)
+	assert.Nil(t, err)
+
+	// Assert
+	for _, expected := range []string{"durable.vehicle", "durable.route"} {
+		select {
+		case message := <-messages:
+			assert.Equal(t, expected, string(message.Body))
+			err = message.Ack()
+			assert.Nil(t, err)
+		case <-time.After(3 * time.Second):
+			assert.Fail(t, "did not receive message in a timely manner")
+		}
+	}
+
+	select {
+	case message := <-messages:
+		assert.Fail(t, "received a message that did not match the binding keys", string(message.Body))
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func Test_Consume_SharedQueue_CompetingConsumers(t *testing.T) {
+	// Arrange
+	conn, err := amqp.Dial(amqpURL)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	channel, err := conn.Channel()
+	assert.Nil(t, err)
+	defer channel.Close()
+
+	settings := &sut.SubscriptionSettings{
+		QueueName:   fmt.Sprintf("test.shared.%s", uuid.NewString()),
+		Durable:     true,
+		BindingKeys: []string{"shared.#"},
+	}
+	defer channel.QueueDelete(settings.QueueName, false, false, false)
+
+	exchangeSubscription := sut.NewExchangeSubscriptionWithSettings(amqpURL, EXCHANGE_NAME, settings)
+	err = exchangeSubscription.EnsureExchangeSubscriptionIsReady()
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	messages, err := exchangeSubscription.Consume(ctx)
+	assert.Nil(t, err)
+
+	// another replica consuming from the same queue
+	competingMessages, err := channel.Consume(settings.QueueName, uuid.NewString(), false, false, false, false, nil)
+	assert.Nil(t, err)
+
+	// Act
+	const messageCount = 10
+	for i := 0; i < messageCount; i++ {
+		err = channel.Publish(EXCHANGE_NAME, "shared.work", false, false, amqp.Publishing{
+			Body: []byte(fmt.Sprintf("%d", i)),
+		})
+		assert.Nil(t, err)
+	}
+
+	// Assert
+	received := map[string]int{}
+	subscriptionCount, competingCount := 0, 0
+	for len(received) < messageCount {
+		select {
+		case message := <-messages:
+			received[string(message.Body)]++
+			subscriptionCount++
+			assert.Nil(t, message.Ack())
+		case message := <-competingMessages:
+			received[string(message.Body)]++
+			competingCount++
+			assert.Nil(t, message.Ack(false))
+		case <-time.After(3 * time.Second):
+			assert.Fail(t, "did not receive messages in a timely manner")
+			return
+		}
+	}
+
+	for body, count := range received {
+		assert.Equal(t, 1, count, "message %s was delivered more than once", body)
+	}
+	assert.NotZero(t, subscriptionCount)
+	assert.NotZero(t, competingCount)
+}
+
+func Test_Consume_DeadLetter_RetriesThenDeadLetters(t *testing.T) {
+	// Arrange
+	conn, err := amqp.Dial(amqpURL)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	channel, err := conn.Channel()
+	assert.Nil(t, err)
+	defer channel.Close()
+
+	settings := &sut.SubscriptionSettings{
+		QueueName:   fmt.Sprintf("test.retry.%s", uuid.NewString()),
+		BindingKeys: []string{"retry.#"},
+		DeadLetter: &sut.DeadLetterSettings{
+			MaxRetries:  2,
+			RetryDelays: []time.Duration{50 * time.Millisecond, 100 * time.Millisecond},
+		},
+	}
+	defer channel.QueueDelete(settings.QueueName, false, false, false)
+	defer channel.QueueDelete(settings.QueueName+".dead-letter", false, false, false)
+	defer channel.QueueDelete(settings.QueueName+".retry.50ms", false, false, false)
+	defer channel.QueueDelete(settings.QueueName+".retry.100ms", false, false, false)
+	defer channel.ExchangeDelete(settings.QueueName+".dead-letter", false, false)
+
+	exchangeSubscription := sut.NewExchangeSubscriptionWithSettings(amqpURL, EXCHANGE_NAME, settings)
+	err = exchangeSubscription.EnsureExchangeSubscriptionIsReady()
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	messages, err := exchangeSubscription.Consume(ctx)
+	assert.Nil(t, err)
+
+	expectedBody := []byte(`{"poison":true}`)
+	err = channel.Publish(EXCHANGE_NAME, "retry.poison", false, false, amqp.Publishing{
+		Body: expectedBody,
+	})
+	assert.Nil(t, err)
+
+	// Act & Assert
+	for attempt := 0; attempt <= 2; attempt++ {
+		select {
+		case message := <-messages:
+			assert.Equal(t, expectedBody, message.Body)
+			assert.Equal(t, "retry.poison", message.RoutingKey)
+			if attempt > 0 {
+				assert.Equal(t, int32(attempt), message.Headers[sut.RetryCountHeader])
+			}
+			err = message.Nack()
+			assert.Nil(t, err)
+		case <-time.After(3 * time.Second):
+			assert.Fail(t, "did not receive message in a timely manner", "attempt %d", attempt)
+			return
+		}
+	}
+
+	deadLetters, err := channel.Consume(settings.QueueName+".dead-letter", uuid.NewString(), true, false, false, false, nil)
+	assert.Nil(t, err)
+
+	select {
+	case deadLetter := <-deadLetters:
+		assert.Equal(t, expectedBody, deadLetter.Body)
+	case <-time.After(3 * time.Second):
+		assert.Fail(t, "message was not dead-lettered in a timely manner")
+	}
+}
+
+func Test_Consume_DeadLetter_RejectsTransientQueue(t *testing.T) {
+	// Arrange
+	exchangeSubscription := sut.NewExchangeSubscriptionWithSettings(amqpURL, EXCHANGE_NAME, &sut.SubscriptionSettings{
+		AutoDelete: true,
+		Exclusive:  true,
+		DeadLetter: &sut.DeadLetterSettings{
+			MaxRetries: 1,
+		},
+	})
+
+	// Act
+	err := exchangeSubscription.EnsureExchangeSubscriptionIsReady()
+
+	// Assert
+	assert.Equal(t, sut.ErrDeadLetterOnTransientQueue, err)
+}
+
+func Test_Consume_DeadLetter_Reject(t *testing.T) {
+	// Arrange
+	conn, err := amqp.Dial(amqpURL)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	channel, err := conn.Channel()
+	assert.Nil(t, err)
+	defer channel.Close()
+
+	settings := &sut.SubscriptionSettings{
+		QueueName:   fmt.Sprintf("test.reject.%s", uuid.NewString()),
+		BindingKeys: []string{"reject.#"},
+		DeadLetter: &sut.DeadLetterSettings{
+			MaxRetries: 5,
+		},
+	}
+	defer channel.QueueDelete(settings.QueueName, false, false, false)
+	defer channel.QueueDelete(settings.QueueName+".dead-letter", false, false, false)
+	defer channel.QueueDelete(settings.QueueName+".retry.5s", false, false, false)
+	defer channel.ExchangeDelete(settings.QueueName+".dead-letter", false, false)
+
+	exchangeSubscription := sut.NewExchangeSubscriptionWithSettings(amqpURL, EXCHANGE_NAME, settings)
+	err = exchangeSubscription.EnsureExchangeSubscriptionIsReady()
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	messages, err := exchangeSubscription.Consume(ctx)
+	assert.Nil(t, err)
+
+	for _, routingKey := range []string{"reject.rejected", "reject.nacked"} {
+		err = channel.Publish(EXCHANGE_NAME, routingKey, false, false, amqp.Publishing{
+			Body: []byte(routingKey),
+		})
+		assert.Nil(t, err)
+	}
+
+	// Act
+	for i := 0; i < 2; i++ {
+		select {
+		case message := <-messages:
+			if string(message.Body) == "reject.rejected" {
+				err = message.Reject()
+			} else {
+				err = message.NackWithoutRequeue()
+			}
+			assert.Nil(t, err)
+		case <-time.After(3 * time.Second):
+			assert.Fail(t, "did not receive message in a timely manner")
+			return
+		}
+	}
+
+	// Assert
+	deadLetters, err := channel.Consume(settings.QueueName+".dead-letter", uuid.NewString(), true, false, false, false, nil)
+	assert.Nil(t, err)
+
+	received := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case deadLetter := <-deadLetters:
+			received[string(deadLetter.Body)] = true
+		case <-time.After(3 * time.Second):
+			assert.Fail(t, "message was not dead-lettered in a timely manner")
+			return
+		}
+	}
+	assert.Equal(t, map[string]bool{"reject.rejected": true, "reject.nacked": true}, received)
+}
+
+func Test_Consume_Reconnect_ResumesAfterConnectionLoss(t *testing.T) {
+	// Arrange
+	conn, err := amqp.Dial(amqpURL)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	channel, err := conn.Channel()
+	assert.Nil(t, err)
+	defer channel.Close()
+
+	proxy := newFlakyProxy(t, amqpURL)
+	defer proxy.Close()
+
+	settings := &sut.SubscriptionSettings{
+		QueueName:   fmt.Sprintf("test.reconnect.%s", uuid.NewString()),
+		BindingKeys: []string{"resume.#"},
+		Reconnect:   true,
+		ReconnectBackoff: sut.Backoff{
+			InitialInterval: 10 * time.Millisecond,
+		},
+	}
+	defer channel.QueueDelete(settings.QueueName, false, false, false)
+
+	exchangeSubscription := sut.NewExchangeSubscriptionWithSettings(proxy.url, EXCHANGE_NAME, settings)
+	err = exchangeSubscription.EnsureExchangeSubscriptionIsReady()
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	messages, err := exchangeSubscription.Consume(ctx)
+	assert.Nil(t, err)
+
+	// Act
+	proxy.Sever()
+
+	expectedBody := []byte(`{"VehicleId":6}`)
+	err = channel.Publish(EXCHANGE_NAME, "resume.after", false, false, amqp.Publishing{
+		Body: expectedBody,
+	})
+	assert.Nil(t, err)
+
+	// Assert
+	select {
+	case message, ok := <-messages:
+		assert.True(t, ok)
+		assert.Equal(t, expectedBody, message.Body)
+		assert.Nil(t, message.Ack())
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "did not resume consuming in a timely manner")
+	}
+
+	cancel()
+	select {
+	case _, ok := <-messages:
+		assert.False(t, ok)
+	case <-time.After(3 * time.Second):
+		assert.Fail(t, "did not close channel in a timely manner")
+	}
+}
+
+func Test_Close_WaitsForInFlightMessages(t *testing.T) {
+	// Arrange
+	conn, err := amqp.Dial(amqpURL)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	channel, err := conn.Channel()
+	assert.Nil(t, err)
+	defer channel.Close()
+
+	exchangeSubscription := sut.NewExchangeSubscriptionWithSettings(amqpURL, EXCHANGE_NAME, &sut.SubscriptionSettings{
+		AutoDelete:  true,
+		Exclusive:   true,
+		BindingKeys: []string{"close.wait"},
+	})
+	err = exchangeSubscription.EnsureExchangeSubscriptionIsReady()
+	assert.Nil(t, err)
+
+	messages, err := exchangeSubscription.Consume(context.Background())
+	assert.Nil(t, err)
+
+	err = channel.Publish(EXCHANGE_NAME, "close.wait", false, false, amqp.Publishing{
+		Body: []byte(`{}`),
+	})
+	assert.Nil(t, err)
+
+	var message *sut.Message
+	select {
+	case message = <-messages:
+	case <-time.After(3 * time.Second):
+		assert.Fail(t, "expected to receive message within a timely manner")
+		return
+	}
+
+	closed := make(chan error)
+
+	// Act
+	go func() {
+		closed <- exchangeSubscription.Close(context.Background())
+	}()
+
+	// Assert
+	select {
+	case <-closed:
+		assert.Fail(t, "closed before the in-flight message was acknowledged")
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	assert.Nil(t, message.Ack())
+
+	select {
+	case err = <-closed:
+		assert.Nil(t, err)
+	case <-time.After(3 * time.Second):
+		assert.Fail(t, "did not close in a timely manner")
+	}
+
+	_, err = exchangeSubscription.Consume(context.Background())
+	assert.Equal(t, sut.ErrClosed, err)
+}
+
+func Test_Close_TimesOutWithUnacknowledgedMessages(t *testing.T) {
+	// Arrange
+	conn, err := amqp.Dial(amqpURL)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	channel, err := conn.Channel()
+	assert.Nil(t, err)
+	defer channel.Close()
+
+	exchangeSubscription := sut.NewExchangeSubscriptionWithSettings(amqpURL, EXCHANGE_NAME, &sut.SubscriptionSettings{
+		AutoDelete:  true,
+		Exclusive:   true,
+		BindingKeys: []string{"close.timeout"},
+	})
+	err = exchangeSubscription.EnsureExchangeSubscriptionIsReady()
+	assert.Nil(t, err)
+
+	messages, err := exchangeSubscription.Consume(context.Background())
+	assert.Nil(t, err)
+
+	err = channel.Publish(EXCHANGE_NAME, "close.timeout", false, false, amqp.Publishing{
+		Body: []byte(`{}`),
+	})
+	assert.Nil(t, err)
+
+	select {
+	case <-messages:
+	case <-time.After(3 * time.Second):
+		assert.Fail(t, "expected to receive message within a timely manner")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	// Act
+	err = exchangeSubscription.Close(ctx)
+
+	// Assert
+	assert.NotNil(t, err)
+	assert.Equal(t, context.DeadlineExceeded, errors.Cause(err))
+}
@@ -0,0 +1,80 @@
+package amqp
+
+import (
+	"context"
+	"sync"
+)
+
+// inFlight counts outstanding work so that closing can stop new work and wait for the outstanding work to finish
+type inFlight struct {
+	mutex  sync.Mutex
+	count  int
+	closed bool
+	idle   chan struct{}
+}
+
+func newInFlight() *inFlight {
+	idle := make(chan struct{})
+	close(idle)
+
+	return &inFlight{
+		idle: idle,
+	}
+}
+
+// start begins a unit of work, returning false if closing has begun
+func (f *inFlight) start() bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.closed {
+		return false
+	}
+
+	if f.count == 0 {
+		f.idle = make(chan struct{})
+	}
+	f.count++
+
+	return true
+}
+
+// done finishes a unit of work
+func (f *inFlight) done() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.count--
+	if f.count == 0 {
+		close(f.idle)
+	}
+}
+
+// close stops any new work from starting
+func (f *inFlight) close() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.closed = true
+}
+
+func (f *inFlight) isClosed() bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.closed
+}
+
+// wait blocks until all outstanding work is done or the context ends
+func (f *inFlight) wait(ctx context.Context) error {
+	f.mutex.Lock()
+	idle := f.idle
+	f.mutex.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
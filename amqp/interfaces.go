@@ -0,0 +1,30 @@
+package amqp
+
+import "context"
+
+// Publisher publishes messages to exchanges. It is implemented by ExchangePublisher, and by the in-memory fake in the
+// amqptest package for tests that run without a broker.
+type Publisher interface {
+	Publish(exchangeName string, headers map[string]string, body []byte) error
+	PublishContext(ctx context.Context, exchangeName string, headers map[string]string, body []byte) error
+	PublishWithRoutingKey(exchangeName string, routingKey string, body []byte) error
+	PublishWithRoutingKeyContext(ctx context.Context, exchangeName string, routingKey string, body []byte) error
+	PublishMessage(ctx context.Context, exchangeName string, message *Publishing) error
+	PublishValue(ctx context.Context, exchangeName string, routingKey string, codec Codec, value interface{}) error
+	Close(ctx context.Context) error
+}
+
+// Subscriber consumes the messages routed to a queue bound to an exchange. It is implemented by ExchangeSubscription,
+// and by the in-memory fake in the amqptest package for tests that run without a broker.
+type Subscriber interface {
+	Consume(ctx context.Context) (<-chan *Message, error)
+	ConsumeWithHandler(ctx context.Context, handler MessageHandler, concurrency int) error
+	ExchangeName() string
+	QueueName() string
+	Close(ctx context.Context) error
+}
+
+var (
+	_ Publisher  = (*ExchangePublisher)(nil)
+	_ Subscriber = (*ExchangeSubscription)(nil)
+)
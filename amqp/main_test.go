@@ -4,7 +4,8 @@ import (
 	"os"
 	"testing"
 
-	"github.com/streadway/amqp"
+	goredis "github.com/go-redis/redis"
+	sut "github.com/syncromatics/go-kit/v2/amqp"
 	"github.com/syncromatics/go-kit/v2/testing/docker"
 )
 
@@ -13,7 +14,8 @@ const (
 )
 
 var (
-	amqpURL string
+	amqpURL      string
+	redisOptions *goredis.Options
 )
 
 func TestMain(m *testing.M) {
@@ -39,6 +41,14 @@ func setup() []func() error {
 		return docker.TeardownRabbitMQ("amqp")
 	})
 
+	redisOptions, err = docker.SetupRedis("amqp")
+	if err != nil {
+		panic(err)
+	}
+	teardowns = append(teardowns, func() error {
+		return docker.TeardownRedis("amqp")
+	})
+
 	err = setupExchanges(amqpURL)
 	if err != nil {
 		panic(err)
@@ -57,27 +67,11 @@ func teardown(teardowns []func() error) {
 }
 
 func setupExchanges(url string) error {
-	conn, err := amqp.Dial(url)
-	if err != nil {
-		return err
-	}
-	defer conn.Close()
-
-	channel, err := conn.Channel()
-	if err != nil {
-		return err
-	}
-	defer channel.Close()
-
-	topicExchangeNames := []string{
-		EXCHANGE_NAME,
-	}
-	for _, exchangeName := range topicExchangeNames {
-		err = channel.ExchangeDeclare(exchangeName, "topic", true, false, false, false, nil)
-		if err != nil {
-			return err
-		}
+	topology := &sut.Topology{
+		Exchanges: []sut.Exchange{
+			{Name: EXCHANGE_NAME, Kind: sut.ExchangeTopic, Durable: true},
+		},
 	}
 
-	return nil
+	return topology.Apply(url)
 }
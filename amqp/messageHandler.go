@@ -0,0 +1,143 @@
+package amqp
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/pkg/errors"
+	"github.com/syncromatics/go-kit/v2/log"
+)
+
+// MessageHandler processes a message delivered by an ExchangeSubscription
+//
+// Returning nil acknowledges the message. Returning an error nacks the message, unless the error is marked with
+// Permanent, in which case the message is rejected.
+type MessageHandler func(ctx context.Context, message *Message) error
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+// Cause returns the underlying error
+func (e *permanentError) Cause() error {
+	return e.err
+}
+
+// Permanent marks an error as one that retrying will not fix, so that the message is rejected rather than nacked.
+// It returns nil when the error is nil.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err}
+}
+
+// IsPermanent reports whether the error, or any error that it wraps, was marked with Permanent
+func IsPermanent(err error) bool {
+	// errors.Cause would unwrap the permanent error itself, so each cause is checked on the way down
+	for err != nil {
+		if _, ok := err.(*permanentError); ok {
+			return true
+		}
+
+		switch wrapped := err.(type) {
+		case interface{ Cause() error }:
+			err = wrapped.Cause()
+		case interface{ Unwrap() error }:
+			err = wrapped.Unwrap()
+		default:
+			return false
+		}
+	}
+
+	return false
+}
+
+// ConsumeWithHandler consumes messages with the given number of concurrent workers, each passing messages to the
+// handler and acknowledging them according to its result
+//
+// It blocks until the context is cancelled or the subscription is closed, and every in-flight message has been
+// handled. If the subscription stops for any other reason, an error is returned.
+//
+// The context passed to the handler carries the span of the message, so that the trace continues from the publisher.
+func (es *ExchangeSubscription) ConsumeWithHandler(ctx context.Context, handler MessageHandler, concurrency int) error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	messages, err := es.Consume(ctx)
+	if err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for message := range messages {
+				es.handle(ctx, handler, message)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if ctx.Err() == nil && !es.inFlight.isClosed() {
+		return errors.Errorf("subscription to exchange '%s' stopped unexpectedly", es.exchangeName)
+	}
+
+	return nil
+}
+
+func (es *ExchangeSubscription) handle(ctx context.Context, handler MessageHandler, message *Message) {
+	es.messagesInFlight.Inc()
+	defer es.messagesInFlight.Dec()
+
+	span := opentracing.SpanFromContext(message.Context())
+	if span != nil {
+		ctx = opentracing.ContextWithSpan(ctx, span)
+	}
+
+	start := time.Now()
+	handlerErr := handler(ctx, message)
+	if !message.timed {
+		es.handlerDuration.WithLabelValues("", handlerResult(handlerErr)).Observe(time.Since(start).Seconds())
+	}
+
+	if handlerErr != nil && span != nil {
+		ext.Error.Set(span, true)
+		span.LogKV("event", "error", "message", handlerErr.Error())
+	}
+
+	var err error
+	switch {
+	case handlerErr == nil:
+		err = message.Ack()
+	case IsPermanent(handlerErr):
+		log.Warn("rejecting message that failed permanently",
+			"err", handlerErr,
+			"queue", es.queueName,
+		)
+		err = message.Reject()
+	default:
+		log.Warn("nacking message that failed",
+			"err", handlerErr,
+			"queue", es.queueName,
+		)
+		err = message.Nack()
+	}
+
+	if err != nil {
+		log.Error("failed to acknowledge message",
+			"err", err,
+			"queue", es.queueName,
+		)
+	}
+}
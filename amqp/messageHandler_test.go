@@ -0,0 +1,170 @@
+package amqp_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	sut "github.com/syncromatics/go-kit/v2/amqp"
+)
+
+func Test_ConsumeWithHandler_RunsConcurrentWorkers(t *testing.T) {
+	// Arrange
+	conn, err := amqp.Dial(amqpURL)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	channel, err := conn.Channel()
+	assert.Nil(t, err)
+	defer channel.Close()
+
+	exchangeSubscription := sut.NewExchangeSubscriptionWithSettings(amqpURL, EXCHANGE_NAME, &sut.SubscriptionSettings{
+		AutoDelete:    true,
+		Exclusive:     true,
+		BindingKeys:   []string{"workers.#"},
+		PrefetchCount: 3,
+	})
+	err = exchangeSubscription.EnsureExchangeSubscriptionIsReady()
+	assert.Nil(t, err)
+
+	const messageCount = 9
+	var inFlight, maxInFlight, handled int32
+	var wg sync.WaitGroup
+	wg.Add(messageCount)
+	handler := func(ctx context.Context, message *sut.Message) error {
+		defer wg.Done()
+
+		current := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			max := atomic.LoadInt32(&maxInFlight)
+			if current <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, current) {
+				break
+			}
+		}
+
+		time.Sleep(100 * time.Millisecond)
+		atomic.AddInt32(&handled, 1)
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+
+	// Act
+	go func() {
+		done <- exchangeSubscription.ConsumeWithHandler(ctx, handler, 3)
+	}()
+
+	for i := 0; i < messageCount; i++ {
+		err = channel.Publish(EXCHANGE_NAME, "workers.job", false, false, amqp.Publishing{
+			Body: []byte(fmt.Sprintf("%d", i)),
+		})
+		assert.Nil(t, err)
+	}
+
+	// Assert
+	waited := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(waited)
+	}()
+
+	select {
+	case <-waited:
+	case <-time.After(3 * time.Second):
+		assert.Fail(t, "did not handle messages in a timely manner")
+	}
+
+	cancel()
+	select {
+	case err = <-done:
+		assert.Nil(t, err)
+	case <-time.After(3 * time.Second):
+		assert.Fail(t, "did not stop in a timely manner")
+	}
+
+	assert.Equal(t, int32(messageCount), atomic.LoadInt32(&handled))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&maxInFlight))
+}
+
+func Test_ConsumeWithHandler_AcknowledgesByResult(t *testing.T) {
+	// Arrange
+	conn, err := amqp.Dial(amqpURL)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	channel, err := conn.Channel()
+	assert.Nil(t, err)
+	defer channel.Close()
+
+	settings := &sut.SubscriptionSettings{
+		QueueName:   fmt.Sprintf("test.handler.%s", uuid.NewString()),
+		BindingKeys: []string{"handler.#"},
+		DeadLetter:  &sut.DeadLetterSettings{},
+	}
+	defer channel.QueueDelete(settings.QueueName, false, false, false)
+	defer channel.QueueDelete(settings.QueueName+".dead-letter", false, false, false)
+	defer channel.QueueDelete(settings.QueueName+".retry.5s", false, false, false)
+	defer channel.ExchangeDelete(settings.QueueName+".dead-letter", false, false)
+
+	exchangeSubscription := sut.NewExchangeSubscriptionWithSettings(amqpURL, EXCHANGE_NAME, settings)
+	err = exchangeSubscription.EnsureExchangeSubscriptionIsReady()
+	assert.Nil(t, err)
+
+	handled := make(chan string, 2)
+	handler := func(ctx context.Context, message *sut.Message) error {
+		defer func() { handled <- string(message.Body) }()
+
+		if string(message.Body) == "poison" {
+			return sut.Permanent(errors.New("cannot be processed"))
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go exchangeSubscription.ConsumeWithHandler(ctx, handler, 2)
+
+	// Act
+	for _, body := range []string{"good", "poison"} {
+		err = channel.Publish(EXCHANGE_NAME, "handler.job", false, false, amqp.Publishing{
+			Body: []byte(body),
+		})
+		assert.Nil(t, err)
+	}
+
+	// Assert
+	for i := 0; i < 2; i++ {
+		select {
+		case <-handled:
+		case <-time.After(3 * time.Second):
+			assert.Fail(t, "did not handle messages in a timely manner")
+			return
+		}
+	}
+
+	deadLetters, err := channel.Consume(settings.QueueName+".dead-letter", uuid.NewString(), true, false, false, false, nil)
+	assert.Nil(t, err)
+
+	select {
+	case deadLetter := <-deadLetters:
+		assert.Equal(t, "poison", string(deadLetter.Body))
+	case <-time.After(3 * time.Second):
+		assert.Fail(t, "poison message was not rejected in a timely manner")
+	}
+
+	select {
+	case deadLetter := <-deadLetters:
+		assert.Fail(t, "acknowledged message was dead-lettered", string(deadLetter.Body))
+	case <-time.After(500 * time.Millisecond):
+	}
+}
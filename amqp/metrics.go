@@ -0,0 +1,159 @@
+package amqp
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	sharedmetrics "github.com/syncromatics/go-kit/v2/internal/metrics"
+)
+
+// metrics are the collectors registered with a single prometheus.Registerer. They are shared by every publisher and
+// subscription using that registerer, and unregistered once the last of them is closed.
+type metrics struct {
+	registration *sharedmetrics.Registration
+
+	reconnectAttempts *prometheus.CounterVec
+	connectionOutages *prometheus.CounterVec
+
+	publisherChannels      prometheus.Gauge
+	publisherChannelsInUse prometheus.Gauge
+	publisherChannelWait   prometheus.Histogram
+
+	activeConsumers  *prometheus.GaugeVec
+	messagesConsumed *prometheus.CounterVec
+	messagesAcked    *prometheus.CounterVec
+	messagesNacked   *prometheus.CounterVec
+	messagesRejected *prometheus.CounterVec
+	messagesRetried  *prometheus.CounterVec
+	messagesInFlight *prometheus.GaugeVec
+	handlerDuration  *prometheus.HistogramVec
+	consumerRestarts *prometheus.CounterVec
+
+	rpcCalls        *prometheus.CounterVec
+	rpcCallErrors   *prometheus.CounterVec
+	rpcCallDuration *prometheus.HistogramVec
+
+	deduplicationHits   *prometheus.CounterVec
+	deduplicationMisses *prometheus.CounterVec
+}
+
+// registrations shares the metrics between every client using the same registerer
+var registrations = sharedmetrics.NewRegistrations()
+
+// acquireMetrics returns the metrics registered with the given registerer, registering them if this is the first use.
+// The default registerer is used when nil.
+func acquireMetrics(registerer prometheus.Registerer) *metrics {
+	return registrations.Acquire(registerer, func(registration *sharedmetrics.Registration) interface{} {
+		return newMetrics(registration)
+	}).(*metrics)
+}
+
+// release unregisters the metrics once nothing is using them any longer
+func (m *metrics) release() {
+	registrations.Release(m.registration)
+}
+
+func newMetrics(registration *sharedmetrics.Registration) *metrics {
+	m := &metrics{
+		registration: registration,
+	}
+
+	clientLabels := []string{"amqp_client"}
+	exchangeLabels := []string{"amqp_exchange"}
+
+	m.reconnectAttempts = m.registration.Register(prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "amqp_reconnect_attempts_total",
+		Help: "The total number of attempts to reconnect to the broker",
+	}, clientLabels)).(*prometheus.CounterVec)
+
+	m.connectionOutages = m.registration.Register(prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "amqp_connection_outages_total",
+		Help: "The total number of times the connection to the broker was lost",
+	}, clientLabels)).(*prometheus.CounterVec)
+
+	m.publisherChannels = m.registration.Register(prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "amqp_publisher_channels",
+		Help: "The number of channels held open by publisher channel pools",
+	})).(prometheus.Gauge)
+
+	m.publisherChannelsInUse = m.registration.Register(prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "amqp_publisher_channels_in_use",
+		Help: "The number of pooled publisher channels currently checked out for publishing",
+	})).(prometheus.Gauge)
+
+	m.publisherChannelWait = m.registration.Register(prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "amqp_publisher_channel_wait_seconds",
+		Help:    "How long publishing waited for a channel from the pool",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+	})).(prometheus.Histogram)
+
+	m.activeConsumers = m.registration.Register(prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "amqp_consumers_total",
+		Help: "The total number of consumers connected to the queue that is subscribed to the exchange",
+	}, exchangeLabels)).(*prometheus.GaugeVec)
+
+	m.messagesConsumed = m.registration.Register(prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "amqp_messages_recv_total",
+		Help: "The total number of received messages",
+	}, exchangeLabels)).(*prometheus.CounterVec)
+
+	m.messagesAcked = m.registration.Register(prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "amqp_messages_ack_total",
+		Help: "The total number of acknowledged messages",
+	}, exchangeLabels)).(*prometheus.CounterVec)
+
+	m.messagesNacked = m.registration.Register(prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "amqp_messages_nack_total",
+		Help: "The total number of negatively acknowledged messages",
+	}, exchangeLabels)).(*prometheus.CounterVec)
+
+	m.messagesRejected = m.registration.Register(prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "amqp_messages_reject_total",
+		Help: "The total number of rejected messages",
+	}, exchangeLabels)).(*prometheus.CounterVec)
+
+	m.messagesRetried = m.registration.Register(prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "amqp_messages_retry_total",
+		Help: "The total number of messages scheduled for a delayed retry",
+	}, exchangeLabels)).(*prometheus.CounterVec)
+
+	m.messagesInFlight = m.registration.Register(prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "amqp_messages_inflight",
+		Help: "The number of messages currently being processed by handlers",
+	}, exchangeLabels)).(*prometheus.GaugeVec)
+
+	m.handlerDuration = m.registration.Register(prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "amqp_handler_duration_seconds",
+		Help: "How long handlers took to process messages, by handler name and result",
+	}, []string{"amqp_exchange", "amqp_handler", "amqp_result"})).(*prometheus.HistogramVec)
+
+	m.consumerRestarts = m.registration.Register(prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "amqp_consumer_restarts_total",
+		Help: "The total number of times a consumer resumed after its channel or connection was lost",
+	}, exchangeLabels)).(*prometheus.CounterVec)
+
+	m.rpcCalls = m.registration.Register(prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "amqp_rpc_calls_total",
+		Help: "The total number of remote procedure calls made by RPC clients",
+	}, exchangeLabels)).(*prometheus.CounterVec)
+
+	m.rpcCallErrors = m.registration.Register(prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "amqp_rpc_call_errors_total",
+		Help: "The total number of remote procedure calls that failed or timed out",
+	}, exchangeLabels)).(*prometheus.CounterVec)
+
+	m.rpcCallDuration = m.registration.Register(prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "amqp_rpc_call_duration_seconds",
+		Help: "How long remote procedure calls took to receive a reply",
+	}, exchangeLabels)).(*prometheus.HistogramVec)
+
+	m.deduplicationHits = m.registration.Register(prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "amqp_deduplication_hits_total",
+		Help: "The total number of duplicate messages that were skipped",
+	}, exchangeLabels)).(*prometheus.CounterVec)
+
+	m.deduplicationMisses = m.registration.Register(prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "amqp_deduplication_misses_total",
+		Help: "The total number of messages that had not been seen before",
+	}, exchangeLabels)).(*prometheus.CounterVec)
+
+	return m
+}
@@ -0,0 +1,180 @@
+package amqp_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	sut "github.com/syncromatics/go-kit/v2/amqp"
+)
+
+func Test_Metrics_SharedByIdenticalSubscriptions(t *testing.T) {
+	// Arrange
+	registry := prometheus.NewRegistry()
+	settings := &sut.SubscriptionSettings{
+		QueueName:  "test.metrics.shared",
+		Registerer: registry,
+	}
+
+	// Act
+	first := sut.NewExchangeSubscriptionWithSettings(amqpURL, EXCHANGE_NAME, settings)
+	second := sut.NewExchangeSubscriptionWithSettings(amqpURL, EXCHANGE_NAME, settings)
+
+	// Assert
+	families, err := registry.Gather()
+	assert.Nil(t, err)
+
+	consumers := findMetricFamily(families, "amqp_consumers_total")
+	if assert.NotNil(t, consumers) {
+		assert.Len(t, consumers.Metric, 1)
+		assert.Equal(t, "amqp_exchange", consumers.Metric[0].Label[0].GetName())
+		assert.Equal(t, EXCHANGE_NAME, consumers.Metric[0].Label[0].GetValue())
+	}
+
+	// Act
+	assert.Nil(t, first.Close(context.Background()))
+
+	// Assert
+	families, err = registry.Gather()
+	assert.Nil(t, err)
+	assert.NotNil(t, findMetricFamily(families, "amqp_consumers_total"))
+
+	// Act
+	assert.Nil(t, second.Close(context.Background()))
+	assert.Nil(t, second.Close(context.Background()))
+
+	// Assert
+	families, err = registry.Gather()
+	assert.Nil(t, err)
+	assert.Empty(t, families)
+}
+
+func Test_Metrics_PublisherUnregistersOnClose(t *testing.T) {
+	// Arrange
+	registry := prometheus.NewRegistry()
+	publisher := sut.NewExchangePublisherWithSettings(amqpURL, &sut.PublisherSettings{
+		ChannelPoolSize: 2,
+		Registerer:      registry,
+	})
+
+	err := publisher.EnsurePublisherIsReady()
+	assert.Nil(t, err)
+
+	err = publisher.PublishWithRoutingKey(EXCHANGE_NAME, "metrics", []byte(`{}`))
+	assert.Nil(t, err)
+
+	families, err := registry.Gather()
+	assert.Nil(t, err)
+	assert.NotNil(t, findMetricFamily(families, "amqp_publisher_channels"))
+
+	// Act
+	err = publisher.Close(context.Background())
+
+	// Assert
+	assert.Nil(t, err)
+
+	families, err = registry.Gather()
+	assert.Nil(t, err)
+	assert.Empty(t, families)
+}
+
+func Test_Metrics_LeavesExistingCollectorsRegistered(t *testing.T) {
+	// Arrange
+	registry := prometheus.NewRegistry()
+	existing := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "amqp_messages_recv_total",
+		Help: "The total number of received messages",
+	}, []string{"amqp_exchange"})
+	registry.MustRegister(existing)
+
+	subscription := sut.NewExchangeSubscriptionWithSettings(amqpURL, EXCHANGE_NAME, &sut.SubscriptionSettings{
+		QueueName:  "test.metrics.existing",
+		Registerer: registry,
+	})
+
+	// Act
+	err := subscription.Close(context.Background())
+
+	// Assert
+	assert.Nil(t, err)
+
+	existing.WithLabelValues(EXCHANGE_NAME).Inc()
+	families, err := registry.Gather()
+	assert.Nil(t, err)
+	assert.Len(t, families, 1)
+	assert.NotNil(t, findMetricFamily(families, "amqp_messages_recv_total"))
+}
+
+func Test_Metrics_HandlerDurationObservedOncePerMessage(t *testing.T) {
+	// Arrange
+	conn, err := amqp.Dial(amqpURL)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	channel, err := conn.Channel()
+	assert.Nil(t, err)
+	defer channel.Close()
+
+	registry := prometheus.NewRegistry()
+	exchangeSubscription := sut.NewExchangeSubscriptionWithSettings(amqpURL, EXCHANGE_NAME, &sut.SubscriptionSettings{
+		AutoDelete:  true,
+		Exclusive:   true,
+		BindingKeys: []string{"metrics.handler.#"},
+		Registerer:  registry,
+	})
+	defer exchangeSubscription.Close(context.Background())
+
+	err = exchangeSubscription.EnsureExchangeSubscriptionIsReady()
+	assert.Nil(t, err)
+
+	handler := func(ctx context.Context, message *sut.Message) error {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go exchangeSubscription.ConsumeWithHandler(ctx, exchangeSubscription.MetricsMiddleware("positions")(handler), 1)
+
+	// Act
+	err = channel.Publish(EXCHANGE_NAME, "metrics.handler.position", false, false, amqp.Publishing{
+		Body: []byte(`{}`),
+	})
+	assert.Nil(t, err)
+
+	// Assert
+	var duration *dto.MetricFamily
+	for start := time.Now(); duration == nil && time.Since(start) < 3*time.Second; time.Sleep(10 * time.Millisecond) {
+		families, err := registry.Gather()
+		assert.Nil(t, err)
+		duration = findMetricFamily(families, "amqp_handler_duration_seconds")
+	}
+
+	if assert.NotNil(t, duration) && assert.Len(t, duration.Metric, 1) {
+		metric := duration.Metric[0]
+		assert.Equal(t, uint64(1), metric.GetHistogram().GetSampleCount())
+
+		labels := map[string]string{}
+		for _, label := range metric.Label {
+			labels[label.GetName()] = label.GetValue()
+		}
+		assert.Equal(t, map[string]string{
+			"amqp_exchange": EXCHANGE_NAME,
+			"amqp_handler":  "positions",
+			"amqp_result":   "ack",
+		}, labels)
+	}
+}
+
+func findMetricFamily(families []*dto.MetricFamily, name string) *dto.MetricFamily {
+	for _, family := range families {
+		if family.GetName() == name {
+			return family
+		}
+	}
+	return nil
+}
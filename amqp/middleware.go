@@ -0,0 +1,135 @@
+package amqp
+
+import (
+	"context"
+	"runtime/debug"
+	"time"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/pkg/errors"
+	"github.com/syncromatics/go-kit/v2/log"
+)
+
+// MessageMiddleware wraps a MessageHandler with additional behavior
+type MessageMiddleware func(MessageHandler) MessageHandler
+
+// ChainMessageMiddleware creates a single middleware out of many, in the same manner as
+// grpc_middleware.ChainUnaryServer. The first middleware is the outermost, so that
+//
+//	ChainMessageMiddleware(one, two, three)(handler)
+//
+// passes each message through one, then two, then three, before it reaches the handler.
+func ChainMessageMiddleware(middlewares ...MessageMiddleware) MessageMiddleware {
+	return func(handler MessageHandler) MessageHandler {
+		for i := len(middlewares) - 1; i >= 0; i-- {
+			handler = middlewares[i](handler)
+		}
+		return handler
+	}
+}
+
+// RecoveryMiddleware recovers from panics in the handler, logging them and returning an error so that the message is
+// nacked instead of crashing the process
+func RecoveryMiddleware() MessageMiddleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(ctx context.Context, message *Message) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Error("recovered from panic in message handler",
+						"panic", r,
+						"exchange", message.Exchange,
+						"routingKey", message.RoutingKey,
+						"stack", string(debug.Stack()),
+					)
+					err = errors.Errorf("panic in message handler: %v", r)
+				}
+			}()
+
+			return next(ctx, message)
+		}
+	}
+}
+
+// LoggingMiddleware logs the result of handling each message through the log package
+func LoggingMiddleware() MessageMiddleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(ctx context.Context, message *Message) error {
+			start := time.Now()
+			err := next(ctx, message)
+
+			keysAndValues := []interface{}{
+				"exchange", message.Exchange,
+				"routingKey", message.RoutingKey,
+				"messageID", message.MessageID,
+				"duration", time.Since(start),
+			}
+
+			switch {
+			case err == nil:
+				log.Debug("handled message", keysAndValues...)
+			case IsPermanent(err):
+				log.Warn("message failed permanently", append(keysAndValues, "err", err)...)
+			default:
+				log.Warn("message failed", append(keysAndValues, "err", err)...)
+			}
+
+			return err
+		}
+	}
+}
+
+// TracingMiddleware wraps the handler in a span with the given operation name, as a child of the message's span
+func TracingMiddleware(operationName string) MessageMiddleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(ctx context.Context, message *Message) error {
+			parent := opentracing.SpanFromContext(ctx)
+			if parent == nil {
+				parent = opentracing.SpanFromContext(message.Context())
+			}
+
+			tracer := opentracing.GlobalTracer()
+			var options []opentracing.StartSpanOption
+			if parent != nil {
+				tracer = parent.Tracer()
+				options = append(options, opentracing.ChildOf(parent.Context()))
+			}
+
+			span := tracer.StartSpan(operationName, options...)
+			err := next(opentracing.ContextWithSpan(ctx, span), message)
+			finishSpan(span, err)
+
+			return err
+		}
+	}
+}
+
+// MetricsMiddleware records how long the handler takes to process each message in the subscription's handler duration
+// histogram, labelled with the handler's name and the result: ack, nack or reject
+//
+// ConsumeWithHandler otherwise observes the whole handler with an empty handler name, and skips that observation for
+// messages that have been timed by this middleware, so that each message is only counted once.
+func (es *ExchangeSubscription) MetricsMiddleware(handlerName string) MessageMiddleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(ctx context.Context, message *Message) error {
+			start := time.Now()
+			err := next(ctx, message)
+
+			es.handlerDuration.WithLabelValues(handlerName, handlerResult(err)).Observe(time.Since(start).Seconds())
+			message.timed = true
+
+			return err
+		}
+	}
+}
+
+// handlerResult is how a message is acknowledged after the handler returns the error
+func handlerResult(err error) string {
+	switch {
+	case err == nil:
+		return "ack"
+	case IsPermanent(err):
+		return "reject"
+	default:
+		return "nack"
+	}
+}
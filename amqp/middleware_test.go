@@ -0,0 +1,167 @@
+package amqp_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	pkgerrors "github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	sut "github.com/syncromatics/go-kit/v2/amqp"
+)
+
+func Test_ChainMessageMiddleware_AppliesInOrder(t *testing.T) {
+	// Arrange
+	var calls []string
+	record := func(name string) sut.MessageMiddleware {
+		return func(next sut.MessageHandler) sut.MessageHandler {
+			return func(ctx context.Context, message *sut.Message) error {
+				calls = append(calls, name+" before")
+				err := next(ctx, message)
+				calls = append(calls, name+" after")
+				return err
+			}
+		}
+	}
+
+	handler := sut.ChainMessageMiddleware(record("one"), record("two"))(func(ctx context.Context, message *sut.Message) error {
+		calls = append(calls, "handler")
+		return nil
+	})
+
+	// Act
+	err := handler(context.Background(), &sut.Message{})
+
+	// Assert
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"one before", "two before", "handler", "two after", "one after"}, calls)
+}
+
+func Test_RecoveryMiddleware_ReturnsErrorOnPanic(t *testing.T) {
+	// Arrange
+	handler := sut.RecoveryMiddleware()(func(ctx context.Context, message *sut.Message) error {
+		panic("nil vehicle")
+	})
+
+	// Act
+	err := handler(context.Background(), &sut.Message{Exchange: EXCHANGE_NAME})
+
+	// Assert
+	assert.NotNil(t, err)
+	assert.False(t, sut.IsPermanent(err))
+	assert.Contains(t, err.Error(), "nil vehicle")
+}
+
+func Test_IsPermanent_DetectsWrappedErrors(t *testing.T) {
+	// Arrange
+	permanent := sut.Permanent(errors.New("malformed"))
+
+	tests := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{name: "permanent", err: permanent, expected: true},
+		{name: "wrapped", err: pkgerrors.Wrap(permanent, "failed to decode"), expected: true},
+		{name: "fmt wrapped", err: fmt.Errorf("failed to decode: %w", permanent), expected: true},
+		{name: "transient", err: pkgerrors.Wrap(errors.New("timeout"), "failed to save"), expected: false},
+		{name: "nil", err: nil, expected: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Act
+			actual := sut.IsPermanent(test.err)
+
+			// Assert
+			assert.Equal(t, test.expected, actual)
+		})
+	}
+}
+
+func Test_Permanent_Nil(t *testing.T) {
+	// Act
+	err := sut.Permanent(nil)
+
+	// Assert
+	assert.Nil(t, err)
+	assert.False(t, sut.IsPermanent(err))
+}
+
+func Test_LoggingMiddleware_PassesResultThrough(t *testing.T) {
+	// Arrange
+	expected := sut.Permanent(errors.New("malformed"))
+	handler := sut.LoggingMiddleware()(func(ctx context.Context, message *sut.Message) error {
+		return expected
+	})
+
+	// Act
+	err := handler(context.Background(), &sut.Message{Exchange: EXCHANGE_NAME})
+
+	// Assert
+	assert.Equal(t, expected, err)
+}
+
+func Test_TracingMiddleware_StartsChildSpan(t *testing.T) {
+	// Arrange
+	tracer := mocktracer.New()
+	parent := tracer.StartSpan("amqp consume")
+	ctx := opentracing.ContextWithSpan(context.Background(), parent)
+
+	var handlerSpan opentracing.Span
+	handler := sut.TracingMiddleware("update position")(func(ctx context.Context, message *sut.Message) error {
+		handlerSpan = opentracing.SpanFromContext(ctx)
+		return errors.New("failed")
+	})
+
+	// Act
+	err := handler(ctx, &sut.Message{})
+
+	// Assert
+	assert.NotNil(t, err)
+
+	finished := tracer.FinishedSpans()
+	if assert.Len(t, finished, 1) {
+		span := finished[0]
+		assert.Equal(t, "update position", span.OperationName)
+		assert.Equal(t, parent.(*mocktracer.MockSpan).SpanContext.SpanID, span.ParentID)
+		assert.Equal(t, true, span.Tag("error"))
+		assert.Equal(t, span, handlerSpan)
+	}
+}
+
+func Test_MetricsMiddleware_ObservesByResult(t *testing.T) {
+	// Arrange
+	registry := prometheus.NewRegistry()
+	exchangeSubscription := sut.NewExchangeSubscriptionWithSettings(amqpURL, EXCHANGE_NAME, &sut.SubscriptionSettings{
+		Registerer: registry,
+	})
+	defer exchangeSubscription.Close(context.Background())
+
+	results := []error{nil, errors.New("failed"), sut.Permanent(errors.New("malformed"))}
+	handler := exchangeSubscription.MetricsMiddleware("positions")(func(ctx context.Context, message *sut.Message) error {
+		err := results[0]
+		results = results[1:]
+		return err
+	})
+
+	// Act
+	for i := 0; i < 3; i++ {
+		handler(context.Background(), &sut.Message{})
+	}
+
+	// Assert
+	families, err := registry.Gather()
+	assert.Nil(t, err)
+
+	duration := findMetricFamily(families, "amqp_handler_duration_seconds")
+	if assert.NotNil(t, duration) && assert.Len(t, duration.Metric, 3) {
+		for _, metric := range duration.Metric {
+			assert.Equal(t, uint64(1), metric.GetHistogram().GetSampleCount())
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package amqp_test
+
+import (
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// flakyProxy forwards TCP connections to a broker and can sever them on demand to simulate network failures
+type flakyProxy struct {
+	listener net.Listener
+	target   string
+	url      string
+
+	mutex       sync.Mutex
+	connections []net.Conn
+}
+
+func newFlakyProxy(t *testing.T, amqpURL string) *flakyProxy {
+	target, err := url.Parse(amqpURL)
+	assert.Nil(t, err)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	proxied := *target
+	proxied.Host = listener.Addr().String()
+
+	proxy := &flakyProxy{
+		listener: listener,
+		target:   target.Host,
+		url:      proxied.String(),
+	}
+	go proxy.serve()
+
+	return proxy
+}
+
+func (p *flakyProxy) serve() {
+	for {
+		client, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		server, err := net.Dial("tcp", p.target)
+		if err != nil {
+			client.Close()
+			continue
+		}
+
+		p.mutex.Lock()
+		p.connections = append(p.connections, client, server)
+		p.mutex.Unlock()
+
+		go func() {
+			io.Copy(server, client)
+			server.Close()
+		}()
+		go func() {
+			io.Copy(client, server)
+			client.Close()
+		}()
+	}
+}
+
+// Sever drops every connection currently passing through the proxy
+func (p *flakyProxy) Sever() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for _, connection := range p.connections {
+		connection.Close()
+	}
+	p.connections = nil
+}
+
+// Close stops accepting connections and drops existing ones
+func (p *flakyProxy) Close() {
+	p.listener.Close()
+	p.Sever()
+}
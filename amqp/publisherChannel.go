@@ -0,0 +1,126 @@
+package amqp
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/streadway/amqp"
+)
+
+// NackError is returned when the broker negatively acknowledges a published message
+type NackError struct {
+	Exchange   string
+	RoutingKey string
+}
+
+func (e *NackError) Error() string {
+	return fmt.Sprintf("broker nacked message published to exchange '%s' with routing key '%s'", e.Exchange, e.RoutingKey)
+}
+
+// UnroutableError is returned when a mandatory message could not be routed to any queue
+type UnroutableError struct {
+	Exchange   string
+	RoutingKey string
+	ReplyCode  uint16
+	ReplyText  string
+}
+
+func (e *UnroutableError) Error() string {
+	return fmt.Sprintf("broker returned message published to exchange '%s' with routing key '%s': %d %s", e.Exchange, e.RoutingKey, e.ReplyCode, e.ReplyText)
+}
+
+// publisherChannel is a long-lived channel used for publishing, optionally in confirm mode
+type publisherChannel struct {
+	connection *amqp.Connection
+	channel    *amqp.Channel
+	confirms   chan amqp.Confirmation
+	returns    chan amqp.Return
+	closes     chan *amqp.Error
+}
+
+func openPublisherChannel(connection *amqp.Connection, confirm bool) (*publisherChannel, error) {
+	channel, err := connection.Channel()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open channel to broker")
+	}
+
+	pc := &publisherChannel{
+		connection: connection,
+		channel:    channel,
+		closes:     channel.NotifyClose(make(chan *amqp.Error, 1)),
+	}
+
+	if !confirm {
+		return pc, nil
+	}
+
+	err = channel.Confirm(false)
+	if err != nil {
+		channel.Close()
+		return nil, errors.Wrap(err, "failed to put channel into confirm mode")
+	}
+
+	// Only one publish is ever outstanding on a channel, so a single slot is enough. The broker
+	// sends a return before the ack for the same message, so the return is always buffered by the
+	// time the confirmation is received.
+	pc.confirms = channel.NotifyPublish(make(chan amqp.Confirmation, 1))
+	pc.returns = channel.NotifyReturn(make(chan amqp.Return, 1))
+
+	return pc, nil
+}
+
+func (pc *publisherChannel) isClosed() bool {
+	select {
+	case <-pc.closes:
+		return true
+	default:
+		return false
+	}
+}
+
+func (pc *publisherChannel) publish(ctx context.Context, exchangeName string, routingKey string, mandatory bool, publishing amqp.Publishing) error {
+	err := pc.channel.Publish(exchangeName, routingKey, mandatory, false, publishing)
+	if err != nil {
+		return errors.Wrap(err, "failed to publish message")
+	}
+
+	if pc.confirms == nil {
+		return nil
+	}
+
+	select {
+	case confirmation, ok := <-pc.confirms:
+		if !ok {
+			return errors.Errorf("channel closed before the broker confirmed the message: %v", <-pc.closes)
+		}
+
+		if !confirmation.Ack {
+			return &NackError{
+				Exchange:   exchangeName,
+				RoutingKey: routingKey,
+			}
+		}
+
+		select {
+		case returned, ok := <-pc.returns:
+			if ok {
+				return &UnroutableError{
+					Exchange:   returned.Exchange,
+					RoutingKey: returned.RoutingKey,
+					ReplyCode:  returned.ReplyCode,
+					ReplyText:  returned.ReplyText,
+				}
+			}
+		default:
+		}
+
+		return nil
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "timed out waiting for the broker to confirm the message")
+	}
+}
+
+func (pc *publisherChannel) close() {
+	pc.channel.Close()
+}
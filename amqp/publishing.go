@@ -0,0 +1,61 @@
+package amqp
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// Publishing is a message to be published to an exchange
+type Publishing struct {
+	// RoutingKey is used by the exchange to route the message to queues
+	RoutingKey string
+	// Headers are the collection of metadata passed along with the Body. Values must be types supported by
+	// AMQP tables, such as strings, integers, booleans, floats, time.Time and nested tables.
+	Headers map[string]interface{}
+	// ContentType is the MIME type of the Body
+	ContentType string
+	// ContentEncoding is the encoding of the Body, such as gzip
+	ContentEncoding string
+	// Persistent asks the broker to write the message to disk so that it survives a broker restart
+	Persistent bool
+	// Priority is the priority of the message from 0 to 9, used by priority queues
+	Priority uint8
+	// CorrelationID correlates a reply with its request
+	CorrelationID string
+	// ReplyTo is the queue to which replies should be sent
+	ReplyTo string
+	// MessageID uniquely identifies the message
+	MessageID string
+	// Timestamp is when the message was created
+	Timestamp time.Time
+	// Expiration is how long the message may wait in a queue before it is discarded. Zero never expires.
+	Expiration time.Duration
+	// Body is the unmodified byte array containing the message
+	Body []byte
+}
+
+func (m *Publishing) toAMQP() amqp.Publishing {
+	publishing := amqp.Publishing{
+		Headers:         amqp.Table(m.Headers),
+		ContentType:     m.ContentType,
+		ContentEncoding: m.ContentEncoding,
+		Priority:        m.Priority,
+		CorrelationId:   m.CorrelationID,
+		ReplyTo:         m.ReplyTo,
+		MessageId:       m.MessageID,
+		Timestamp:       m.Timestamp,
+		Body:            m.Body,
+	}
+
+	if m.Persistent {
+		publishing.DeliveryMode = amqp.Persistent
+	}
+
+	if m.Expiration > 0 {
+		publishing.Expiration = strconv.FormatInt(int64(m.Expiration/time.Millisecond), 10)
+	}
+
+	return publishing
+}
@@ -0,0 +1,284 @@
+package amqp
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/streadway/amqp"
+	"github.com/syncromatics/go-kit/v2/log"
+)
+
+const (
+	// directReplyTo is the pseudo-queue that RabbitMQ uses to deliver replies straight to the requesting channel
+	directReplyTo = "amq.rabbitmq.reply-to"
+
+	// RPCErrorHeader carries the error returned by an RPCServer's handler back to the caller
+	RPCErrorHeader = "rpc-error"
+)
+
+// RPCError is returned by RPCClient.Call when the server's handler failed
+type RPCError struct {
+	Message string
+}
+
+func (e *RPCError) Error() string {
+	return e.Message
+}
+
+// RPCClientSettings are the settings for an RPCClient
+type RPCClientSettings struct {
+	// ReconnectBackoff controls how long to wait between attempts to reconnect after the connection is lost
+	ReconnectBackoff Backoff
+	// Registerer is where the client's metrics are registered. Defaults to prometheus.DefaultRegisterer.
+	Registerer prometheus.Registerer
+}
+
+// RPCClient makes remote procedure calls over AMQP, receiving replies through RabbitMQ's direct reply-to
+type RPCClient struct {
+	connection     *connectionManager
+	inFlight       *inFlight
+	metrics        *metrics
+	releaseMetrics sync.Once
+
+	mutex   sync.Mutex
+	channel *amqp.Channel
+	pending map[string]*pendingCall
+}
+
+type pendingCall struct {
+	channel *amqp.Channel
+	result  chan rpcResult
+}
+
+type rpcResult struct {
+	reply amqp.Delivery
+	err   error
+}
+
+// NewRPCClient creates a new RPCClient
+func NewRPCClient(amqpURL string) *RPCClient {
+	return NewRPCClientWithSettings(amqpURL, &RPCClientSettings{})
+}
+
+// NewRPCClientWithSettings creates a new RPCClient with the given settings
+func NewRPCClientWithSettings(amqpURL string, settings *RPCClientSettings) *RPCClient {
+	metrics := acquireMetrics(settings.Registerer)
+
+	client := &RPCClient{
+		connection: newConnectionManager(amqpURL, "rpc-client", true, settings.ReconnectBackoff, metrics),
+		inFlight:   newInFlight(),
+		metrics:    metrics,
+		pending:    map[string]*pendingCall{},
+	}
+	client.connection.onConnect = client.listen
+
+	return client
+}
+
+// EnsureRPCClientIsReady ensures that the client is ready to make calls
+//
+// Once ready, the client reconnects to the broker whenever the connection is lost.
+func (c *RPCClient) EnsureRPCClientIsReady() error {
+	return c.connection.connect()
+}
+
+// listen opens the channel on which requests are published and replies are received
+func (c *RPCClient) listen(connection *amqp.Connection) error {
+	channel, err := connection.Channel()
+	if err != nil {
+		return errors.Wrap(err, "failed to open channel to broker")
+	}
+
+	replies, err := channel.Consume(directReplyTo, "", true, false, false, false, nil)
+	if err != nil {
+		channel.Close()
+		return errors.Wrap(err, "failed to consume replies")
+	}
+	returns := channel.NotifyReturn(make(chan amqp.Return, 1))
+	closes := channel.NotifyClose(make(chan *amqp.Error, 1))
+
+	c.mutex.Lock()
+	c.channel = channel
+	c.mutex.Unlock()
+
+	go c.dispatch(connection, channel, replies, returns, closes)
+
+	return nil
+}
+
+// dispatch hands replies and returned requests to their callers until the channel closes
+func (c *RPCClient) dispatch(connection *amqp.Connection, channel *amqp.Channel, replies <-chan amqp.Delivery, returns <-chan amqp.Return, closes <-chan *amqp.Error) {
+	for {
+		select {
+		case reply, ok := <-replies:
+			if !ok {
+				c.recover(connection, channel, closes)
+				return
+			}
+			c.resolve(reply.CorrelationId, rpcResult{reply: reply})
+		case returned, ok := <-returns:
+			if !ok {
+				returns = nil
+				continue
+			}
+			c.resolve(returned.CorrelationId, rpcResult{err: &UnroutableError{
+				Exchange:   returned.Exchange,
+				RoutingKey: returned.RoutingKey,
+				ReplyCode:  returned.ReplyCode,
+				ReplyText:  returned.ReplyText,
+			}})
+		}
+	}
+}
+
+// recover fails the calls waiting on a closed channel and, if only the channel was closed, opens a new one
+func (c *RPCClient) recover(connection *amqp.Connection, channel *amqp.Channel, closes <-chan *amqp.Error) {
+	err := errors.New("channel closed before a reply was received")
+	select {
+	case reason := <-closes:
+		if reason != nil {
+			err = errors.Wrap(reason, "channel closed before a reply was received")
+		}
+	default:
+	}
+
+	c.mutex.Lock()
+	for correlationID, call := range c.pending {
+		if call.channel == channel {
+			call.result <- rpcResult{err: err}
+			delete(c.pending, correlationID)
+		}
+	}
+	c.mutex.Unlock()
+
+	if connection.IsClosed() {
+		// the connection manager reconnects and listens again
+		return
+	}
+
+	log.Warn("reply channel closed, reopening",
+		"err", err,
+	)
+	err = c.listen(connection)
+	if err != nil {
+		c.connection.invalidate(connection, err)
+	}
+}
+
+func (c *RPCClient) resolve(correlationID string, result rpcResult) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	call, ok := c.pending[correlationID]
+	if !ok {
+		// the caller has already given up
+		return
+	}
+	call.result <- result
+	delete(c.pending, correlationID)
+}
+
+// Call publishes the request to the given exchange and waits for the reply
+//
+// The context bounds how long the call waits for the broker and for the reply. When the context has a deadline, the
+// request expires from the server's queue once the deadline has passed. If the server's handler fails, an *RPCError
+// is returned.
+func (c *RPCClient) Call(ctx context.Context, exchangeName string, routingKey string, body []byte) ([]byte, error) {
+	if !c.inFlight.start() {
+		return nil, ErrClosed
+	}
+	defer c.inFlight.done()
+
+	start := time.Now()
+	reply, err := c.call(ctx, exchangeName, routingKey, body)
+
+	c.metrics.rpcCalls.WithLabelValues(exchangeName).Inc()
+	c.metrics.rpcCallDuration.WithLabelValues(exchangeName).Observe(time.Since(start).Seconds())
+	if err != nil {
+		c.metrics.rpcCallErrors.WithLabelValues(exchangeName).Inc()
+	}
+
+	return reply, err
+}
+
+func (c *RPCClient) call(ctx context.Context, exchangeName string, routingKey string, body []byte) (reply []byte, err error) {
+	_, err = c.connection.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	span, headers := startPublishSpan(ctx, exchangeName, nil)
+	defer func() {
+		finishSpan(span, err)
+	}()
+
+	publishing := amqp.Publishing{
+		Headers:       amqp.Table(headers),
+		CorrelationId: uuid.NewString(),
+		ReplyTo:       directReplyTo,
+		Body:          body,
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		remaining := time.Until(deadline) / time.Millisecond
+		if remaining < 1 {
+			return nil, errors.Wrap(context.DeadlineExceeded, "timed out before the request was published")
+		}
+		publishing.Expiration = strconv.FormatInt(int64(remaining), 10)
+	}
+
+	result := make(chan rpcResult, 1)
+
+	c.mutex.Lock()
+	channel := c.channel
+	c.pending[publishing.CorrelationId] = &pendingCall{
+		channel: channel,
+		result:  result,
+	}
+	c.mutex.Unlock()
+
+	defer func() {
+		c.mutex.Lock()
+		delete(c.pending, publishing.CorrelationId)
+		c.mutex.Unlock()
+	}()
+
+	err = channel.Publish(exchangeName, routingKey, true, false, publishing)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to publish request")
+	}
+
+	select {
+	case r := <-result:
+		if r.err != nil {
+			return nil, r.err
+		}
+		if message, ok := r.reply.Headers[RPCErrorHeader].(string); ok {
+			return nil, &RPCError{Message: message}
+		}
+		return r.reply.Body, nil
+	case <-ctx.Done():
+		return nil, errors.Wrap(ctx.Err(), "timed out waiting for reply")
+	}
+}
+
+// Close stops new calls, waits until the context ends for calls in progress to be answered, and then closes the
+// connection to the broker and unregisters the client's metrics
+func (c *RPCClient) Close(ctx context.Context) error {
+	c.inFlight.close()
+	drainErr := c.inFlight.wait(ctx)
+
+	err := c.connection.close()
+	c.releaseMetrics.Do(c.metrics.release)
+
+	if drainErr != nil {
+		return errors.Wrap(drainErr, "timed out waiting for calls in progress")
+	}
+
+	return err
+}
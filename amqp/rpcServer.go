@@ -0,0 +1,97 @@
+package amqp
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"github.com/syncromatics/go-kit/v2/log"
+)
+
+// RPCHandler processes a request delivered to an RPCServer and returns the body of the reply
+//
+// If the handler returns an error, its message is sent to the caller in place of a reply.
+type RPCHandler func(ctx context.Context, request *Message) ([]byte, error)
+
+// RPCServer answers remote procedure calls made with an RPCClient. Requests are consumed from a subscription to an
+// exchange, and replies are published to the reply-to queue of each request.
+type RPCServer struct {
+	subscription *ExchangeSubscription
+	publisher    *ExchangePublisher
+}
+
+// NewRPCServer creates a new RPCServer that consumes requests from a queue with the given settings
+//
+// Several servers can share a durable, named queue, in which case each request is answered by only one of them.
+func NewRPCServer(amqpURL string, exchangeName string, settings *SubscriptionSettings) *RPCServer {
+	return &RPCServer{
+		subscription: NewExchangeSubscriptionWithSettings(amqpURL, exchangeName, settings),
+		publisher: NewExchangePublisherWithSettings(amqpURL, &PublisherSettings{
+			ReconnectBackoff: settings.ReconnectBackoff,
+			Registerer:       settings.Registerer,
+		}),
+	}
+}
+
+// EnsureRPCServerIsReady ensures that the request queue exists and that replies can be published
+func (s *RPCServer) EnsureRPCServerIsReady() error {
+	err := s.subscription.EnsureExchangeSubscriptionIsReady()
+	if err != nil {
+		return err
+	}
+
+	return s.publisher.EnsurePublisherIsReady()
+}
+
+// Serve answers requests with the given number of concurrent workers until the context is cancelled or the server is
+// closed
+//
+// Requests without a reply-to queue are rejected. A request is only acknowledged once its reply has been published,
+// so that it is requeued if the reply cannot be sent.
+func (s *RPCServer) Serve(ctx context.Context, handler RPCHandler, concurrency int) error {
+	return s.subscription.ConsumeWithHandler(ctx, s.reply(handler), concurrency)
+}
+
+func (s *RPCServer) reply(handler RPCHandler) MessageHandler {
+	return func(ctx context.Context, request *Message) error {
+		if request.ReplyTo == "" {
+			return Permanent(errors.New("request has no reply-to queue"))
+		}
+
+		body, handlerErr := handler(ctx, request)
+
+		reply := &Publishing{
+			RoutingKey:    request.ReplyTo,
+			CorrelationID: request.CorrelationID,
+			Body:          body,
+		}
+		if handlerErr != nil {
+			log.Warn("rpc handler failed",
+				"err", handlerErr,
+				"exchange", s.subscription.ExchangeName(),
+			)
+			reply.Headers = map[string]interface{}{
+				RPCErrorHeader: handlerErr.Error(),
+			}
+			reply.Body = nil
+		}
+
+		err := s.publisher.PublishMessage(ctx, "", reply)
+		if err != nil {
+			return errors.Wrap(err, "failed to publish reply")
+		}
+
+		return nil
+	}
+}
+
+// Close stops consuming requests, waits until the context ends for requests in progress to be answered, and then
+// closes the connections to the broker
+func (s *RPCServer) Close(ctx context.Context) error {
+	err := s.subscription.Close(ctx)
+	publisherErr := s.publisher.Close(ctx)
+	if err != nil {
+		return err
+	}
+
+	return publisherErr
+}
@@ -0,0 +1,120 @@
+package amqp_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	pkgerrors "github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	sut "github.com/syncromatics/go-kit/v2/amqp"
+)
+
+func startRPCServer(t *testing.T, bindingKey string, handler sut.RPCHandler) func() {
+	server := sut.NewRPCServer(amqpURL, EXCHANGE_NAME, &sut.SubscriptionSettings{
+		AutoDelete:  true,
+		Exclusive:   true,
+		BindingKeys: []string{bindingKey},
+	})
+	err := server.EnsureRPCServerIsReady()
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go server.Serve(ctx, handler, 2)
+
+	return func() {
+		cancel()
+		server.Close(context.Background())
+	}
+}
+
+func Test_RPC_CallReceivesReply(t *testing.T) {
+	// Arrange
+	stop := startRPCServer(t, "rpc.echo", func(ctx context.Context, request *sut.Message) ([]byte, error) {
+		return []byte(fmt.Sprintf("echo %s", request.Body)), nil
+	})
+	defer stop()
+
+	client := sut.NewRPCClient(amqpURL)
+	err := client.EnsureRPCClientIsReady()
+	assert.Nil(t, err)
+	defer client.Close(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	// Act
+	reply, err := client.Call(ctx, EXCHANGE_NAME, "rpc.echo", []byte("hello"))
+
+	// Assert
+	assert.Nil(t, err)
+	assert.Equal(t, "echo hello", string(reply))
+}
+
+func Test_RPC_CallReturnsHandlerError(t *testing.T) {
+	// Arrange
+	stop := startRPCServer(t, "rpc.fail", func(ctx context.Context, request *sut.Message) ([]byte, error) {
+		return nil, errors.New("vehicle not found")
+	})
+	defer stop()
+
+	client := sut.NewRPCClient(amqpURL)
+	err := client.EnsureRPCClientIsReady()
+	assert.Nil(t, err)
+	defer client.Close(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	// Act
+	reply, err := client.Call(ctx, EXCHANGE_NAME, "rpc.fail", []byte("hello"))
+
+	// Assert
+	assert.Nil(t, reply)
+	assert.Equal(t, &sut.RPCError{Message: "vehicle not found"}, err)
+}
+
+func Test_RPC_CallTimesOut(t *testing.T) {
+	// Arrange
+	stop := startRPCServer(t, "rpc.slow", func(ctx context.Context, request *sut.Message) ([]byte, error) {
+		time.Sleep(time.Second)
+		return request.Body, nil
+	})
+	defer stop()
+
+	client := sut.NewRPCClient(amqpURL)
+	err := client.EnsureRPCClientIsReady()
+	assert.Nil(t, err)
+	defer client.Close(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	// Act
+	reply, err := client.Call(ctx, EXCHANGE_NAME, "rpc.slow", []byte("hello"))
+
+	// Assert
+	assert.Nil(t, reply)
+	assert.Equal(t, context.DeadlineExceeded, pkgerrors.Cause(err))
+}
+
+func Test_RPC_CallWithoutServerIsUnroutable(t *testing.T) {
+	// Arrange
+	client := sut.NewRPCClient(amqpURL)
+	err := client.EnsureRPCClientIsReady()
+	assert.Nil(t, err)
+	defer client.Close(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	// Act
+	reply, err := client.Call(ctx, "amq.direct", "rpc.nobody", []byte("hello"))
+
+	// Assert
+	assert.Nil(t, reply)
+	_, ok := err.(*sut.UnroutableError)
+	assert.True(t, ok, "expected an unroutable error but got %v", err)
+}
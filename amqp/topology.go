@@ -0,0 +1,120 @@
+package amqp
+
+import (
+	"github.com/pkg/errors"
+	"github.com/streadway/amqp"
+)
+
+// ExchangeKind is the type of an exchange, which determines how it routes messages to queues
+type ExchangeKind string
+
+const (
+	// ExchangeFanout routes messages to every bound queue
+	ExchangeFanout ExchangeKind = amqp.ExchangeFanout
+	// ExchangeTopic routes messages to queues whose binding keys match the routing key, with * and # wildcards
+	ExchangeTopic ExchangeKind = amqp.ExchangeTopic
+	// ExchangeDirect routes messages to queues whose binding keys equal the routing key
+	ExchangeDirect ExchangeKind = amqp.ExchangeDirect
+	// ExchangeHeaders routes messages to queues whose binding arguments match the message headers
+	ExchangeHeaders ExchangeKind = amqp.ExchangeHeaders
+)
+
+// Exchange describes an exchange to declare
+type Exchange struct {
+	// Name is the name of the exchange
+	Name string
+	// Kind is the type of the exchange
+	Kind ExchangeKind
+	// Durable exchanges survive a broker restart
+	Durable bool
+	// AutoDelete exchanges are deleted once their last binding has been removed
+	AutoDelete bool
+	// Internal exchanges only receive messages from other exchanges
+	Internal bool
+	// Arguments are the optional arguments of the exchange, such as alternate-exchange
+	Arguments map[string]interface{}
+}
+
+// Queue describes a queue to declare
+type Queue struct {
+	// Name is the name of the queue
+	Name string
+	// Durable queues survive a broker restart
+	Durable bool
+	// AutoDelete queues are deleted once their last consumer has gone away
+	AutoDelete bool
+	// Exclusive queues are only accessible by the connection that declared them and are deleted when it closes
+	Exclusive bool
+	// Arguments are the optional arguments of the queue, such as x-message-ttl
+	Arguments map[string]interface{}
+}
+
+// Binding describes a binding that routes messages from an exchange to a queue
+type Binding struct {
+	// Exchange is the name of the exchange that routes messages
+	Exchange string
+	// Queue is the name of the queue that receives them
+	Queue string
+	// Key is the binding key that routing keys are matched against
+	Key string
+	// Arguments are the optional arguments of the binding, such as the headers matched by a headers exchange
+	Arguments map[string]interface{}
+}
+
+// Topology is a set of exchanges, queues and bindings that are declared together
+//
+// Declaring a topology is idempotent as long as the existing exchanges and queues were declared with the same
+// settings. A topology given in SubscriptionSettings or PublisherSettings is declared on connect and again on every
+// reconnect, so that it is restored after a broker restart.
+type Topology struct {
+	Exchanges []Exchange
+	Queues    []Queue
+	Bindings  []Binding
+}
+
+// Apply connects to the broker and declares the topology
+func (t *Topology) Apply(amqpURL string) error {
+	connection, err := amqp.Dial(amqpURL)
+	if err != nil {
+		return errors.Wrap(err, "failed to connect to broker")
+	}
+	defer connection.Close()
+
+	return t.declareOnConnection(connection)
+}
+
+func (t *Topology) declareOnConnection(connection *amqp.Connection) error {
+	channel, err := connection.Channel()
+	if err != nil {
+		return errors.Wrap(err, "failed to open channel to broker")
+	}
+	defer channel.Close()
+
+	return t.declare(channel)
+}
+
+// declare declares the exchanges, then the queues, then the bindings between them
+func (t *Topology) declare(channel *amqp.Channel) error {
+	for _, exchange := range t.Exchanges {
+		err := channel.ExchangeDeclare(exchange.Name, string(exchange.Kind), exchange.Durable, exchange.AutoDelete, exchange.Internal, false, amqp.Table(exchange.Arguments))
+		if err != nil {
+			return errors.Wrapf(err, "failed to declare exchange '%s'", exchange.Name)
+		}
+	}
+
+	for _, queue := range t.Queues {
+		_, err := channel.QueueDeclare(queue.Name, queue.Durable, queue.AutoDelete, queue.Exclusive, false, amqp.Table(queue.Arguments))
+		if err != nil {
+			return errors.Wrapf(err, "failed to declare queue '%s'", queue.Name)
+		}
+	}
+
+	for _, binding := range t.Bindings {
+		err := channel.QueueBind(binding.Queue, binding.Key, binding.Exchange, false, amqp.Table(binding.Arguments))
+		if err != nil {
+			return errors.Wrapf(err, "failed to bind queue '%s' to exchange '%s' with key '%s'", binding.Queue, binding.Exchange, binding.Key)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,153 @@
+package amqp_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	sut "github.com/syncromatics/go-kit/v2/amqp"
+)
+
+func Test_Topology_ApplyIsIdempotent(t *testing.T) {
+	// Arrange
+	conn, err := amqp.Dial(amqpURL)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	channel, err := conn.Channel()
+	assert.Nil(t, err)
+	defer channel.Close()
+
+	name := fmt.Sprintf("test.topology.%s", uuid.NewString())
+	defer channel.ExchangeDelete(name, false, false)
+	defer channel.QueueDelete(name, false, false, false)
+
+	topology := &sut.Topology{
+		Exchanges: []sut.Exchange{
+			{Name: name, Kind: sut.ExchangeHeaders},
+		},
+		Queues: []sut.Queue{
+			{Name: name, Arguments: map[string]interface{}{"x-max-length": int32(10)}},
+		},
+		Bindings: []sut.Binding{
+			{Exchange: name, Queue: name, Arguments: map[string]interface{}{
+				"x-match":     "all",
+				"messageType": "Position",
+			}},
+		},
+	}
+
+	// Act
+	err = topology.Apply(amqpURL)
+	assert.Nil(t, err)
+
+	err = topology.Apply(amqpURL)
+	assert.Nil(t, err)
+
+	// Assert
+	for _, messageType := range []string{"Position", "Emergency"} {
+		err = channel.Publish(name, "", false, false, amqp.Publishing{
+			Headers: amqp.Table{"messageType": messageType},
+			Body:    []byte(`{}`),
+		})
+		assert.Nil(t, err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	inspected, err := channel.QueueInspect(name)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, inspected.Messages)
+}
+
+func Test_Topology_ApplyFailsWithConflictingDeclaration(t *testing.T) {
+	// Arrange
+	topology := &sut.Topology{
+		Exchanges: []sut.Exchange{
+			{Name: EXCHANGE_NAME, Kind: sut.ExchangeFanout, Durable: true},
+		},
+	}
+
+	// Act
+	err := topology.Apply(amqpURL)
+
+	// Assert
+	assert.NotNil(t, err)
+}
+
+func Test_Topology_DeclaredOnReconnect(t *testing.T) {
+	// Arrange
+	conn, err := amqp.Dial(amqpURL)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	channel, err := conn.Channel()
+	assert.Nil(t, err)
+	defer channel.Close()
+
+	proxy := newFlakyProxy(t, amqpURL)
+	defer proxy.Close()
+
+	name := fmt.Sprintf("test.topology.%s", uuid.NewString())
+	defer channel.ExchangeDelete(name, false, false)
+
+	exchangeSubscription := sut.NewExchangeSubscriptionWithSettings(proxy.url, name, &sut.SubscriptionSettings{
+		AutoDelete: true,
+		Exclusive:  true,
+		Reconnect:  true,
+		ReconnectBackoff: sut.Backoff{
+			InitialInterval: 50 * time.Millisecond,
+			MaxInterval:     100 * time.Millisecond,
+		},
+		Topology: &sut.Topology{
+			Exchanges: []sut.Exchange{
+				{Name: name, Kind: sut.ExchangeFanout},
+			},
+		},
+	})
+	err = exchangeSubscription.EnsureExchangeSubscriptionIsReady()
+	assert.Nil(t, err)
+	defer exchangeSubscription.Close(context.Background())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	messages, err := exchangeSubscription.Consume(ctx)
+	assert.Nil(t, err)
+
+	// each message is published on its own channel, since publishing to a missing exchange closes the channel
+	publisher := sut.NewExchangePublisher(amqpURL)
+	err = publisher.EnsurePublisherIsReady()
+	assert.Nil(t, err)
+	defer publisher.Close(context.Background())
+
+	// Act
+	err = channel.ExchangeDelete(name, false, false)
+	assert.Nil(t, err)
+
+	proxy.Sever()
+
+	// Assert
+	deadline := time.After(5 * time.Second)
+	for {
+		err = publisher.Publish(name, nil, []byte(`{}`))
+		if err != nil {
+			assert.Fail(t, "failed to publish", err.Error())
+			return
+		}
+
+		select {
+		case message := <-messages:
+			assert.Nil(t, message.Ack())
+			return
+		case <-time.After(200 * time.Millisecond):
+		case <-deadline:
+			assert.Fail(t, "exchange was not declared again after reconnecting")
+			return
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package amqp
+
+import (
+	"context"
+	"fmt"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+)
+
+// headersCarrier carries span contexts in the headers of AMQP messages
+type headersCarrier map[string]interface{}
+
+// Set implements opentracing.TextMapWriter
+func (c headersCarrier) Set(key, value string) {
+	c[key] = value
+}
+
+// ForeachKey implements opentracing.TextMapReader
+func (c headersCarrier) ForeachKey(handler func(key, value string) error) error {
+	for key, value := range c {
+		s, ok := value.(string)
+		if !ok {
+			continue
+		}
+
+		err := handler(key, s)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// startPublishSpan starts a producer span when the context carries an active span, and injects it into a copy of the
+// headers. The headers are returned unchanged when there is nothing to propagate.
+func startPublishSpan(ctx context.Context, exchangeName string, headers map[string]interface{}) (opentracing.Span, map[string]interface{}) {
+	parent := opentracing.SpanFromContext(ctx)
+	if parent == nil {
+		return nil, headers
+	}
+
+	tracer := parent.Tracer()
+	span := tracer.StartSpan(fmt.Sprintf("amqp publish %s", exchangeName),
+		opentracing.ChildOf(parent.Context()),
+		ext.SpanKindProducer,
+		opentracing.Tag{Key: string(ext.Component), Value: "amqp"},
+		opentracing.Tag{Key: string(ext.MessageBusDestination), Value: exchangeName},
+	)
+
+	carrier := headersCarrier{}
+	for key, value := range headers {
+		carrier[key] = value
+	}
+
+	err := tracer.Inject(span.Context(), opentracing.TextMap, carrier)
+	if err != nil {
+		ext.Error.Set(span, true)
+		span.LogKV("event", "error", "message", err.Error())
+	}
+
+	return span, carrier
+}
+
+// finishSpan finishes the span, if there is one, marking it as failed when there was an error
+func finishSpan(span opentracing.Span, err error) {
+	if span == nil {
+		return
+	}
+
+	if err != nil {
+		ext.Error.Set(span, true)
+		span.LogKV("event", "error", "message", err.Error())
+	}
+	span.Finish()
+}
+
+// startConsumeSpan starts a consumer span for a delivered message, as a child of the span that published it if one
+// was propagated in its headers
+func startConsumeSpan(tracer opentracing.Tracer, exchangeName string, headers map[string]interface{}) opentracing.Span {
+	options := []opentracing.StartSpanOption{
+		ext.SpanKindConsumer,
+		opentracing.Tag{Key: string(ext.Component), Value: "amqp"},
+		opentracing.Tag{Key: string(ext.MessageBusDestination), Value: exchangeName},
+	}
+
+	parent, err := tracer.Extract(opentracing.TextMap, headersCarrier(headers))
+	if err == nil {
+		options = append(options, opentracing.ChildOf(parent))
+	}
+
+	return tracer.StartSpan(fmt.Sprintf("amqp consume %s", exchangeName), options...)
+}
@@ -0,0 +1,115 @@
+package amqp_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/stretchr/testify/assert"
+	sut "github.com/syncromatics/go-kit/v2/amqp"
+)
+
+func Test_Tracing_PropagatesSpanFromPublisherToConsumer(t *testing.T) {
+	// Arrange
+	tracer := mocktracer.New()
+
+	exchangeSubscription := sut.NewExchangeSubscriptionWithSettings(amqpURL, EXCHANGE_NAME, &sut.SubscriptionSettings{
+		AutoDelete:  true,
+		Exclusive:   true,
+		BindingKeys: []string{"tracing.#"},
+		Tracer:      tracer,
+	})
+	err := exchangeSubscription.EnsureExchangeSubscriptionIsReady()
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	messages, err := exchangeSubscription.Consume(ctx)
+	assert.Nil(t, err)
+
+	publisher := sut.NewExchangePublisher(amqpURL)
+	err = publisher.EnsurePublisherIsReady()
+	assert.Nil(t, err)
+
+	rpc := tracer.StartSpan("rpc")
+	publishCtx := opentracing.ContextWithSpan(context.Background(), rpc)
+
+	// Act
+	err = publisher.PublishWithRoutingKeyContext(publishCtx, EXCHANGE_NAME, "tracing.job", []byte(`{}`))
+	assert.Nil(t, err)
+	rpc.Finish()
+
+	// Assert
+	var message *sut.Message
+	select {
+	case message = <-messages:
+	case <-time.After(3 * time.Second):
+		assert.Fail(t, "expected to receive message within a timely manner")
+		return
+	}
+
+	assert.Nil(t, message.Ack())
+
+	finished := tracer.FinishedSpans()
+	if !assert.Len(t, finished, 3) {
+		return
+	}
+
+	publish, root, consume := finished[0], finished[1], finished[2]
+	assert.Equal(t, "amqp publish "+EXCHANGE_NAME, publish.OperationName)
+	assert.Equal(t, root.SpanContext.SpanID, publish.ParentID)
+	assert.Equal(t, "amqp consume "+EXCHANGE_NAME, consume.OperationName)
+	assert.Equal(t, publish.SpanContext.SpanID, consume.ParentID)
+	assert.Equal(t, root.SpanContext.TraceID, consume.SpanContext.TraceID)
+
+	span, ok := opentracing.SpanFromContext(message.Context()).(*mocktracer.MockSpan)
+	if assert.True(t, ok) {
+		assert.Equal(t, consume.SpanContext.SpanID, span.SpanContext.SpanID)
+	}
+}
+
+func Test_Tracing_StartsNewTraceWithoutPropagatedSpan(t *testing.T) {
+	// Arrange
+	tracer := mocktracer.New()
+
+	exchangeSubscription := sut.NewExchangeSubscriptionWithSettings(amqpURL, EXCHANGE_NAME, &sut.SubscriptionSettings{
+		AutoDelete:  true,
+		Exclusive:   true,
+		BindingKeys: []string{"untraced.#"},
+		Tracer:      tracer,
+	})
+	err := exchangeSubscription.EnsureExchangeSubscriptionIsReady()
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	messages, err := exchangeSubscription.Consume(ctx)
+	assert.Nil(t, err)
+
+	publisher := sut.NewExchangePublisher(amqpURL)
+	err = publisher.EnsurePublisherIsReady()
+	assert.Nil(t, err)
+
+	// Act
+	err = publisher.PublishWithRoutingKey(EXCHANGE_NAME, "untraced.job", []byte(`{}`))
+	assert.Nil(t, err)
+
+	// Assert
+	select {
+	case message := <-messages:
+		assert.Empty(t, message.Headers)
+		assert.Nil(t, message.Reject())
+	case <-time.After(3 * time.Second):
+		assert.Fail(t, "expected to receive message within a timely manner")
+		return
+	}
+
+	finished := tracer.FinishedSpans()
+	if assert.Len(t, finished, 1) {
+		assert.Equal(t, 0, finished[0].ParentID)
+	}
+}
@@ -1,10 +1,177 @@
 package grpc
 
 import (
+	"context"
+	"sync"
+	"time"
+
+	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
+	grpc_zap "github.com/grpc-ecosystem/go-grpc-middleware/logging/zap"
+	grpc_retry "github.com/grpc-ecosystem/go-grpc-middleware/retry"
+	grpc_opentracing "github.com/grpc-ecosystem/go-grpc-middleware/tracing/opentracing"
+	grpc_prometheus "github.com/grpc-ecosystem/go-grpc-prometheus"
+	opentracing "github.com/opentracing/opentracing-go"
+	"go.uber.org/zap"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/keepalive"
 )
 
+// DialSettings are the settings for a client connection created by DialWithSettings
+type DialSettings struct {
+	// Tracer traces outbound calls. Defaults to the global tracer at the time of dialing.
+	Tracer opentracing.Tracer
+	// TLS secures the connection with TLS. The connection is insecure when nil.
+	TLS *ClientTLSSettings
+
+	// IdempotentMethods are the full names of the methods that are retried, such as "/gokit.ping.v1.PingAPI/Ping".
+	// Other methods are never retried, and neither are client or bidirectional streams.
+	IdempotentMethods []string
+	// MaxRetries is how many times a call to an idempotent method is retried. Defaults to 3.
+	MaxRetries uint
+	// RetryBackoff is the wait before the first retry, which doubles for each further retry. Defaults to 100
+	// milliseconds.
+	RetryBackoff time.Duration
+	// RetryCodes are the status codes that are retried. Defaults to Unavailable and ResourceExhausted.
+	RetryCodes []codes.Code
+
+	// UnaryInterceptors run after tracing, metrics, logging and retries, immediately before the call is sent
+	UnaryInterceptors []grpc.UnaryClientInterceptor
+	// StreamInterceptors run after tracing, metrics, logging and retries, immediately before the stream is opened
+	StreamInterceptors []grpc.StreamClientInterceptor
+	// DialOptions are applied after the kit's options, so they can override them. They must not set interceptors;
+	// use the interceptor settings instead.
+	DialOptions []grpc.DialOption
+
+	// KeepaliveParams defaults to pinging the server every 30 seconds while there are active calls, which is allowed
+	// by the enforcement policy of servers created by CreateServer
+	KeepaliveParams *keepalive.ClientParameters
+}
+
+var enableClientHandlingHistogram sync.Once
+
 // Dial creates a client connection to the given target
 func Dial(target string, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
 	return grpc.Dial(target, opts...)
 }
+
+// DialWithSettings creates a client connection to the given target with tracing, prometheus stats, logging and
+// retries of idempotent methods
+func DialWithSettings(target string, s *DialSettings) (*grpc.ClientConn, error) {
+	logConfig := zap.NewProductionConfig()
+	logConfig.Level = zap.NewAtomicLevelAt(zap.WarnLevel)
+	logger, _ := logConfig.Build()
+
+	tracer := s.Tracer
+	if tracer == nil {
+		tracer = opentracing.GlobalTracer()
+	}
+
+	// the handling time histogram is not safe to enable while another connection is making calls
+	enableClientHandlingHistogram.Do(func() {
+		grpc_prometheus.EnableClientHandlingTimeHistogram()
+	})
+
+	retryOptions := retryCallOptions(s)
+	idempotent := map[string]bool{}
+	for _, method := range s.IdempotentMethods {
+		idempotent[method] = true
+	}
+
+	unaryInterceptors := []grpc.UnaryClientInterceptor{
+		grpc_opentracing.UnaryClientInterceptor(grpc_opentracing.WithTracer(tracer)),
+		grpc_prometheus.UnaryClientInterceptor,
+		grpc_zap.UnaryClientInterceptor(logger),
+		idempotentUnaryInterceptor(idempotent, grpc_retry.UnaryClientInterceptor(retryOptions...)),
+	}
+	unaryInterceptors = append(unaryInterceptors, s.UnaryInterceptors...)
+
+	streamInterceptors := []grpc.StreamClientInterceptor{
+		grpc_opentracing.StreamClientInterceptor(grpc_opentracing.WithTracer(tracer)),
+		grpc_prometheus.StreamClientInterceptor,
+		grpc_zap.StreamClientInterceptor(logger),
+		idempotentStreamInterceptor(idempotent, grpc_retry.StreamClientInterceptor(retryOptions...)),
+	}
+	streamInterceptors = append(streamInterceptors, s.StreamInterceptors...)
+
+	keepaliveParams := keepalive.ClientParameters{
+		Time:    30 * time.Second, // wait time before ping if no activity, at least the server's enforced minimum
+		Timeout: 20 * time.Second, // ping timeout
+	}
+	if s.KeepaliveParams != nil {
+		keepaliveParams = *s.KeepaliveParams
+	}
+
+	transportOption := grpc.WithInsecure()
+	if s.TLS != nil {
+		var err error
+		transportOption, err = WithTLS(s.TLS)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	options := []grpc.DialOption{
+		transportOption,
+		grpc.WithUnaryInterceptor(grpc_middleware.ChainUnaryClient(unaryInterceptors...)),
+		grpc.WithStreamInterceptor(grpc_middleware.ChainStreamClient(streamInterceptors...)),
+		grpc.WithKeepaliveParams(keepaliveParams),
+	}
+	options = append(options, s.DialOptions...)
+
+	return grpc.Dial(target, options...)
+}
+
+func retryCallOptions(s *DialSettings) []grpc_retry.CallOption {
+	maxRetries := s.MaxRetries
+	if maxRetries == 0 {
+		maxRetries = 3
+	}
+
+	backoff := s.RetryBackoff
+	if backoff == 0 {
+		backoff = 100 * time.Millisecond
+	}
+
+	retryCodes := s.RetryCodes
+	if len(retryCodes) == 0 {
+		retryCodes = []codes.Code{codes.Unavailable, codes.ResourceExhausted}
+	}
+
+	return []grpc_retry.CallOption{
+		grpc_retry.WithMax(maxRetries + 1), // the first attempt counts towards the maximum
+		grpc_retry.WithBackoff(exponentialBackoff(backoff)),
+		grpc_retry.WithCodes(retryCodes...),
+	}
+}
+
+// exponentialBackoff waits the initial duration before the first retry, doubling it for each further retry, with 10%
+// jitter
+func exponentialBackoff(initial time.Duration) grpc_retry.BackoffFunc {
+	jittered := grpc_retry.BackoffLinearWithJitter(initial, 0.1)
+	return func(attempt uint) time.Duration {
+		if attempt == 0 {
+			return 0
+		}
+		return jittered(attempt) << (attempt - 1)
+	}
+}
+
+func idempotentUnaryInterceptor(idempotent map[string]bool, retry grpc.UnaryClientInterceptor) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if !idempotent[method] {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+		return retry(ctx, method, req, reply, cc, invoker, opts...)
+	}
+}
+
+func idempotentStreamInterceptor(idempotent map[string]bool, retry grpc.StreamClientInterceptor) grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		// only server streams can be retried, since the messages sent by the client are not buffered
+		if !idempotent[method] || desc.ClientStreams {
+			return streamer(ctx, desc, cc, method, opts...)
+		}
+		return retry(ctx, desc, cc, method, streamer, opts...)
+	}
+}
@@ -0,0 +1,149 @@
+package grpc_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/stretchr/testify/assert"
+	sut "github.com/syncromatics/go-kit/v2/grpc"
+	pingv1 "github.com/syncromatics/go-kit/v2/internal/protos/gokit/ping/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const pingMethod = "/gokit.ping.v1.PingAPI/Ping"
+
+// failingInterceptor fails the first calls with Unavailable
+func failingInterceptor(failures int) (grpc.UnaryServerInterceptor, *int) {
+	calls := 0
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		calls++
+		if calls <= failures {
+			return nil, status.Error(codes.Unavailable, "warming up")
+		}
+		return handler(ctx, req)
+	}, &calls
+}
+
+func Test_DialWithSettings_RetriesIdempotentMethods(t *testing.T) {
+	// Arrange
+	interceptor, calls := failingInterceptor(2)
+	port, cancel := hostServer(t, &sut.Settings{
+		ServerName:                     "retries",
+		UnaryInterceptorsAfterRecovery: []grpc.UnaryServerInterceptor{interceptor},
+	})
+	defer cancel()
+
+	conn, err := sut.DialWithSettings(fmt.Sprintf("localhost:%d", port), &sut.DialSettings{
+		IdempotentMethods: []string{pingMethod},
+		RetryBackoff:      time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Act
+	_, err = pingv1.NewPingAPIClient(conn).Ping(context.Background(), &pingv1.PingRequest{})
+
+	// Assert
+	assert.Nil(t, err)
+	assert.Equal(t, 3, *calls)
+}
+
+func Test_DialWithSettings_DoesNotRetryOtherMethods(t *testing.T) {
+	// Arrange
+	interceptor, calls := failingInterceptor(1)
+	port, cancel := hostServer(t, &sut.Settings{
+		ServerName:                     "no-retries",
+		UnaryInterceptorsAfterRecovery: []grpc.UnaryServerInterceptor{interceptor},
+	})
+	defer cancel()
+
+	conn, err := sut.DialWithSettings(fmt.Sprintf("localhost:%d", port), &sut.DialSettings{
+		RetryBackoff: time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Act
+	_, err = pingv1.NewPingAPIClient(conn).Ping(context.Background(), &pingv1.PingRequest{})
+
+	// Assert
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	assert.Equal(t, 1, *calls)
+}
+
+func Test_DialWithSettings_TracesCalls(t *testing.T) {
+	// Arrange
+	port, cancel := hostServer(t, &sut.Settings{
+		ServerName: "tracing",
+	})
+	defer cancel()
+
+	tracer := mocktracer.New()
+	conn, err := sut.DialWithSettings(fmt.Sprintf("localhost:%d", port), &sut.DialSettings{
+		Tracer: tracer,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Act
+	_, err = pingv1.NewPingAPIClient(conn).Ping(context.Background(), &pingv1.PingRequest{})
+
+	// Assert
+	assert.Nil(t, err)
+
+	spans := tracer.FinishedSpans()
+	if assert.Len(t, spans, 1) {
+		assert.Equal(t, pingMethod, spans[0].OperationName)
+	}
+}
+
+func Test_DialWithSettings_WhileAnotherConnectionIsCalling(t *testing.T) {
+	// Arrange
+	port, cancel := hostServer(t, &sut.Settings{
+		ServerName: "concurrent-dials",
+	})
+	defer cancel()
+
+	target := fmt.Sprintf("localhost:%d", port)
+	conn, err := sut.DialWithSettings(target, &sut.DialSettings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	done := make(chan error)
+	go func() {
+		client := pingv1.NewPingAPIClient(conn)
+		for i := 0; i < 20; i++ {
+			_, err := client.Ping(context.Background(), &pingv1.PingRequest{})
+			if err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	// Act
+	for i := 0; i < 20; i++ {
+		other, err := sut.DialWithSettings(target, &sut.DialSettings{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		other.Close()
+	}
+
+	// Assert
+	assert.Nil(t, <-done)
+}
@@ -0,0 +1,164 @@
+package grpc
+
+import (
+	"context"
+	"io"
+	"runtime"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/syncromatics/go-kit/v2/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// HealthRegistry holds the serving status of each service reported by the standard grpc.health.v1.Health service.
+// The overall status of the server is reported for the empty service name.
+type HealthRegistry struct {
+	server *health.Server
+}
+
+// NewHealthRegistry creates a HealthRegistry with the overall status set to SERVING
+func NewHealthRegistry() *HealthRegistry {
+	return &HealthRegistry{
+		server: health.NewServer(),
+	}
+}
+
+// SetServing reports the service as SERVING
+func (r *HealthRegistry) SetServing(service string) {
+	r.server.SetServingStatus(service, healthpb.HealthCheckResponse_SERVING)
+}
+
+// SetNotServing reports the service as NOT_SERVING
+func (r *HealthRegistry) SetNotServing(service string) {
+	r.server.SetServingStatus(service, healthpb.HealthCheckResponse_NOT_SERVING)
+}
+
+// Shutdown reports every service as NOT_SERVING and ignores any further changes in status
+func (r *HealthRegistry) Shutdown() {
+	r.server.Shutdown()
+}
+
+// Monitor will periodically run the check, reporting the service as SERVING while it succeeds and NOT_SERVING while
+// it fails, until the context is completed. The check is given the interval to complete.
+//
+// For example, a database can be monitored with db.PingContext, or Redis with a check calling client.Ping().Err().
+func (r *HealthRegistry) Monitor(ctx context.Context, service string, interval time.Duration, check func(context.Context) error) func() error {
+	return func() error {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		serving := true
+		for {
+			checkCtx, cancel := context.WithTimeout(ctx, interval)
+			err := check(checkCtx)
+			cancel()
+
+			switch {
+			case err == nil:
+				if !serving {
+					log.Info("health check recovered", "service", service)
+				}
+				r.SetServing(service)
+			case ctx.Err() != nil:
+				return nil
+			default:
+				if serving {
+					log.Warn("health check failed", "service", service, "err", err)
+				}
+				r.SetNotServing(service)
+			}
+			serving = err == nil
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	}
+}
+
+// hostedServers are the health registries, drain delays and tracers of the servers created by CreateServer, so that
+// HostServer can report them as NOT_SERVING when shutting down and flush their spans once stopped. They are keyed by
+// the address of the server rather than the server itself, so that a server that is never hosted can still be garbage
+// collected, after which its serverLifetime releases its entry.
+var (
+	hostedServersMutex sync.Mutex
+	hostedServers      = map[uintptr]hostedServer{}
+	lastHostedServerID uint64
+)
+
+type hostedServer struct {
+	// id tells apart the servers that are allocated at the same address over time
+	id           uint64
+	health       *HealthRegistry
+	drainDelay   time.Duration
+	tracerCloser io.Closer
+}
+
+// serverLifetime is referenced only by its server, so its finalizer runs once the server has been garbage collected.
+// The server cannot have a finalizer itself, since it references itself and would never be collected.
+type serverLifetime struct {
+	key uintptr
+	id  uint64
+}
+
+func hostedServerKey(server *grpc.Server) uintptr {
+	return uintptr(unsafe.Pointer(server))
+}
+
+// storeHostedServer stores the server's entry and returns the lifetime that the server must reference
+func storeHostedServer(server *grpc.Server, hosted hostedServer) *serverLifetime {
+	hostedServersMutex.Lock()
+	defer hostedServersMutex.Unlock()
+
+	lastHostedServerID++
+	hosted.id = lastHostedServerID
+
+	key := hostedServerKey(server)
+	hostedServers[key] = hosted
+
+	lifetime := &serverLifetime{key: key, id: hosted.id}
+	runtime.SetFinalizer(lifetime, func(lifetime *serverLifetime) {
+		releaseHostedServerEntry(lifetime.key, lifetime.id)
+	})
+
+	return lifetime
+}
+
+func loadHostedServer(server *grpc.Server) (hostedServer, bool) {
+	hostedServersMutex.Lock()
+	defer hostedServersMutex.Unlock()
+
+	hosted, ok := hostedServers[hostedServerKey(server)]
+	return hosted, ok
+}
+
+// releaseHostedServer forgets the server, closing the tracer that was created for it
+func releaseHostedServer(server *grpc.Server) {
+	hosted, ok := loadHostedServer(server)
+	if ok {
+		releaseHostedServerEntry(hostedServerKey(server), hosted.id)
+	}
+}
+
+// releaseHostedServerEntry forgets the entry at the key if it still belongs to the server with the id, closing the
+// tracer that was created for it
+func releaseHostedServerEntry(key uintptr, id uint64) {
+	hostedServersMutex.Lock()
+	hosted, ok := hostedServers[key]
+	if !ok || hosted.id != id {
+		hostedServersMutex.Unlock()
+		return
+	}
+	delete(hostedServers, key)
+	hostedServersMutex.Unlock()
+
+	if hosted.tracerCloser != nil {
+		hosted.tracerCloser.Close()
+	}
+}
@@ -0,0 +1,148 @@
+package grpc_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	sut "github.com/syncromatics/go-kit/v2/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// waitForStatus checks the health of the service until it has the expected status, returning the last status seen
+func waitForStatus(client healthpb.HealthClient, service string, expected healthpb.HealthCheckResponse_ServingStatus) healthpb.HealthCheckResponse_ServingStatus {
+	var actual healthpb.HealthCheckResponse_ServingStatus
+	for start := time.Now(); time.Since(start) < 3*time.Second; time.Sleep(10 * time.Millisecond) {
+		response, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+		if err != nil {
+			continue
+		}
+
+		actual = response.Status
+		if actual == expected {
+			break
+		}
+	}
+
+	return actual
+}
+
+func Test_HealthRegistry_ReportsStatusOfEachService(t *testing.T) {
+	// Arrange
+	registry := sut.NewHealthRegistry()
+	port, cancel := hostServer(t, &sut.Settings{
+		HealthRegistry: registry,
+	})
+	defer cancel()
+
+	conn := dialInsecure(t, port)
+	defer conn.Close()
+
+	client := healthpb.NewHealthClient(conn)
+
+	// Act
+	registry.SetServing("positions")
+	registry.SetNotServing("assignments")
+
+	// Assert
+	tests := map[string]healthpb.HealthCheckResponse_ServingStatus{
+		"":            healthpb.HealthCheckResponse_SERVING,
+		"positions":   healthpb.HealthCheckResponse_SERVING,
+		"assignments": healthpb.HealthCheckResponse_NOT_SERVING,
+	}
+	for service, expected := range tests {
+		response, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+		if assert.Nil(t, err, service) {
+			assert.Equal(t, expected, response.Status, service)
+		}
+	}
+}
+
+func Test_HealthRegistry_Monitor_FollowsCheck(t *testing.T) {
+	// Arrange
+	registry := sut.NewHealthRegistry()
+	port, cancel := hostServer(t, &sut.Settings{
+		HealthRegistry: registry,
+	})
+	defer cancel()
+
+	conn := dialInsecure(t, port)
+	defer conn.Close()
+
+	client := healthpb.NewHealthClient(conn)
+
+	var failing int32
+	check := func(ctx context.Context) error {
+		if atomic.LoadInt32(&failing) == 1 {
+			return errors.New("database unavailable")
+		}
+		return nil
+	}
+
+	ctx, cancelMonitor := context.WithCancel(context.Background())
+	defer cancelMonitor()
+
+	// Act
+	go registry.Monitor(ctx, "database", 10*time.Millisecond, check)()
+
+	// Assert
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, waitForStatus(client, "database", healthpb.HealthCheckResponse_SERVING))
+
+	atomic.StoreInt32(&failing, 1)
+	assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, waitForStatus(client, "database", healthpb.HealthCheckResponse_NOT_SERVING))
+
+	atomic.StoreInt32(&failing, 0)
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, waitForStatus(client, "database", healthpb.HealthCheckResponse_SERVING))
+}
+
+func Test_HostServer_ReportsNotServingBeforeStopping(t *testing.T) {
+	// Arrange
+	registry := sut.NewHealthRegistry()
+	registry.SetServing("positions")
+
+	port, cancel := hostServer(t, &sut.Settings{
+		HealthRegistry: registry,
+		DrainDelay:     time.Second,
+	})
+
+	conn := dialInsecure(t, port)
+	defer conn.Close()
+
+	client := healthpb.NewHealthClient(conn)
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, waitForStatus(client, "positions", healthpb.HealthCheckResponse_SERVING))
+
+	// Act
+	cancel()
+
+	// Assert
+	assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, waitForStatus(client, "", healthpb.HealthCheckResponse_NOT_SERVING))
+
+	response, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{Service: "positions"})
+	if assert.Nil(t, err, "expected the server to keep serving while draining") {
+		assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, response.Status)
+	}
+}
+
+func Test_HostServer_DrainsByDefault(t *testing.T) {
+	// Arrange
+	port, cancel := hostServer(t, &sut.Settings{})
+
+	conn := dialInsecure(t, port)
+	defer conn.Close()
+
+	client := healthpb.NewHealthClient(conn)
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, waitForStatus(client, "", healthpb.HealthCheckResponse_SERVING))
+
+	// Act
+	cancel()
+
+	// Assert
+	assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, waitForStatus(client, "", healthpb.HealthCheckResponse_NOT_SERVING))
+
+	time.Sleep(time.Second)
+	_, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{})
+	assert.Nil(t, err, "expected the server to keep serving while draining")
+}
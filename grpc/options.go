@@ -10,3 +10,14 @@ import (
 func WithInsecure() grpc.DialOption {
 	return grpc.WithInsecure()
 }
+
+// WithTLS returns a DialOption which secures the ClientConn with TLS, presenting a client certificate if the settings
+// have one
+func WithTLS(settings *ClientTLSSettings) (grpc.DialOption, error) {
+	creds, err := ClientTLSCredentials(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	return grpc.WithTransportCredentials(creds), nil
+}
@@ -6,7 +6,10 @@ import (
 	"golang.org/x/net/context"
 )
 
-type pingService struct{}
+type pingService struct {
+	// lifetime releases the server's entry in hostedServers once the server has been garbage collected
+	lifetime *serverLifetime
+}
 
 func (*pingService) Ping(ctx context.Context, m *pingv1.PingRequest) (*pingv1.PingResponse, error) {
 	return &pingv1.PingResponse{}, nil
@@ -3,12 +3,19 @@ package grpc
 import (
 	"context"
 	"fmt"
+	"io"
 	"math"
 	"net"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
 	"time"
 
 	pingv1 "github.com/syncromatics/go-kit/v2/internal/protos/gokit/ping/v1"
+	"github.com/syncromatics/go-kit/v2/log"
+	"github.com/syncromatics/go-kit/v2/tracing"
 
 	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
 	grpc_zap "github.com/grpc-ecosystem/go-grpc-middleware/logging/zap"
@@ -20,9 +27,10 @@ import (
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	jaegerClient "github.com/uber/jaeger-client-go"
-	"github.com/uber/jaeger-client-go/thrift-gen/sampling"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/keepalive"
 	"google.golang.org/grpc/reflection"
 )
@@ -34,10 +42,98 @@ type Settings struct {
 	ServerName                 string
 	BiDirectionalStreamTimeout time.Duration
 	Sampler                    jaegerClient.Sampler
+
+	// Tracer traces requests and is set as the global tracer. When nil, a tracer reporting to the Jaeger agent at
+	// JaegerAgentHost and DefaultUDPSpanServerPort is created, which HostServer closes once the server has stopped. Its
+	// service name is the ServerName, or the name of the executable when that is empty.
+	Tracer opentracing.Tracer
+
+	// UnaryInterceptorsBeforeLogging run after tagging, tracing and metrics but before logging and recovery, such as
+	// to reject requests before they are logged. Their panics are not recovered, so they crash the server.
+	UnaryInterceptorsBeforeLogging []grpc.UnaryServerInterceptor
+	// UnaryInterceptorsAfterRecovery run after logging and recovery, immediately before the handler, so that their
+	// errors are logged and their panics are recovered
+	UnaryInterceptorsAfterRecovery []grpc.UnaryServerInterceptor
+	// StreamInterceptorsBeforeLogging run after tagging, tracing and metrics but before logging, stream timing and
+	// recovery. Their panics are not recovered, so they crash the server.
+	StreamInterceptorsBeforeLogging []grpc.StreamServerInterceptor
+	// StreamInterceptorsAfterRecovery run after logging, stream timing and recovery, immediately before the handler
+	StreamInterceptorsAfterRecovery []grpc.StreamServerInterceptor
+	// ServerOptions are applied after the kit's options, so they can override them. They must not set interceptors;
+	// use the interceptor settings instead.
+	ServerOptions []grpc.ServerOption
+
+	// KeepaliveParams defaults to pinging idle connections after 10 seconds and closing connections idle for 2 minutes
+	KeepaliveParams *keepalive.ServerParameters
+	// KeepaliveEnforcementPolicy defaults to allowing clients to ping every 10 seconds
+	KeepaliveEnforcementPolicy *keepalive.EnforcementPolicy
+	// MaxConcurrentStreams limits the number of concurrent streams for each connection. Defaults to unlimited.
+	MaxConcurrentStreams uint32
+
+	// TLS serves with TLS, and mutual TLS when it has a client certificate authority. The server is insecure when nil.
+	TLS *TLSSettings
+
+	// HealthRegistry is served by the standard grpc.health.v1.Health service. One is created when nil.
+	HealthRegistry *HealthRegistry
+	// DrainDelay is how long HostServer waits after reporting every service as NOT_SERVING before it stops the
+	// server, so that load balancers stop sending it requests first. Defaults to 5 seconds, and is skipped when
+	// negative.
+	DrainDelay time.Duration
 }
 
-// CreateServer will create a grpc server with tracing, prometheus stats, and logging
+const defaultDrainDelay = 5 * time.Second
+
+var (
+	replaceGrpcLogger       sync.Once
+	enableHandlingHistogram sync.Once
+)
+
+// CreateServer will create a grpc server with tracing, prometheus stats, and logging. If the TLS certificate cannot be
+// loaded, the error is logged and handshakes fail until it can be. If the tracer cannot be created, the error is logged
+// and spans are not reported. Use CreateServerWithError to handle these errors instead.
 func CreateServer(s *Settings) *grpc.Server {
+	var creds credentials.TransportCredentials
+	if s.TLS != nil {
+		var err error
+		creds, err = ServerTLSCredentials(s.TLS)
+		if err != nil {
+			log.Error("failed to load tls certificate, handshakes will fail until it can be loaded", "err", err)
+			creds = unloadedServerTLSCredentials(s.TLS)
+		}
+	}
+
+	tracer, tracerCloser, err := serverTracer(s)
+	if err != nil {
+		log.Error("failed to create tracer, spans will not be reported", "err", err)
+		tracer, tracerCloser = opentracing.NoopTracer{}, nil
+	}
+
+	return createServer(s, creds, tracer, tracerCloser)
+}
+
+// CreateServerWithError will create a grpc server like CreateServer, returning an error if the TLS certificate cannot
+// be loaded or the tracer cannot be created
+func CreateServerWithError(s *Settings) (*grpc.Server, error) {
+	var creds credentials.TransportCredentials
+	if s.TLS != nil {
+		var err error
+		creds, err = ServerTLSCredentials(s.TLS)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create tls credentials")
+		}
+	}
+
+	tracer, tracerCloser, err := serverTracer(s)
+	if err != nil {
+		return nil, err
+	}
+
+	return createServer(s, creds, tracer, tracerCloser), nil
+}
+
+// createServer creates the server, serving with the transport credentials when they are not nil. The tracer closer is
+// closed by HostServer once the server has stopped.
+func createServer(s *Settings, creds credentials.TransportCredentials, tracer opentracing.Tracer, tracerCloser io.Closer) *grpc.Server {
 	logConfig := zap.NewProductionConfig()
 	logConfig.Level = zap.NewAtomicLevelAt(zap.WarnLevel)
 	logger, _ := logConfig.Build()
@@ -46,73 +142,156 @@ func CreateServer(s *Settings) *grpc.Server {
 		s.BiDirectionalStreamTimeout = 1 * time.Minute
 	}
 
-	grpc_zap.ReplaceGrpcLogger(logger)
+	// grpclog's logger is not safe to replace while another server is running
+	replaceGrpcLogger.Do(func() {
+		grpc_zap.ReplaceGrpcLogger(logger)
+	})
 
-	transport, err := jaegerClient.NewUDPTransport(fmt.Sprintf("%s:%d", s.JaegerAgentHost, jaegerClient.DefaultUDPSpanServerPort), 60000)
-	if err != nil {
-		panic(err)
+	opentracing.SetGlobalTracer(tracer)
+
+	// the handling time histogram is not safe to enable while another server is handling calls
+	enableHandlingHistogram.Do(func() {
+		grpc_prometheus.EnableHandlingTimeHistogram()
+	})
+
+	streamInterceptors := []grpc.StreamServerInterceptor{
+		grpc_ctxtags.StreamServerInterceptor(),
+		grpc_opentracing.StreamServerInterceptor(grpc_opentracing.WithTracer(tracer)),
+		grpc_prometheus.StreamServerInterceptor,
+	}
+	streamInterceptors = append(streamInterceptors, s.StreamInterceptorsBeforeLogging...)
+	streamInterceptors = append(streamInterceptors,
+		grpc_zap.StreamServerInterceptor(logger),
+		streamTimingInterceptor(s.ServerName, s.BiDirectionalStreamTimeout),
+		grpc_recovery.StreamServerInterceptor(),
+	)
+	streamInterceptors = append(streamInterceptors, s.StreamInterceptorsAfterRecovery...)
+
+	unaryInterceptors := []grpc.UnaryServerInterceptor{
+		grpc_ctxtags.UnaryServerInterceptor(),
+		grpc_opentracing.UnaryServerInterceptor(grpc_opentracing.WithTracer(tracer)),
+		grpc_prometheus.UnaryServerInterceptor,
 	}
+	unaryInterceptors = append(unaryInterceptors, s.UnaryInterceptorsBeforeLogging...)
+	unaryInterceptors = append(unaryInterceptors,
+		grpc_zap.UnaryServerInterceptor(logger),
+		grpc_recovery.UnaryServerInterceptor(),
+	)
+	unaryInterceptors = append(unaryInterceptors, s.UnaryInterceptorsAfterRecovery...)
 
-	sampler := s.Sampler
-	if sampler == nil {
-		sampler = jaegerClient.NewPerOperationSampler(jaegerClient.PerOperationSamplerParams{
-			Strategies: &sampling.PerOperationSamplingStrategies{
-				DefaultSamplingProbability:       0.1,
-				DefaultLowerBoundTracesPerSecond: 1.0,
-			},
-		})
+	keepaliveParams := keepalive.ServerParameters{
+		Time:              10 * time.Second, // wait time before ping if no activity
+		Timeout:           20 * time.Second, // ping timeout
+		MaxConnectionIdle: 2 * time.Minute,  // Max time a connection can be idle, includes pings
+	}
+	if s.KeepaliveParams != nil {
+		keepaliveParams = *s.KeepaliveParams
 	}
 
-	tracer, _ := jaegerClient.NewTracer(s.ServerName,
-		sampler,
-		jaegerClient.NewRemoteReporter(transport))
+	enforcementPolicy := keepalive.EnforcementPolicy{
+		MinTime: 10 * time.Second, // min time a client should wait before sending a ping
+	}
+	if s.KeepaliveEnforcementPolicy != nil {
+		enforcementPolicy = *s.KeepaliveEnforcementPolicy
+	}
 
-	opentracing.SetGlobalTracer(tracer)
-	grpc_prometheus.EnableHandlingTimeHistogram()
-
-	server := grpc.NewServer(
-		grpc.StreamInterceptor(grpc_middleware.ChainStreamServer(
-			grpc_ctxtags.StreamServerInterceptor(),
-			grpc_opentracing.StreamServerInterceptor(grpc_opentracing.WithTracer(tracer)),
-			grpc_prometheus.StreamServerInterceptor,
-			grpc_zap.StreamServerInterceptor(logger),
-			streamTimingInterceptor(s.ServerName, s.BiDirectionalStreamTimeout),
-			grpc_recovery.StreamServerInterceptor(),
-		)),
-		grpc.UnaryInterceptor(grpc_middleware.ChainUnaryServer(
-			grpc_ctxtags.UnaryServerInterceptor(),
-			grpc_opentracing.UnaryServerInterceptor(grpc_opentracing.WithTracer(tracer)),
-			grpc_prometheus.UnaryServerInterceptor,
-			grpc_zap.UnaryServerInterceptor(logger),
-			grpc_recovery.UnaryServerInterceptor(),
-		)),
-		grpc.KeepaliveParams(keepalive.ServerParameters{
-			Time:              10 * time.Second, // wait time before ping if no activity
-			Timeout:           20 * time.Second, // ping timeout
-			MaxConnectionIdle: 2 * time.Minute,  // Max time a connection can be idle, includes pings
-
-		}),
-		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
-			MinTime: 10 * time.Second, // min time a client should wait before sending a ping
-		}),
-		grpc.MaxConcurrentStreams(math.MaxUint32))
-
-	pingv1.RegisterPingAPIServer(server, &pingService{})
+	maxConcurrentStreams := s.MaxConcurrentStreams
+	if maxConcurrentStreams == 0 {
+		maxConcurrentStreams = math.MaxUint32
+	}
+
+	options := []grpc.ServerOption{
+		grpc.StreamInterceptor(grpc_middleware.ChainStreamServer(streamInterceptors...)),
+		grpc.UnaryInterceptor(grpc_middleware.ChainUnaryServer(unaryInterceptors...)),
+		grpc.KeepaliveParams(keepaliveParams),
+		grpc.KeepaliveEnforcementPolicy(enforcementPolicy),
+		grpc.MaxConcurrentStreams(maxConcurrentStreams),
+	}
+	if creds != nil {
+		options = append(options, grpc.Creds(creds))
+	}
+	options = append(options, s.ServerOptions...)
+
+	server := grpc.NewServer(options...)
+
+	if s.HealthRegistry == nil {
+		s.HealthRegistry = NewHealthRegistry()
+	}
+
+	drainDelay := s.DrainDelay
+	if drainDelay == 0 {
+		drainDelay = defaultDrainDelay
+	}
+
+	lifetime := storeHostedServer(server, hostedServer{
+		health:       s.HealthRegistry,
+		drainDelay:   drainDelay,
+		tracerCloser: tracerCloser,
+	})
+
+	pingv1.RegisterPingAPIServer(server, &pingService{lifetime: lifetime})
+	healthpb.RegisterHealthServer(server, s.HealthRegistry.server)
 
 	return server
 }
 
-// HostServer will host the grpc server and gracefully stop if the context is completed
+// serverTracer returns the tracer in the settings, or creates one reporting to the Jaeger agent in the settings along
+// with its closer
+func serverTracer(s *Settings) (opentracing.Tracer, io.Closer, error) {
+	if s.Tracer != nil {
+		return s.Tracer, nil, nil
+	}
+
+	serviceName := s.ServerName
+	if serviceName == "" {
+		serviceName = filepath.Base(os.Args[0])
+	}
+
+	settings := &tracing.Settings{
+		ServiceName: serviceName,
+		Backend:     tracing.JaegerUDP,
+		AgentHost:   s.JaegerAgentHost,
+		Sampler:     s.Sampler,
+	}
+
+	if s.DefaultUDPSpanServerPort != "" {
+		port, err := strconv.Atoi(s.DefaultUDPSpanServerPort)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "invalid jaeger agent port '%s'", s.DefaultUDPSpanServerPort)
+		}
+		settings.AgentPort = port
+	}
+
+	tracer, closer, err := tracing.NewTracer(settings)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to create tracer")
+	}
+
+	return tracer, closer, nil
+}
+
+// HostServer will host the grpc server and gracefully stop if the context is completed. When the server was created by
+// CreateServer, every service is reported as NOT_SERVING before it stops, and the tracer it created is flushed once it
+// has stopped.
 func HostServer(ctx context.Context, server *grpc.Server, port int) func() error {
 	cancel := make(chan struct{})
 	go func() {
 		select {
 		case <-ctx.Done():
+			if hosted, ok := loadHostedServer(server); ok {
+				hosted.health.Shutdown()
+				if hosted.drainDelay > 0 {
+					time.Sleep(hosted.drainDelay)
+				}
+			}
+
 			go func() {
 				time.Sleep(10 * time.Second)
 				server.Stop()
 			}()
 			server.GracefulStop()
+
+			releaseHostedServer(server)
 			return
 		case <-cancel:
 			return
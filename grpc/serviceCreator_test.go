@@ -0,0 +1,253 @@
+package grpc_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/stretchr/testify/assert"
+	sut "github.com/syncromatics/go-kit/v2/grpc"
+	pingv1 "github.com/syncromatics/go-kit/v2/internal/protos/gokit/ping/v1"
+	"github.com/syncromatics/go-kit/v2/tracing"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/status"
+)
+
+func Test_CreateServer_TracesWithSettingsTracer(t *testing.T) {
+	// Arrange
+	tracer, closer, err := tracing.NewTracer(&tracing.Settings{
+		Backend: tracing.Memory,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closer.Close()
+
+	port, cancel := hostServer(t, &sut.Settings{
+		ServerName: "traced",
+		Tracer:     tracer,
+	})
+	defer cancel()
+
+	conn, err := sut.Dial(fmt.Sprintf("localhost:%d", port), sut.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Act
+	_, err = pingv1.NewPingAPIClient(conn).Ping(context.Background(), &pingv1.PingRequest{})
+
+	// Assert
+	assert.Nil(t, err)
+
+	spans := tracer.(*mocktracer.MockTracer).FinishedSpans()
+	if assert.Len(t, spans, 1) {
+		assert.Equal(t, pingMethod, spans[0].OperationName)
+	}
+}
+
+func Test_CreateServerWithError_ReturnsTracerError(t *testing.T) {
+	// Act
+	server, err := sut.CreateServerWithError(&sut.Settings{
+		ServerName:               "invalid-agent-port",
+		DefaultUDPSpanServerPort: "jaeger",
+	})
+
+	// Assert
+	assert.NotNil(t, err)
+	assert.Nil(t, server)
+}
+
+func Test_CreateServerWithError_TracesWithoutServerName(t *testing.T) {
+	// Act
+	server, err := sut.CreateServerWithError(&sut.Settings{})
+
+	// Assert
+	assert.Nil(t, err)
+	if assert.NotNil(t, server) {
+		server.Stop()
+	}
+}
+
+func dialInsecure(t *testing.T, port int) *grpc.ClientConn {
+	conn, err := sut.Dial(fmt.Sprintf("localhost:%d", port), sut.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// watchHealth opens a stream watching the overall health of the server and waits for its first status
+func watchHealth(ctx context.Context, conn *grpc.ClientConn) (healthpb.Health_WatchClient, error) {
+	stream, err := healthpb.NewHealthClient(conn).Watch(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = stream.Recv()
+	if err != nil {
+		return nil, err
+	}
+
+	return stream, nil
+}
+
+func Test_CreateServer_BeforeLoggingInterceptorRejectsBeforeHandler(t *testing.T) {
+	// Arrange
+	handled := false
+	port, cancel := hostServer(t, &sut.Settings{
+		UnaryInterceptorsBeforeLogging: []grpc.UnaryServerInterceptor{
+			func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+				return nil, status.Error(codes.PermissionDenied, "not allowed")
+			},
+		},
+		UnaryInterceptorsAfterRecovery: []grpc.UnaryServerInterceptor{
+			func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+				handled = true
+				return handler(ctx, req)
+			},
+		},
+	})
+	defer cancel()
+
+	conn := dialInsecure(t, port)
+	defer conn.Close()
+
+	// Act
+	_, err := pingv1.NewPingAPIClient(conn).Ping(context.Background(), &pingv1.PingRequest{})
+
+	// Assert
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	assert.False(t, handled)
+}
+
+func Test_CreateServer_RecoversPanicsInAfterRecoveryInterceptors(t *testing.T) {
+	// Arrange
+	port, cancel := hostServer(t, &sut.Settings{
+		UnaryInterceptorsAfterRecovery: []grpc.UnaryServerInterceptor{
+			func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+				panic("nil vehicle")
+			},
+		},
+	})
+	defer cancel()
+
+	conn := dialInsecure(t, port)
+	defer conn.Close()
+
+	// Act
+	_, err := pingv1.NewPingAPIClient(conn).Ping(context.Background(), &pingv1.PingRequest{})
+
+	// Assert
+	assert.Equal(t, codes.Internal, status.Code(err))
+
+	_, err = healthpb.NewHealthClient(conn).Check(context.Background(), &healthpb.HealthCheckRequest{})
+	assert.Equal(t, codes.Internal, status.Code(err), "expected the server to keep serving after the panic")
+}
+
+func Test_CreateServer_AppliesDefaults(t *testing.T) {
+	// Arrange
+	settings := &sut.Settings{}
+	port, cancel := hostServer(t, settings)
+	defer cancel()
+
+	conn := dialInsecure(t, port)
+	defer conn.Close()
+
+	ctx, cancelStreams := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelStreams()
+
+	// Act
+	// clients allow 100 concurrent streams unless the server allows more
+	var err error
+	for i := 0; i < 150 && err == nil; i++ {
+		_, err = watchHealth(ctx, conn)
+	}
+
+	// Assert
+	assert.Nil(t, err)
+	assert.Equal(t, time.Minute, settings.BiDirectionalStreamTimeout)
+	assert.NotNil(t, settings.HealthRegistry)
+}
+
+func Test_CreateServer_LimitsConcurrentStreams(t *testing.T) {
+	// Arrange
+	port, cancel := hostServer(t, &sut.Settings{
+		MaxConcurrentStreams: 1,
+	})
+	defer cancel()
+
+	conn := dialInsecure(t, port)
+	defer conn.Close()
+
+	_, err := watchHealth(context.Background(), conn)
+	assert.Nil(t, err)
+
+	ctx, cancelSecond := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancelSecond()
+
+	// Act
+	_, err = watchHealth(ctx, conn)
+
+	// Assert
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+}
+
+func Test_CreateServer_AppliesKeepaliveParams(t *testing.T) {
+	// Arrange
+	port, cancel := hostServer(t, &sut.Settings{
+		KeepaliveParams: &keepalive.ServerParameters{
+			MaxConnectionAge:      100 * time.Millisecond,
+			MaxConnectionAgeGrace: 100 * time.Millisecond,
+		},
+	})
+	defer cancel()
+
+	conn := dialInsecure(t, port)
+	defer conn.Close()
+
+	stream, err := watchHealth(context.Background(), conn)
+	assert.Nil(t, err)
+
+	// Act
+	closed := make(chan error)
+	go func() {
+		_, err := stream.Recv()
+		closed <- err
+	}()
+
+	// Assert
+	select {
+	case err = <-closed:
+		assert.Equal(t, codes.Unavailable, status.Code(err))
+	case <-time.After(3 * time.Second):
+		assert.Fail(t, "expected the connection to be closed once it reached its maximum age")
+	}
+}
+
+func Test_CreateServer_AppliesServerOptions(t *testing.T) {
+	// Arrange
+	port, cancel := hostServer(t, &sut.Settings{
+		ServerOptions: []grpc.ServerOption{
+			grpc.UnknownServiceHandler(func(srv interface{}, stream grpc.ServerStream) error {
+				return status.Error(codes.AlreadyExists, "handled by unknown service handler")
+			}),
+		},
+	})
+	defer cancel()
+
+	conn := dialInsecure(t, port)
+	defer conn.Close()
+
+	// Act
+	err := conn.Invoke(context.Background(), "/gokit.unknown.v1.UnknownAPI/Unknown", &pingv1.PingRequest{}, &pingv1.PingResponse{})
+
+	// Assert
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+}
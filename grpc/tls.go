@@ -0,0 +1,262 @@
+package grpc
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/syncromatics/go-kit/v2/log"
+	"google.golang.org/grpc/credentials"
+)
+
+const defaultReloadInterval = 30 * time.Second
+
+// TLSSettings are the settings for serving with TLS
+type TLSSettings struct {
+	// CertFile and KeyFile are the PEM encoded certificate and private key of the server
+	CertFile string
+	KeyFile  string
+	// ClientCAFile is a PEM encoded bundle of certificate authorities. When set, clients must present a certificate
+	// signed by one of them (mutual TLS).
+	ClientCAFile string
+	// ReloadInterval is how often the files are checked for changes, such as when a mounted Kubernetes secret is
+	// updated. Defaults to 30 seconds.
+	ReloadInterval time.Duration
+}
+
+// ClientTLSSettings are the settings for dialing a server with TLS
+type ClientTLSSettings struct {
+	// CAFile is a PEM encoded bundle of the certificate authorities trusted to sign the server's certificate. The
+	// system's certificate authorities are trusted when empty.
+	CAFile string
+	// CertFile and KeyFile are the PEM encoded certificate and private key presented to servers that require mutual
+	// TLS. They are reloaded when the files change.
+	CertFile string
+	KeyFile  string
+	// ServerName overrides the host name used to verify the server's certificate
+	ServerName string
+	// ReloadInterval is how often the client certificate files are checked for changes. Defaults to 30 seconds.
+	ReloadInterval time.Duration
+}
+
+// ServerTLSCredentials creates transport credentials for a server from the settings. The certificate and client
+// certificate authorities are reloaded when their files change.
+func ServerTLSCredentials(settings *TLSSettings) (credentials.TransportCredentials, error) {
+	reloader, err := newCertificateReloader(settings.CertFile, settings.KeyFile, settings.ClientCAFile, settings.ReloadInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	return serverTLSCredentials(settings, reloader), nil
+}
+
+// unloadedServerTLSCredentials creates transport credentials for a server whose certificate could not be loaded.
+// Loading is retried by handshakes at most once every reload interval, and they fail until it succeeds.
+func unloadedServerTLSCredentials(settings *TLSSettings) credentials.TransportCredentials {
+	reloader := &certificateReloader{
+		certFile: settings.CertFile,
+		keyFile:  settings.KeyFile,
+		caFile:   settings.ClientCAFile,
+		interval: settings.ReloadInterval,
+	}
+	if reloader.interval <= 0 {
+		reloader.interval = defaultReloadInterval
+	}
+
+	return serverTLSCredentials(settings, reloader)
+}
+
+func serverTLSCredentials(settings *TLSSettings, reloader *certificateReloader) credentials.TransportCredentials {
+	clientAuth := tls.NoClientCert
+	if settings.ClientCAFile != "" {
+		clientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return credentials.NewTLS(&tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			certificate, clientCAs := reloader.current()
+			if certificate == nil {
+				return nil, errors.Errorf("tls certificate '%s' has not been loaded", settings.CertFile)
+			}
+
+			// the config returned here replaces the one from credentials.NewTLS, so it must also negotiate http/2
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*certificate},
+				ClientCAs:    clientCAs,
+				ClientAuth:   clientAuth,
+				NextProtos:   []string{"h2"},
+			}, nil
+		},
+	})
+}
+
+// ClientTLSCredentials creates transport credentials for a client from the settings
+func ClientTLSCredentials(settings *ClientTLSSettings) (credentials.TransportCredentials, error) {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: settings.ServerName,
+	}
+
+	if settings.CAFile != "" {
+		pool, err := loadCertPool(settings.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+
+	if settings.CertFile != "" || settings.KeyFile != "" {
+		reloader, err := newCertificateReloader(settings.CertFile, settings.KeyFile, "", settings.ReloadInterval)
+		if err != nil {
+			return nil, err
+		}
+
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			certificate, _ := reloader.current()
+			return certificate, nil
+		}
+	}
+
+	return credentials.NewTLS(config), nil
+}
+
+// certificateReloader holds a certificate and an optional certificate authority bundle loaded from files, which are
+// reloaded when the files' modification times change
+type certificateReloader struct {
+	certFile string
+	keyFile  string
+	caFile   string
+	interval time.Duration
+
+	mutex       sync.Mutex
+	checked     time.Time
+	modTimes    []time.Time
+	certificate *tls.Certificate
+	pool        *x509.CertPool
+}
+
+func newCertificateReloader(certFile, keyFile, caFile string, interval time.Duration) (*certificateReloader, error) {
+	if interval <= 0 {
+		interval = defaultReloadInterval
+	}
+
+	reloader := &certificateReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		caFile:   caFile,
+		interval: interval,
+	}
+
+	modTimes, err := reloader.stat()
+	if err != nil {
+		return nil, err
+	}
+
+	err = reloader.load(modTimes)
+	if err != nil {
+		return nil, err
+	}
+
+	return reloader, nil
+}
+
+// current returns the loaded certificate and certificate authorities, first reloading them if the files have changed
+// since they were last checked. If the files cannot be reloaded, the previous ones continue to be used.
+func (r *certificateReloader) current() (*tls.Certificate, *x509.CertPool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if time.Since(r.checked) < r.interval {
+		return r.certificate, r.pool
+	}
+	r.checked = time.Now()
+
+	modTimes, err := r.stat()
+	if err == nil && !r.changed(modTimes) {
+		return r.certificate, r.pool
+	}
+	if err == nil {
+		err = r.load(modTimes)
+	}
+	if err != nil {
+		log.Warn("failed to reload tls certificate", "err", err, "certFile", r.certFile)
+	}
+
+	return r.certificate, r.pool
+}
+
+func (r *certificateReloader) files() []string {
+	files := []string{r.certFile, r.keyFile}
+	if r.caFile != "" {
+		files = append(files, r.caFile)
+	}
+	return files
+}
+
+// stat returns the modification times of the files
+func (r *certificateReloader) stat() ([]time.Time, error) {
+	var modTimes []time.Time
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to stat '%s'", file)
+		}
+		modTimes = append(modTimes, info.ModTime())
+	}
+	return modTimes, nil
+}
+
+func (r *certificateReloader) changed(modTimes []time.Time) bool {
+	if len(modTimes) != len(r.modTimes) {
+		return true
+	}
+	for i, modTime := range modTimes {
+		if !modTime.Equal(r.modTimes[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// load reads the files, and must be called while holding the mutex once the reloader has been created
+func (r *certificateReloader) load(modTimes []time.Time) error {
+	certificate, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return errors.Wrap(err, "failed to load certificate")
+	}
+
+	var pool *x509.CertPool
+	if r.caFile != "" {
+		pool, err = loadCertPool(r.caFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	r.certificate = &certificate
+	r.pool = pool
+	r.modTimes = modTimes
+	r.checked = time.Now()
+
+	return nil
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read certificate authorities from '%s'", file)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.Errorf("no certificates found in '%s'", file)
+	}
+
+	return pool, nil
+}
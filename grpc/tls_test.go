@@ -0,0 +1,372 @@
+package grpc_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/phayes/freeport"
+	"github.com/stretchr/testify/assert"
+	sut "github.com/syncromatics/go-kit/v2/grpc"
+	pingv1 "github.com/syncromatics/go-kit/v2/internal/protos/gokit/ping/v1"
+	"google.golang.org/grpc"
+)
+
+type certificate struct {
+	template *x509.Certificate
+	key      *ecdsa.PrivateKey
+	der      []byte
+}
+
+func newCertificate(t *testing.T, commonName string, parent *certificate) *certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	signer := &certificate{template: template, key: key}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer = parent
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer.template, &key.PublicKey, signer.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &certificate{template: template, key: key, der: der}
+}
+
+// write writes the certificate and key to "<name>.crt" and "<name>.key" in the directory
+func (c *certificate) write(t *testing.T, dir string, name string) (string, string) {
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+
+	err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return certFile, keyFile
+}
+
+func hostServer(t *testing.T, settings *sut.Settings) (int, context.CancelFunc) {
+	port, err := freeport.GetFreePort()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	server := sut.CreateServer(settings)
+	go sut.HostServer(ctx, server, port)()
+
+	// wait for the server to start listening
+	for i := 0; i < 100; i++ {
+		conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+		if err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return port, cancel
+}
+
+func ping(port int, option grpc.DialOption) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := sut.Dial(fmt.Sprintf("localhost:%d", port), option)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = pingv1.NewPingAPIClient(conn).Ping(ctx, &pingv1.PingRequest{})
+	return err
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func Test_TLS(t *testing.T) {
+	// Arrange
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	ca := newCertificate(t, "ca", nil)
+	caFile, _ := ca.write(t, dir, "ca")
+	certFile, keyFile := newCertificate(t, "server", ca).write(t, dir, "server")
+
+	port, cancel := hostServer(t, &sut.Settings{
+		ServerName: "tls",
+		TLS: &sut.TLSSettings{
+			CertFile: certFile,
+			KeyFile:  keyFile,
+		},
+	})
+	defer cancel()
+
+	option, err := sut.WithTLS(&sut.ClientTLSSettings{CAFile: caFile})
+	assert.Nil(t, err)
+
+	// Act
+	err = ping(port, option)
+
+	// Assert
+	assert.Nil(t, err)
+}
+
+func Test_TLS_MutualTLS(t *testing.T) {
+	// Arrange
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	ca := newCertificate(t, "ca", nil)
+	caFile, _ := ca.write(t, dir, "ca")
+	certFile, keyFile := newCertificate(t, "server", ca).write(t, dir, "server")
+	clientCertFile, clientKeyFile := newCertificate(t, "client", ca).write(t, dir, "client")
+
+	port, cancel := hostServer(t, &sut.Settings{
+		ServerName: "mtls",
+		TLS: &sut.TLSSettings{
+			CertFile:     certFile,
+			KeyFile:      keyFile,
+			ClientCAFile: caFile,
+		},
+	})
+	defer cancel()
+
+	withCertificate, err := sut.WithTLS(&sut.ClientTLSSettings{
+		CAFile:   caFile,
+		CertFile: clientCertFile,
+		KeyFile:  clientKeyFile,
+	})
+	assert.Nil(t, err)
+
+	withoutCertificate, err := sut.WithTLS(&sut.ClientTLSSettings{CAFile: caFile})
+	assert.Nil(t, err)
+
+	// Act
+	authorizedErr := ping(port, withCertificate)
+	unauthorizedErr := ping(port, withoutCertificate)
+
+	// Assert
+	assert.Nil(t, authorizedErr)
+	assert.NotNil(t, unauthorizedErr)
+}
+
+func Test_TLS_NegotiatesHTTP2(t *testing.T) {
+	// Arrange
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	ca := newCertificate(t, "ca", nil)
+	certFile, keyFile := newCertificate(t, "server", ca).write(t, dir, "server")
+
+	creds, err := sut.ServerTLSCredentials(&sut.TLSSettings{
+		CertFile: certFile,
+		KeyFile:  keyFile,
+	})
+	assert.Nil(t, err)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		tlsConn, _, _ := creds.ServerHandshake(conn)
+		if tlsConn != nil {
+			tlsConn.Close()
+		}
+	}()
+
+	// Act
+	conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"h2"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Assert
+	assert.Equal(t, "h2", conn.ConnectionState().NegotiatedProtocol)
+}
+
+func Test_TLS_ReloadsCertificate(t *testing.T) {
+	// Arrange
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	ca := newCertificate(t, "ca", nil)
+	certFile, keyFile := newCertificate(t, "original", ca).write(t, dir, "server")
+
+	creds, err := sut.ServerTLSCredentials(&sut.TLSSettings{
+		CertFile:       certFile,
+		KeyFile:        keyFile,
+		ReloadInterval: 10 * time.Millisecond,
+	})
+	assert.Nil(t, err)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				tlsConn, _, _ := creds.ServerHandshake(conn)
+				if tlsConn != nil {
+					tlsConn.Close()
+				}
+			}()
+		}
+	}()
+
+	serverName := func() string {
+		conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+
+	before := serverName()
+
+	// Act
+	time.Sleep(20 * time.Millisecond)
+	newCertificate(t, "renewed", ca).write(t, dir, "server")
+
+	var after string
+	for i := 0; i < 50 && after != "renewed"; i++ {
+		time.Sleep(20 * time.Millisecond)
+		after = serverName()
+	}
+
+	// Assert
+	assert.Equal(t, "original", before)
+	assert.Equal(t, "renewed", after)
+}
+
+func Test_CreateServerWithError_ReturnsTLSError(t *testing.T) {
+	// Arrange
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	// Act
+	server, err := sut.CreateServerWithError(&sut.Settings{
+		ServerName: "missing-certificate",
+		TLS: &sut.TLSSettings{
+			CertFile: filepath.Join(dir, "server.crt"),
+			KeyFile:  filepath.Join(dir, "server.key"),
+		},
+	})
+
+	// Assert
+	assert.NotNil(t, err)
+	assert.Nil(t, server)
+}
+
+func Test_TLS_ServesOnceCertificateIsWritten(t *testing.T) {
+	// Arrange
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	ca := newCertificate(t, "ca", nil)
+	caFile, _ := ca.write(t, dir, "ca")
+
+	port, cancel := hostServer(t, &sut.Settings{
+		ServerName: "tls-written-later",
+		TLS: &sut.TLSSettings{
+			CertFile:       filepath.Join(dir, "server.crt"),
+			KeyFile:        filepath.Join(dir, "server.key"),
+			ReloadInterval: 10 * time.Millisecond,
+		},
+	})
+	defer cancel()
+
+	option, err := sut.WithTLS(&sut.ClientTLSSettings{CAFile: caFile})
+	assert.Nil(t, err)
+
+	before := ping(port, option)
+
+	// Act
+	newCertificate(t, "server", ca).write(t, dir, "server")
+
+	var after error
+	for i := 0; i < 50; i++ {
+		time.Sleep(20 * time.Millisecond)
+		after = ping(port, option)
+		if after == nil {
+			break
+		}
+	}
+
+	// Assert
+	assert.NotNil(t, before)
+	assert.Nil(t, after)
+}
@@ -0,0 +1,88 @@
+// Package metrics shares prometheus collectors between every client that registers them with the same registerer
+package metrics
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Registrations tracks the collectors registered with each prometheus.Registerer. Clients using the same registerer
+// share the collectors, which are unregistered once the last of those clients releases them.
+type Registrations struct {
+	mutex        sync.Mutex
+	byRegisterer map[prometheus.Registerer]*Registration
+}
+
+// Registration is the set of collectors registered with a single prometheus.Registerer
+type Registration struct {
+	registerer prometheus.Registerer
+	references int
+	value      interface{}
+	// registered are the collectors registered by this registration, which excludes equivalent collectors that were
+	// already registered by someone else
+	registered []prometheus.Collector
+}
+
+// NewRegistrations creates an empty set of registrations
+func NewRegistrations() *Registrations {
+	return &Registrations{
+		byRegisterer: map[prometheus.Registerer]*Registration{},
+	}
+}
+
+// Acquire returns the value built for the given registerer, calling build to register its collectors if this is the
+// first use. The default registerer is used when nil.
+func (r *Registrations) Acquire(registerer prometheus.Registerer, build func(*Registration) interface{}) interface{} {
+	if registerer == nil {
+		registerer = prometheus.DefaultRegisterer
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	registration, ok := r.byRegisterer[registerer]
+	if !ok {
+		registration = &Registration{
+			registerer: registerer,
+		}
+		registration.value = build(registration)
+		r.byRegisterer[registerer] = registration
+	}
+	registration.references++
+
+	return registration.value
+}
+
+// Release unregisters the registration's collectors once every value acquired from it has been released
+func (r *Registrations) Release(registration *Registration) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	registration.references--
+	if registration.references > 0 {
+		return
+	}
+
+	for _, collector := range registration.registered {
+		registration.registerer.Unregister(collector)
+	}
+	delete(r.byRegisterer, registration.registerer)
+}
+
+// Register registers the collector, or returns the equivalent collector if one is already registered. Collectors that
+// were already registered are left registered on release, since they belong to whoever registered them.
+func (r *Registration) Register(collector prometheus.Collector) prometheus.Collector {
+	err := r.registerer.Register(collector)
+	if err != nil {
+		existing, ok := err.(prometheus.AlreadyRegisteredError)
+		if !ok {
+			panic(err)
+		}
+		return existing.ExistingCollector
+	}
+
+	r.registered = append(r.registered, collector)
+
+	return collector
+}
@@ -0,0 +1,95 @@
+package metrics_test
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	sut "github.com/syncromatics/go-kit/v2/internal/metrics"
+)
+
+type testMetrics struct {
+	registration *sut.Registration
+	messages     prometheus.Counter
+}
+
+func acquire(registrations *sut.Registrations, registerer prometheus.Registerer) *testMetrics {
+	return registrations.Acquire(registerer, func(registration *sut.Registration) interface{} {
+		return &testMetrics{
+			registration: registration,
+			messages: registration.Register(prometheus.NewCounter(prometheus.CounterOpts{
+				Name: "test_messages_total",
+				Help: "The total number of messages",
+			})).(prometheus.Counter),
+		}
+	}).(*testMetrics)
+}
+
+func Test_Registrations_SharedByRegisterer(t *testing.T) {
+	// Arrange
+	registrations := sut.NewRegistrations()
+	registry := prometheus.NewRegistry()
+
+	// Act
+	first := acquire(registrations, registry)
+	second := acquire(registrations, registry)
+	other := acquire(registrations, prometheus.NewRegistry())
+
+	// Assert
+	assert.True(t, first == second)
+	assert.False(t, first == other)
+}
+
+func Test_Registrations_UnregistersOnLastRelease(t *testing.T) {
+	// Arrange
+	registrations := sut.NewRegistrations()
+	registry := prometheus.NewRegistry()
+
+	first := acquire(registrations, registry)
+	second := acquire(registrations, registry)
+	first.messages.Inc()
+
+	// Act
+	registrations.Release(first.registration)
+
+	// Assert
+	families, err := registry.Gather()
+	assert.Nil(t, err)
+	assert.Len(t, families, 1)
+
+	// Act
+	registrations.Release(second.registration)
+
+	// Assert
+	families, err = registry.Gather()
+	assert.Nil(t, err)
+	assert.Empty(t, families)
+
+	third := acquire(registrations, registry)
+	assert.False(t, first == third)
+}
+
+func Test_Registrations_LeavesExistingCollectorsRegistered(t *testing.T) {
+	// Arrange
+	registrations := sut.NewRegistrations()
+	registry := prometheus.NewRegistry()
+
+	existing := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "test_messages_total",
+		Help: "The total number of messages",
+	})
+	registry.MustRegister(existing)
+
+	acquired := acquire(registrations, registry)
+
+	// Act
+	registrations.Release(acquired.registration)
+
+	// Assert
+	assert.True(t, acquired.messages == existing)
+
+	existing.Inc()
+	families, err := registry.Gather()
+	assert.Nil(t, err)
+	assert.Len(t, families, 1)
+}
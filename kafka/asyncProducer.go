@@ -0,0 +1,125 @@
+package kafka
+
+import (
+	"context"
+	"sync"
+
+	"github.com/Shopify/sarama"
+	"github.com/pkg/errors"
+	"github.com/syncromatics/go-kit/v2/log"
+)
+
+// AsyncProducer produces messages to Kafka in batches without waiting for the brokers to acknowledge each one.
+// Messages that fail to be produced are logged and counted in the kafka_produce_errors_total metric.
+//
+// Run must be running for messages to be produced, and must only be called once.
+type AsyncProducer struct {
+	producer sarama.AsyncProducer
+	metrics  *metrics
+
+	// closing is closed to stop Produce from waiting on the producer's input once Run is stopping
+	closing   chan struct{}
+	closeOnce sync.Once
+
+	// mutex guards closed, so that the producer's input is never sent to after it is closed
+	mutex  sync.RWMutex
+	closed bool
+}
+
+// NewAsyncProducer creates an AsyncProducer connected to the given brokers
+func NewAsyncProducer(brokers []string, settings *ProducerSettings) (*AsyncProducer, error) {
+	producer, err := sarama.NewAsyncProducer(brokers, settings.config())
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create producer")
+	}
+
+	return &AsyncProducer{
+		producer: producer,
+		metrics:  acquireMetrics(settings.Registerer),
+		closing:  make(chan struct{}),
+	}, nil
+}
+
+// Produce queues the message to be sent, blocking while the producer's buffer is full until the context ends
+func (p *AsyncProducer) Produce(ctx context.Context, message *sarama.ProducerMessage) error {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	if p.closed {
+		return ErrClosed
+	}
+
+	select {
+	case p.producer.Input() <- message:
+		return nil
+	case <-p.closing:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Run records the result of every message produced until the context ends, then stops accepting messages, waits for
+// the queued ones to be sent and closes the connections to the brokers. It is intended to be started in a
+// cmd.ProcessGroup.
+func (p *AsyncProducer) Run(ctx context.Context) error {
+	successes := p.producer.Successes()
+	errs := p.producer.Errors()
+
+	for {
+		select {
+		case message := <-successes:
+			p.succeeded(message)
+		case err := <-errs:
+			p.failed(err)
+		case <-ctx.Done():
+			return p.close(successes, errs)
+		}
+	}
+}
+
+func (p *AsyncProducer) close(successes <-chan *sarama.ProducerMessage, errs <-chan *sarama.ProducerError) error {
+	defer p.metrics.release()
+
+	p.closeOnce.Do(func() {
+		close(p.closing)
+	})
+
+	p.mutex.Lock()
+	p.closed = true
+	p.mutex.Unlock()
+
+	p.producer.AsyncClose()
+
+	// the producer closes both channels once every queued message has been sent or has failed
+	for successes != nil || errs != nil {
+		select {
+		case message, ok := <-successes:
+			if !ok {
+				successes = nil
+				continue
+			}
+			p.succeeded(message)
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			p.failed(err)
+		}
+	}
+
+	return nil
+}
+
+func (p *AsyncProducer) succeeded(message *sarama.ProducerMessage) {
+	p.metrics.messagesProduced.WithLabelValues(message.Topic).Inc()
+}
+
+func (p *AsyncProducer) failed(err *sarama.ProducerError) {
+	p.metrics.produceErrors.WithLabelValues(err.Msg.Topic).Inc()
+	log.Error("failed to produce message",
+		"err", err.Err,
+		"topic", err.Msg.Topic,
+	)
+}
@@ -0,0 +1,31 @@
+// Package kafka produces messages to and consumes messages from Kafka topics, with Prometheus metrics for throughput
+// and consumer lag
+package kafka
+
+import (
+	"github.com/Shopify/sarama"
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrClosed is returned when producing to a producer that has been closed
+	ErrClosed = errors.New("producer is closed")
+)
+
+// DefaultVersion is the version of the Kafka protocol used when the settings do not specify one
+var DefaultVersion = sarama.V2_0_0_0
+
+func newConfig(version sarama.KafkaVersion, clientID string) *sarama.Config {
+	config := sarama.NewConfig()
+
+	config.Version = version
+	if config.Version == (sarama.KafkaVersion{}) {
+		config.Version = DefaultVersion
+	}
+
+	if clientID != "" {
+		config.ClientID = clientID
+	}
+
+	return config
+}
@@ -0,0 +1,238 @@
+package kafka
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/syncromatics/go-kit/v2/log"
+)
+
+// MessageHandler handles a message consumed from a topic. When it returns an error, the message is not marked as
+// consumed and the consumer group stops.
+type MessageHandler func(ctx context.Context, message *sarama.ConsumerMessage) error
+
+// ConsumerGroupSettings are the settings for a ConsumerGroup
+type ConsumerGroupSettings struct {
+	// Version is the version of the Kafka protocol to use. Defaults to DefaultVersion.
+	Version sarama.KafkaVersion
+	// ClientID identifies the consumer to the brokers
+	ClientID string
+	// FromOldest starts partitions that the group has no committed offset for at the oldest message, instead of at
+	// the next message to be produced
+	FromOldest bool
+	// Registerer is where the consumer group's metrics are registered. Defaults to prometheus.DefaultRegisterer.
+	Registerer prometheus.Registerer
+}
+
+// ConsumerGroup consumes messages from topics as a member of a Kafka consumer group, which divides the topics'
+// partitions between its members
+type ConsumerGroup struct {
+	brokers []string
+	group   string
+	topics  []string
+	config  *sarama.Config
+
+	registerer prometheus.Registerer
+}
+
+// NewConsumerGroup creates a ConsumerGroup that joins the named group to consume the given topics
+func NewConsumerGroup(brokers []string, group string, topics []string, settings *ConsumerGroupSettings) *ConsumerGroup {
+	config := newConfig(settings.Version, settings.ClientID)
+	config.Consumer.Return.Errors = true
+	if settings.FromOldest {
+		config.Consumer.Offsets.Initial = sarama.OffsetOldest
+	}
+
+	return &ConsumerGroup{
+		brokers:    brokers,
+		group:      group,
+		topics:     topics,
+		config:     config,
+		registerer: settings.Registerer,
+	}
+}
+
+// Run joins the consumer group and passes each message from the partitions claimed by this member to the handler, one
+// partition at a time, until the context ends or the handler returns an error. It is intended to be started in a
+// cmd.ProcessGroup.
+//
+// When the group rebalances, the message being handled for each partition is finished and marked before the
+// partition is released, and the offsets of handled messages are committed.
+func (c *ConsumerGroup) Run(ctx context.Context, handler MessageHandler) error {
+	group, err := sarama.NewConsumerGroup(c.brokers, c.group, c.config)
+	if err != nil {
+		return errors.Wrapf(err, "failed to join consumer group '%s'", c.group)
+	}
+
+	metrics := acquireMetrics(c.registerer)
+	defer metrics.release()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for err := range group.Errors() {
+			metrics.consumerErrors.WithLabelValues(c.group).Inc()
+			log.Warn("consumer group error",
+				"err", err,
+				"group", c.group,
+			)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	groupHandler := &groupHandler{
+		ctx:     ctx,
+		cancel:  cancel,
+		group:   c.group,
+		handler: handler,
+		metrics: metrics,
+	}
+
+	err = c.consume(ctx, group, groupHandler)
+
+	closeErr := group.Close()
+	wg.Wait()
+
+	if err != nil {
+		return err
+	}
+	if handlerErr := groupHandler.failure(); handlerErr != nil {
+		return handlerErr
+	}
+	if closeErr != nil {
+		return errors.Wrap(closeErr, "failed to close consumer group")
+	}
+
+	return nil
+}
+
+// consume rejoins the group after every rebalance until the context ends
+func (c *ConsumerGroup) consume(ctx context.Context, group sarama.ConsumerGroup, handler *groupHandler) error {
+	for {
+		err := group.Consume(ctx, c.topics, handler)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed to consume as consumer group '%s'", c.group)
+		}
+	}
+}
+
+// groupHandler is the sarama.ConsumerGroupHandler for a single run of a ConsumerGroup
+type groupHandler struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	group   string
+	handler MessageHandler
+	metrics *metrics
+
+	mutex sync.Mutex
+	err   error
+}
+
+// Setup is called when partitions are assigned to this member, after a rebalance
+func (h *groupHandler) Setup(session sarama.ConsumerGroupSession) error {
+	claimed := 0
+	for _, partitions := range session.Claims() {
+		claimed += len(partitions)
+	}
+
+	h.metrics.rebalances.WithLabelValues(h.group).Inc()
+	h.metrics.claims.WithLabelValues(h.group).Set(float64(claimed))
+
+	log.Info("claimed partitions",
+		"group", h.group,
+		"member", session.MemberID(),
+		"generation", session.GenerationID(),
+		"claims", session.Claims(),
+	)
+
+	return nil
+}
+
+// Cleanup is called once every partition has been released, before the offsets are committed
+func (h *groupHandler) Cleanup(session sarama.ConsumerGroupSession) error {
+	h.metrics.claims.WithLabelValues(h.group).Set(0)
+	for topic, partitions := range session.Claims() {
+		for _, partition := range partitions {
+			h.metrics.consumerLag.DeleteLabelValues(h.group, topic, strconv.Itoa(int(partition)))
+		}
+	}
+
+	log.Info("released partitions",
+		"group", h.group,
+		"member", session.MemberID(),
+		"generation", session.GenerationID(),
+	)
+
+	return nil
+}
+
+// ConsumeClaim handles the messages of a single partition until it is released
+func (h *groupHandler) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	partition := strconv.Itoa(int(claim.Partition()))
+	lag := h.metrics.consumerLag.WithLabelValues(h.group, claim.Topic(), partition)
+	consumed := h.metrics.messagesConsumed.WithLabelValues(h.group, claim.Topic())
+	failed := h.metrics.handlerErrors.WithLabelValues(h.group, claim.Topic())
+	duration := h.metrics.handlerDuration.WithLabelValues(h.group, claim.Topic())
+
+	for {
+		select {
+		case message, ok := <-claim.Messages():
+			if !ok {
+				return nil
+			}
+
+			// the message is handled with the run's context instead of the session's, so that it is finished
+			// rather than abandoned when the group rebalances
+			start := time.Now()
+			err := h.handler(h.ctx, message)
+			duration.Observe(time.Since(start).Seconds())
+
+			if err != nil && h.ctx.Err() != nil {
+				// the run is stopping, so the message is left to be consumed again
+				return nil
+			}
+			if err != nil {
+				failed.Inc()
+				h.fail(errors.Wrapf(err, "failed to handle message from topic '%s' partition %d offset %d",
+					message.Topic, message.Partition, message.Offset))
+				return nil
+			}
+
+			session.MarkMessage(message, "")
+			consumed.Inc()
+			lag.Set(float64(claim.HighWaterMarkOffset() - message.Offset - 1))
+
+		case <-session.Context().Done():
+			return nil
+		}
+	}
+}
+
+// fail records the first error returned by the handler and stops the run
+func (h *groupHandler) fail(err error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.err == nil {
+		h.err = err
+		h.cancel()
+	}
+}
+
+func (h *groupHandler) failure() error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	return h.err
+}
@@ -0,0 +1,137 @@
+package kafka_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	sut "github.com/syncromatics/go-kit/v2/kafka"
+)
+
+func produce(t *testing.T, topic string, values ...string) {
+	producer, err := sut.NewSyncProducer(brokers, &sut.ProducerSettings{
+		Registerer: prometheus.NewRegistry(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer producer.Close()
+
+	for _, value := range values {
+		err = producer.Produce(context.Background(), &sarama.ProducerMessage{
+			Topic: topic,
+			Value: sarama.StringEncoder(value),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func Test_ConsumerGroup_Run(t *testing.T) {
+	// Arrange
+	createTopic(t, "consumer-group", 1)
+	produce(t, "consumer-group", "one", "two", "three")
+
+	registry := prometheus.NewRegistry()
+	group := sut.NewConsumerGroup(brokers, "consumer-group-run", []string{"consumer-group"}, &sut.ConsumerGroupSettings{
+		FromOldest: true,
+		Registerer: registry,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	received := make(chan string, 3)
+	done := make(chan error)
+
+	// Act
+	go func() {
+		done <- group.Run(ctx, func(ctx context.Context, message *sarama.ConsumerMessage) error {
+			received <- string(message.Value)
+			return nil
+		})
+	}()
+
+	var values []string
+	timeout := time.After(30 * time.Second)
+	for len(values) < 3 {
+		select {
+		case value := <-received:
+			values = append(values, value)
+		case <-timeout:
+			t.Fatal("timed out waiting for messages")
+		}
+	}
+
+	cancel()
+	err := <-done
+
+	// Assert
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"one", "two", "three"}, values)
+	assert.Equal(t, float64(3), sumCounter(t, registry, "kafka_messages_consumed_total"))
+	assert.Equal(t, float64(1), sumCounter(t, registry, "kafka_consumer_rebalances_total"))
+}
+
+func Test_ConsumerGroup_Run_ResumesFromCommittedOffset(t *testing.T) {
+	// Arrange
+	createTopic(t, "consumer-group-resume", 1)
+	produce(t, "consumer-group-resume", "one", "two")
+
+	group := sut.NewConsumerGroup(brokers, "consumer-group-resume", []string{"consumer-group-resume"}, &sut.ConsumerGroupSettings{
+		FromOldest: true,
+		Registerer: prometheus.NewRegistry(),
+	})
+
+	first, cancelFirst := context.WithCancel(context.Background())
+	err := group.Run(first, func(ctx context.Context, message *sarama.ConsumerMessage) error {
+		if message.Offset == 1 {
+			cancelFirst()
+		}
+		return nil
+	})
+	assert.Nil(t, err)
+
+	produce(t, "consumer-group-resume", "three")
+
+	second, cancelSecond := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancelSecond()
+
+	// Act
+	var values []string
+	err = group.Run(second, func(ctx context.Context, message *sarama.ConsumerMessage) error {
+		values = append(values, string(message.Value))
+		cancelSecond()
+		return nil
+	})
+
+	// Assert
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"three"}, values)
+}
+
+func Test_ConsumerGroup_Run_HandlerError(t *testing.T) {
+	// Arrange
+	createTopic(t, "consumer-group-error", 1)
+	produce(t, "consumer-group-error", "one")
+
+	group := sut.NewConsumerGroup(brokers, "consumer-group-error", []string{"consumer-group-error"}, &sut.ConsumerGroupSettings{
+		FromOldest: true,
+		Registerer: prometheus.NewRegistry(),
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// Act
+	err := group.Run(ctx, func(ctx context.Context, message *sarama.ConsumerMessage) error {
+		return errors.New("malformed position")
+	})
+
+	// Assert
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "malformed position")
+}
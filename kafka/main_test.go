@@ -0,0 +1,55 @@
+package kafka_test
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/pkg/errors"
+	sut "github.com/syncromatics/go-kit/v2/kafka"
+	"github.com/syncromatics/go-kit/v2/testing/docker"
+)
+
+var (
+	brokers      []string
+	registryHost string
+)
+
+func TestMain(m *testing.M) {
+	setup, err := docker.SetupKafka("kafka")
+	if err != nil {
+		panic(err)
+	}
+
+	brokers = []string{setup.ExternalBroker}
+	registryHost = setup.ProtoRegistry
+
+	result := m.Run()
+
+	docker.TeardownKafka("kafka")
+
+	os.Exit(result)
+}
+
+func createTopic(t *testing.T, topic string, partitions int32) {
+	config := sarama.NewConfig()
+	config.Version = sut.DefaultVersion
+
+	admin, err := sarama.NewClusterAdmin(brokers, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+
+	err = admin.CreateTopic(topic, &sarama.TopicDetail{
+		NumPartitions:     partitions,
+		ReplicationFactor: 1,
+	}, false)
+	if err != nil {
+		t.Fatal(errors.Wrap(err, "failed to create topic"))
+	}
+
+	// give the brokers time to elect leaders for the new partitions
+	time.Sleep(time.Second)
+}
@@ -0,0 +1,105 @@
+package kafka
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	sharedmetrics "github.com/syncromatics/go-kit/v2/internal/metrics"
+)
+
+// metrics are the collectors registered with a single prometheus.Registerer. They are shared by every producer and
+// consumer group using that registerer, and unregistered once the last of them is closed.
+type metrics struct {
+	registration *sharedmetrics.Registration
+
+	messagesProduced *prometheus.CounterVec
+	produceErrors    *prometheus.CounterVec
+	produceDuration  *prometheus.HistogramVec
+
+	messagesConsumed *prometheus.CounterVec
+	handlerErrors    *prometheus.CounterVec
+	handlerDuration  *prometheus.HistogramVec
+	consumerLag      *prometheus.GaugeVec
+	consumerErrors   *prometheus.CounterVec
+	rebalances       *prometheus.CounterVec
+	claims           *prometheus.GaugeVec
+}
+
+// registrations shares the metrics between every client using the same registerer
+var registrations = sharedmetrics.NewRegistrations()
+
+// acquireMetrics returns the metrics registered with the given registerer, registering them if this is the first use.
+// The default registerer is used when nil.
+func acquireMetrics(registerer prometheus.Registerer) *metrics {
+	return registrations.Acquire(registerer, func(registration *sharedmetrics.Registration) interface{} {
+		return newMetrics(registration)
+	}).(*metrics)
+}
+
+// release unregisters the metrics once nothing is using them any longer
+func (m *metrics) release() {
+	registrations.Release(m.registration)
+}
+
+func newMetrics(registration *sharedmetrics.Registration) *metrics {
+	m := &metrics{
+		registration: registration,
+	}
+
+	topicLabels := []string{"kafka_topic"}
+	groupLabels := []string{"kafka_group"}
+	groupTopicLabels := []string{"kafka_group", "kafka_topic"}
+	partitionLabels := []string{"kafka_group", "kafka_topic", "kafka_partition"}
+
+	m.messagesProduced = m.registration.Register(prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kafka_messages_produced_total",
+		Help: "The total number of messages acknowledged by the brokers after being produced to the topic",
+	}, topicLabels)).(*prometheus.CounterVec)
+
+	m.produceErrors = m.registration.Register(prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kafka_produce_errors_total",
+		Help: "The total number of messages that failed to be produced to the topic",
+	}, topicLabels)).(*prometheus.CounterVec)
+
+	m.produceDuration = m.registration.Register(prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "kafka_produce_duration_seconds",
+		Help:    "How long the synchronous producer waited for the brokers to acknowledge a message",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+	}, topicLabels)).(*prometheus.HistogramVec)
+
+	m.messagesConsumed = m.registration.Register(prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kafka_messages_consumed_total",
+		Help: "The total number of messages from the topic handled successfully by the consumer group",
+	}, groupTopicLabels)).(*prometheus.CounterVec)
+
+	m.handlerErrors = m.registration.Register(prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kafka_handler_errors_total",
+		Help: "The total number of messages from the topic that the consumer group's handler failed to handle",
+	}, groupTopicLabels)).(*prometheus.CounterVec)
+
+	m.handlerDuration = m.registration.Register(prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "kafka_handler_duration_seconds",
+		Help:    "How long the consumer group's handler took to handle a message from the topic",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+	}, groupTopicLabels)).(*prometheus.HistogramVec)
+
+	m.consumerLag = m.registration.Register(prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "kafka_consumer_lag",
+		Help: "The number of messages in the partition that the consumer group has not yet handled",
+	}, partitionLabels)).(*prometheus.GaugeVec)
+
+	m.consumerErrors = m.registration.Register(prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kafka_consumer_errors_total",
+		Help: "The total number of errors reported by the consumer group",
+	}, groupLabels)).(*prometheus.CounterVec)
+
+	m.rebalances = m.registration.Register(prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kafka_consumer_rebalances_total",
+		Help: "The total number of times partitions were assigned to this member of the consumer group",
+	}, groupLabels)).(*prometheus.CounterVec)
+
+	m.claims = m.registration.Register(prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "kafka_consumer_claimed_partitions",
+		Help: "The number of partitions currently claimed by this member of the consumer group",
+	}, groupLabels)).(*prometheus.GaugeVec)
+
+	return m
+}
@@ -0,0 +1,106 @@
+package kafka
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ProducerSettings are the settings for a SyncProducer or an AsyncProducer
+type ProducerSettings struct {
+	// Version is the version of the Kafka protocol to use. Defaults to DefaultVersion.
+	Version sarama.KafkaVersion
+	// ClientID identifies the producer to the brokers
+	ClientID string
+	// Compression is the codec used to compress batches of messages. Defaults to no compression.
+	Compression sarama.CompressionCodec
+	// Registerer is where the producer's metrics are registered. Defaults to prometheus.DefaultRegisterer.
+	Registerer prometheus.Registerer
+}
+
+func (s *ProducerSettings) config() *sarama.Config {
+	config := newConfig(s.Version, s.ClientID)
+
+	// every in-sync replica acknowledges a message before it is reported as produced
+	config.Producer.RequiredAcks = sarama.WaitForAll
+	config.Producer.Compression = s.Compression
+	config.Producer.Return.Successes = true
+	config.Producer.Return.Errors = true
+
+	return config
+}
+
+// SyncProducer produces messages to Kafka, waiting for the brokers to acknowledge each one
+type SyncProducer struct {
+	producer       sarama.SyncProducer
+	metrics        *metrics
+	releaseMetrics sync.Once
+}
+
+// NewSyncProducer creates a SyncProducer connected to the given brokers
+func NewSyncProducer(brokers []string, settings *ProducerSettings) (*SyncProducer, error) {
+	producer, err := sarama.NewSyncProducer(brokers, settings.config())
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create producer")
+	}
+
+	return &SyncProducer{
+		producer: producer,
+		metrics:  acquireMetrics(settings.Registerer),
+	}, nil
+}
+
+// Produce sends the message and waits for the brokers to acknowledge it. Once it returns without error, the message's
+// Partition and Offset are set.
+//
+// If the context ends first, Produce returns the context's error without waiting any longer. The message may still be
+// produced, so it must not be reused.
+func (p *SyncProducer) Produce(ctx context.Context, message *sarama.ProducerMessage) error {
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		result <- p.send(message)
+	}()
+
+	select {
+	case err = <-result:
+		return err
+	case <-ctx.Done():
+		return errors.Wrapf(ctx.Err(), "timed out producing message to topic '%s'", message.Topic)
+	}
+}
+
+func (p *SyncProducer) send(message *sarama.ProducerMessage) error {
+	start := time.Now()
+	_, _, err := p.producer.SendMessage(message)
+	p.metrics.produceDuration.WithLabelValues(message.Topic).Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		p.metrics.produceErrors.WithLabelValues(message.Topic).Inc()
+		return errors.Wrapf(err, "failed to produce message to topic '%s'", message.Topic)
+	}
+
+	p.metrics.messagesProduced.WithLabelValues(message.Topic).Inc()
+
+	return nil
+}
+
+// Close closes the connections to the brokers
+func (p *SyncProducer) Close() error {
+	defer p.releaseMetrics.Do(p.metrics.release)
+
+	err := p.producer.Close()
+	if err != nil {
+		return errors.Wrap(err, "failed to close producer")
+	}
+
+	return nil
+}
@@ -0,0 +1,129 @@
+package kafka_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	sut "github.com/syncromatics/go-kit/v2/kafka"
+)
+
+func Test_SyncProducer_Produce(t *testing.T) {
+	// Arrange
+	createTopic(t, "sync-producer", 1)
+
+	producer, err := sut.NewSyncProducer(brokers, &sut.ProducerSettings{
+		Registerer: prometheus.NewRegistry(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer producer.Close()
+
+	message := &sarama.ProducerMessage{
+		Topic: "sync-producer",
+		Key:   sarama.StringEncoder("vehicle-1"),
+		Value: sarama.ByteEncoder("position"),
+	}
+
+	// Act
+	err = producer.Produce(context.Background(), message)
+
+	// Assert
+	assert.Nil(t, err)
+	assert.Equal(t, int32(0), message.Partition)
+	assert.Equal(t, int64(0), message.Offset)
+}
+
+func Test_SyncProducer_Produce_CancelledContext(t *testing.T) {
+	// Arrange
+	producer, err := sut.NewSyncProducer(brokers, &sut.ProducerSettings{
+		Registerer: prometheus.NewRegistry(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer producer.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// Act
+	err = producer.Produce(ctx, &sarama.ProducerMessage{
+		Topic: "sync-producer",
+		Value: sarama.ByteEncoder("position"),
+	})
+
+	// Assert
+	assert.Equal(t, context.Canceled, err)
+}
+
+func Test_AsyncProducer_Run(t *testing.T) {
+	// Arrange
+	createTopic(t, "async-producer", 1)
+
+	registry := prometheus.NewRegistry()
+	producer, err := sut.NewAsyncProducer(brokers, &sut.ProducerSettings{
+		Registerer: registry,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- producer.Run(ctx)
+	}()
+
+	// Act
+	for i := 0; i < 10; i++ {
+		err = producer.Produce(context.Background(), &sarama.ProducerMessage{
+			Topic: "async-producer",
+			Value: sarama.ByteEncoder("position"),
+		})
+		assert.Nil(t, err)
+	}
+
+	var produced float64
+	deadline := time.Now().Add(10 * time.Second)
+	for produced < 10 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+		produced = sumCounter(t, registry, "kafka_messages_produced_total")
+	}
+
+	cancel()
+	runErr := <-done
+
+	// Assert
+	assert.Nil(t, runErr)
+	assert.Equal(t, float64(10), produced)
+
+	err = producer.Produce(context.Background(), &sarama.ProducerMessage{
+		Topic: "async-producer",
+		Value: sarama.ByteEncoder("position"),
+	})
+	assert.Equal(t, sut.ErrClosed, err)
+}
+
+// sumCounter sums every series of the named counter
+func sumCounter(t *testing.T, registry *prometheus.Registry, name string) float64 {
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	total := 0.0
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.Metric {
+			total += metric.GetCounter().GetValue()
+		}
+	}
+	return total
+}
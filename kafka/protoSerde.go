@@ -0,0 +1,265 @@
+package kafka
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"sync"
+
+	parser "github.com/emicklei/proto"
+	"github.com/golang/protobuf/descriptor"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	registry "github.com/syncromatics/proto-schema-registry/pkg/proto/schema/registry/v1"
+	"github.com/syncromatics/proto-schema-registry/pkg/protobuf"
+)
+
+// schemaIDHeaderSize is the length of the header prefixed to serialized payloads: a zero magic byte followed by the
+// big-endian schema ID
+const schemaIDHeaderSize = 5
+
+// ProtoSerde serializes protobuf messages for Kafka topics, registering their schemas with a proto schema registry
+// and prefixing each payload with the ID of its schema. Schema IDs and schemas are cached, so the registry is only
+// called the first time a message type is produced to a topic or a schema ID is consumed.
+type ProtoSerde struct {
+	client registry.RegistryAPIClient
+
+	mutex      sync.RWMutex
+	ids        map[subject]uint32
+	schemas    map[uint32][]byte
+	compatible map[readerSchema]error
+}
+
+// readerSchema is a message type that payloads with a schema ID are deserialized into
+type readerSchema struct {
+	id          uint32
+	messageName string
+}
+
+// subject is a message type produced to a topic, which the registry assigns a schema ID
+type subject struct {
+	topic       string
+	messageName string
+}
+
+// NewProtoSerde creates a ProtoSerde that registers and looks up schemas with the given registry client
+func NewProtoSerde(client registry.RegistryAPIClient) *ProtoSerde {
+	return &ProtoSerde{
+		client:     client,
+		ids:        map[subject]uint32{},
+		schemas:    map[uint32][]byte{},
+		compatible: map[readerSchema]error{},
+	}
+}
+
+// Serialize marshals the generated protobuf message, prefixed with the ID of its schema in the registry. The schema is
+// registered for the topic the first time the message type is serialized for it, and is rejected by the registry if
+// it is not compatible with the schema already registered for the topic.
+func (s *ProtoSerde) Serialize(ctx context.Context, topic string, message descriptor.Message) ([]byte, error) {
+	id, err := s.schemaID(ctx, topic, message)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := proto.Marshal(message)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal message")
+	}
+
+	payload := make([]byte, schemaIDHeaderSize, schemaIDHeaderSize+len(body))
+	binary.BigEndian.PutUint32(payload[1:], id)
+
+	return append(payload, body...), nil
+}
+
+// Deserialize unmarshals a payload created by Serialize into the generated protobuf message, after checking that the
+// message can read its schema: every field that the schema and the message have in common must have the same type. It
+// returns the schema ID.
+func (s *ProtoSerde) Deserialize(ctx context.Context, payload []byte, message descriptor.Message) (uint32, error) {
+	if len(payload) < schemaIDHeaderSize || payload[0] != 0 {
+		return 0, errors.New("payload is not prefixed with a schema id")
+	}
+
+	id := binary.BigEndian.Uint32(payload[1:schemaIDHeaderSize])
+
+	err := s.checkCompatible(ctx, id, message)
+	if err != nil {
+		return 0, err
+	}
+
+	err = proto.Unmarshal(payload[schemaIDHeaderSize:], message)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to unmarshal message with schema id %d", id)
+	}
+
+	return id, nil
+}
+
+// Schema returns the registered schema with the given ID
+func (s *ProtoSerde) Schema(ctx context.Context, id uint32) ([]byte, error) {
+	s.mutex.RLock()
+	schema, ok := s.schemas[id]
+	s.mutex.RUnlock()
+
+	if ok {
+		return schema, nil
+	}
+
+	response, err := s.client.GetSchema(ctx, &registry.GetSchemaRequest{Id: id})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get schema %d from the registry", id)
+	}
+	if !response.Exists {
+		return nil, errors.Errorf("schema %d does not exist in the registry", id)
+	}
+
+	s.mutex.Lock()
+	s.schemas[id] = response.Schema
+	s.mutex.Unlock()
+
+	return response.Schema, nil
+}
+
+func (s *ProtoSerde) schemaID(ctx context.Context, topic string, message descriptor.Message) (uint32, error) {
+	key := subject{
+		topic:       topic,
+		messageName: proto.MessageName(message),
+	}
+
+	s.mutex.RLock()
+	id, ok := s.ids[key]
+	s.mutex.RUnlock()
+
+	if ok {
+		return id, nil
+	}
+
+	schema, err := protobuf.ExtractSchema(message)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to extract schema of '%s'", key.messageName)
+	}
+
+	response, err := s.client.RegisterSchema(ctx, &registry.RegisterSchemaRequest{
+		Topic:  topic,
+		Schema: []byte(schema),
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to register schema of '%s' for topic '%s'", key.messageName, topic)
+	}
+
+	if rejected := response.GetResponseError(); rejected != nil {
+		return 0, errors.Errorf("registry rejected schema of '%s' for topic '%s': %s",
+			key.messageName, topic, strings.Join(rejected.Errors, ", "))
+	}
+
+	id = response.GetResponseSuccess().GetId()
+
+	s.mutex.Lock()
+	s.ids[key] = id
+	s.schemas[id] = []byte(schema)
+	s.mutex.Unlock()
+
+	return id, nil
+}
+
+// checkCompatible checks that the message can read payloads written with the schema, caching the result
+func (s *ProtoSerde) checkCompatible(ctx context.Context, id uint32, message descriptor.Message) error {
+	key := readerSchema{
+		id:          id,
+		messageName: proto.MessageName(message),
+	}
+
+	s.mutex.RLock()
+	err, ok := s.compatible[key]
+	s.mutex.RUnlock()
+
+	if ok {
+		return err
+	}
+
+	writer, err := s.Schema(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	reader, err := protobuf.ExtractSchema(message)
+	if err != nil {
+		return errors.Wrapf(err, "failed to extract schema of '%s'", key.messageName)
+	}
+
+	err = compareSchemas(writer, []byte(reader))
+	if err != nil {
+		err = errors.Wrapf(err, "'%s' cannot read messages with schema %d", key.messageName, id)
+	}
+
+	s.mutex.Lock()
+	s.compatible[key] = err
+	s.mutex.Unlock()
+
+	return err
+}
+
+// compareSchemas checks that the fields that two flattened schemas have in common have the same types. The schemas
+// name the root message "record" and every other message after its full name, so messages are matched by name.
+func compareSchemas(writer []byte, reader []byte) error {
+	writerFields, err := fieldTypes(writer)
+	if err != nil {
+		return err
+	}
+
+	readerFields, err := fieldTypes(reader)
+	if err != nil {
+		return err
+	}
+
+	var mismatches []string
+	for messageName, fields := range writerFields {
+		for number, writerType := range fields {
+			readerType, ok := readerFields[messageName][number]
+			if ok && readerType != writerType {
+				mismatches = append(mismatches, fmt.Sprintf("field %d of '%s' is '%s' but was written as '%s'",
+					number, messageName, readerType, writerType))
+			}
+		}
+	}
+
+	if len(mismatches) > 0 {
+		return errors.New(strings.Join(mismatches, ", "))
+	}
+
+	return nil
+}
+
+// fieldTypes maps each message in a flattened schema to the types of its fields by field number
+func fieldTypes(schema []byte) (map[string]map[int]string, error) {
+	definition, err := parser.NewParser(bytes.NewReader(schema)).Parse()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse schema")
+	}
+
+	messages := map[string]map[int]string{}
+	parser.Walk(definition, parser.WithMessage(func(message *parser.Message) {
+		fields := map[int]string{}
+		for _, element := range message.Elements {
+			switch field := element.(type) {
+			case *parser.NormalField:
+				if field.Repeated {
+					fields[field.Sequence] = "repeated " + field.Type
+				} else {
+					fields[field.Sequence] = field.Type
+				}
+			case *parser.Oneof:
+				for _, choice := range field.Elements {
+					if choice, ok := choice.(*parser.OneOfField); ok {
+						fields[choice.Sequence] = choice.Type
+					}
+				}
+			}
+		}
+		messages[message.Name] = fields
+	}))
+
+	return messages, nil
+}
@@ -0,0 +1,174 @@
+package kafka_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/stretchr/testify/assert"
+	sut "github.com/syncromatics/go-kit/v2/kafka"
+	registry "github.com/syncromatics/proto-schema-registry/pkg/proto/schema/registry/v1"
+	"google.golang.org/grpc"
+)
+
+type fakeRegistry struct {
+	registered map[string]uint32
+	schemas    map[uint32][]byte
+	rejections []string
+
+	registerCalls int
+	getCalls      int
+}
+
+func newFakeRegistry() *fakeRegistry {
+	return &fakeRegistry{
+		registered: map[string]uint32{},
+		schemas:    map[uint32][]byte{},
+	}
+}
+
+func (r *fakeRegistry) GetSchema(ctx context.Context, in *registry.GetSchemaRequest, opts ...grpc.CallOption) (*registry.GetSchemaResponse, error) {
+	r.getCalls++
+
+	schema, ok := r.schemas[in.Id]
+	return &registry.GetSchemaResponse{
+		Exists: ok,
+		Schema: schema,
+	}, nil
+}
+
+func (r *fakeRegistry) RegisterSchema(ctx context.Context, in *registry.RegisterSchemaRequest, opts ...grpc.CallOption) (*registry.RegisterSchemaResponse, error) {
+	r.registerCalls++
+
+	if len(r.rejections) > 0 {
+		return &registry.RegisterSchemaResponse{
+			Response: &registry.RegisterSchemaResponse_ResponseError{
+				ResponseError: &registry.RegisterSchemaError{Errors: r.rejections},
+			},
+		}, nil
+	}
+
+	id, ok := r.registered[in.Topic]
+	if !ok {
+		id = uint32(len(r.schemas) + 1)
+		r.registered[in.Topic] = id
+		r.schemas[id] = in.Schema
+	}
+
+	return &registry.RegisterSchemaResponse{
+		Response: &registry.RegisterSchemaResponse_ResponseSuccess{
+			ResponseSuccess: &registry.RegisterSchemaSuccess{Id: id},
+		},
+	}, nil
+}
+
+func (r *fakeRegistry) Ping(ctx context.Context, in *registry.PingRequest, opts ...grpc.CallOption) (*registry.PingResponse, error) {
+	return &registry.PingResponse{}, nil
+}
+
+func Test_ProtoSerde_RoundTrip(t *testing.T) {
+	// Arrange
+	conn, err := grpc.Dial(registryHost, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	client := registry.NewRegistryAPIClient(conn)
+	producerSerde := sut.NewProtoSerde(client)
+	consumerSerde := sut.NewProtoSerde(client)
+
+	message := &timestamp.Timestamp{Seconds: 1571234567, Nanos: 89}
+
+	// Act
+	payload, err := producerSerde.Serialize(context.Background(), "proto-serde", message)
+	assert.Nil(t, err)
+
+	actual := &timestamp.Timestamp{}
+	id, err := consumerSerde.Deserialize(context.Background(), payload, actual)
+
+	// Assert
+	assert.Nil(t, err)
+	assert.NotZero(t, id)
+	assert.Equal(t, message.Seconds, actual.Seconds)
+	assert.Equal(t, message.Nanos, actual.Nanos)
+
+	schema, err := consumerSerde.Schema(context.Background(), id)
+	assert.Nil(t, err)
+	assert.Contains(t, string(schema), "int64 seconds = 1;")
+}
+
+func Test_ProtoSerde_CachesSchemas(t *testing.T) {
+	// Arrange
+	fake := newFakeRegistry()
+	producerSerde := sut.NewProtoSerde(fake)
+	consumerSerde := sut.NewProtoSerde(fake)
+
+	// Act
+	for i := 0; i < 3; i++ {
+		payload, err := producerSerde.Serialize(context.Background(), "positions", &timestamp.Timestamp{Seconds: int64(i)})
+		assert.Nil(t, err)
+
+		_, err = consumerSerde.Deserialize(context.Background(), payload, &timestamp.Timestamp{})
+		assert.Nil(t, err)
+	}
+
+	// Assert
+	assert.Equal(t, 1, fake.registerCalls)
+	assert.Equal(t, 1, fake.getCalls)
+}
+
+func Test_ProtoSerde_Serialize_Rejected(t *testing.T) {
+	// Arrange
+	fake := newFakeRegistry()
+	fake.rejections = []string{"field 'seconds' changed type"}
+	serde := sut.NewProtoSerde(fake)
+
+	// Act
+	_, err := serde.Serialize(context.Background(), "positions", &timestamp.Timestamp{})
+
+	// Assert
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "field 'seconds' changed type")
+}
+
+func Test_ProtoSerde_Deserialize_UnknownSchema(t *testing.T) {
+	// Arrange
+	serde := sut.NewProtoSerde(newFakeRegistry())
+
+	// Act
+	_, err := serde.Deserialize(context.Background(), []byte{0, 0, 0, 0, 42, 8, 1}, &timestamp.Timestamp{})
+
+	// Assert
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "schema 42 does not exist")
+}
+
+func Test_ProtoSerde_Deserialize_IncompatibleMessage(t *testing.T) {
+	// Arrange
+	fake := newFakeRegistry()
+	producerSerde := sut.NewProtoSerde(fake)
+	consumerSerde := sut.NewProtoSerde(fake)
+
+	payload, err := producerSerde.Serialize(context.Background(), "positions", &timestamp.Timestamp{Seconds: 1})
+	assert.Nil(t, err)
+
+	// Act
+	_, err = consumerSerde.Deserialize(context.Background(), payload, &wrappers.StringValue{})
+
+	// Assert
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "field 1 of 'record' is 'string' but was written as 'int64'")
+}
+
+func Test_ProtoSerde_Deserialize_MissingSchemaID(t *testing.T) {
+	// Arrange
+	serde := sut.NewProtoSerde(newFakeRegistry())
+
+	// Act
+	_, err := serde.Deserialize(context.Background(), []byte{8, 1}, &timestamp.Timestamp{})
+
+	// Assert
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,95 @@
+package outbox
+
+import (
+	"encoding/json"
+	"reflect"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// headerTypes are the types of header values that can be stored, by the name that they are stored with
+var headerTypes = map[string]reflect.Type{
+	"string":    reflect.TypeOf(""),
+	"bool":      reflect.TypeOf(false),
+	"byte":      reflect.TypeOf(byte(0)),
+	"int":       reflect.TypeOf(int(0)),
+	"int16":     reflect.TypeOf(int16(0)),
+	"int32":     reflect.TypeOf(int32(0)),
+	"int64":     reflect.TypeOf(int64(0)),
+	"float32":   reflect.TypeOf(float32(0)),
+	"float64":   reflect.TypeOf(float64(0)),
+	"bytes":     reflect.TypeOf([]byte{}),
+	"timestamp": reflect.TypeOf(time.Time{}),
+}
+
+// header is a header value tagged with its type, so that it is published with the same type that it was stored with
+type header struct {
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value"`
+}
+
+// encodeHeaders encodes the headers as JSON that keeps the type of each value. Only the scalar types in headerTypes
+// are supported.
+func encodeHeaders(headers map[string]interface{}) (string, error) {
+	tagged := map[string]header{}
+	for key, value := range headers {
+		typeName, ok := headerTypeName(reflect.TypeOf(value))
+		if !ok {
+			return "", errors.Errorf("header '%s' has unsupported type %T", key, value)
+		}
+
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to encode header '%s'", key)
+		}
+
+		tagged[key] = header{
+			Type:  typeName,
+			Value: encoded,
+		}
+	}
+
+	encoded, err := json.Marshal(tagged)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to encode headers")
+	}
+
+	return string(encoded), nil
+}
+
+// decodeHeaders decodes headers encoded by encodeHeaders, restoring the type of each value
+func decodeHeaders(encoded string) (map[string]interface{}, error) {
+	tagged := map[string]header{}
+	err := json.Unmarshal([]byte(encoded), &tagged)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode headers")
+	}
+
+	headers := map[string]interface{}{}
+	for key, h := range tagged {
+		valueType, ok := headerTypes[h.Type]
+		if !ok {
+			return nil, errors.Errorf("header '%s' has unknown type '%s'", key, h.Type)
+		}
+
+		value := reflect.New(valueType)
+		err = json.Unmarshal(h.Value, value.Interface())
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to decode header '%s'", key)
+		}
+
+		headers[key] = value.Elem().Interface()
+	}
+
+	return headers, nil
+}
+
+func headerTypeName(valueType reflect.Type) (string, bool) {
+	for name, t := range headerTypes {
+		if t == valueType {
+			return name, true
+		}
+	}
+	return "", false
+}
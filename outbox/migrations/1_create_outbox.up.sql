@@ -0,0 +1,25 @@
+CREATE TABLE IF NOT EXISTS outbox (
+    id BIGSERIAL PRIMARY KEY,
+    exchange TEXT NOT NULL,
+    routing_key TEXT NOT NULL,
+    headers JSONB,
+    content_type TEXT NOT NULL,
+    content_encoding TEXT NOT NULL,
+    persistent BOOLEAN NOT NULL,
+    priority SMALLINT NOT NULL,
+    correlation_id TEXT NOT NULL,
+    reply_to TEXT NOT NULL,
+    message_id TEXT NOT NULL,
+    message_timestamp TIMESTAMPTZ,
+    expiration_ms BIGINT NOT NULL,
+    body BYTEA NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    sent_at TIMESTAMPTZ,
+    rejections INT NOT NULL DEFAULT 0,
+    last_error TEXT,
+    failed_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS outbox_pending_idx ON outbox (id) WHERE sent_at IS NULL AND failed_at IS NULL;
+
+CREATE INDEX IF NOT EXISTS outbox_sent_idx ON outbox (sent_at) WHERE sent_at IS NOT NULL;
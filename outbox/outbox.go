@@ -0,0 +1,77 @@
+// Package outbox publishes AMQP messages from a transactional outbox in Postgres
+//
+// Messages are stored in the outbox table in the same transaction as the changes that produce them, so that a message
+// is published if and only if its transaction commits. A Relay publishes the stored messages, marks them sent and
+// later purges them.
+//
+// Messages that the broker keeps rejecting are parked by setting their failed_at column, with the reason in
+// last_error, so that the messages behind them are not held up. Parked messages are neither published nor purged, and
+// can be retried once the cause has been fixed with:
+//
+//	UPDATE outbox SET failed_at = NULL, rejections = 0 WHERE failed_at IS NOT NULL;
+//
+// The outbox table is created by the migration in the migrations directory of this package, which should be copied
+// into the service's own migrations. Migrations are applied in the order of their version numbers, so rename the copy
+// from 1_create_outbox to the service's next unused version, such as 7_create_outbox.up.sql and
+// 7_create_outbox.down.sql when the latest migration is 6.
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/syncromatics/go-kit/v2/amqp"
+)
+
+const insertQuery = `INSERT INTO outbox (exchange, routing_key, headers, content_type, content_encoding, persistent, priority,
+	correlation_id, reply_to, message_id, message_timestamp, expiration_ms, body)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)`
+
+// Store stores the message in the outbox within the transaction, to be published to the exchange once the transaction
+// has committed
+//
+// Header values keep their types when they are published. Only strings, booleans, integers, floats, byte slices and
+// times are supported, and any other header value is rejected.
+func Store(ctx context.Context, tx *sql.Tx, exchangeName string, message *amqp.Publishing) error {
+	var headers sql.NullString
+	if len(message.Headers) > 0 {
+		encoded, err := encodeHeaders(message.Headers)
+		if err != nil {
+			return errors.Wrap(err, "failed to encode message headers")
+		}
+		headers = sql.NullString{String: encoded, Valid: true}
+	}
+
+	var timestamp *time.Time
+	if !message.Timestamp.IsZero() {
+		timestamp = &message.Timestamp
+	}
+
+	body := message.Body
+	if body == nil {
+		body = []byte{}
+	}
+
+	_, err := tx.ExecContext(ctx, insertQuery,
+		exchangeName,
+		message.RoutingKey,
+		headers,
+		message.ContentType,
+		message.ContentEncoding,
+		message.Persistent,
+		int(message.Priority),
+		message.CorrelationID,
+		message.ReplyTo,
+		message.MessageID,
+		timestamp,
+		int64(message.Expiration/time.Millisecond),
+		body,
+	)
+	if err != nil {
+		return errors.Wrap(err, "failed to store message in outbox")
+	}
+
+	return nil
+}
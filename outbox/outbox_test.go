@@ -0,0 +1,151 @@
+package outbox_test
+
+import (
+	"context"
+	"database/sql/driver"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/syncromatics/go-kit/v2/amqp"
+	"github.com/syncromatics/go-kit/v2/outbox"
+)
+
+func Test_Store_InsertsMessageInTransaction(t *testing.T) {
+	// Arrange
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+
+	timestamp := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO outbox").
+		WithArgs(
+			"vehicles",
+			"vehicles.position",
+			`{"messageType":{"type":"string","value":"Position"}}`,
+			"application/json",
+			"",
+			true,
+			5,
+			"correlation",
+			"replies",
+			"message",
+			timestamp,
+			int64(60000),
+			[]byte(`{"VehicleId":1}`),
+		).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	tx, err := db.Begin()
+	assert.Nil(t, err)
+
+	// Act
+	err = outbox.Store(context.Background(), tx, "vehicles", &amqp.Publishing{
+		RoutingKey:    "vehicles.position",
+		Headers:       map[string]interface{}{"messageType": "Position"},
+		ContentType:   "application/json",
+		Persistent:    true,
+		Priority:      5,
+		CorrelationID: "correlation",
+		ReplyTo:       "replies",
+		MessageID:     "message",
+		Timestamp:     timestamp,
+		Expiration:    time.Minute,
+		Body:          []byte(`{"VehicleId":1}`),
+	})
+
+	// Assert
+	assert.Nil(t, err)
+	assert.Nil(t, tx.Commit())
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+type capturedArgument struct {
+	value interface{}
+}
+
+func (a *capturedArgument) Match(value driver.Value) bool {
+	a.value = value
+	return true
+}
+
+func Test_Store_PreservesHeaderTypes(t *testing.T) {
+	// Arrange
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+
+	expected := map[string]interface{}{
+		"name":      "Position",
+		"retries":   int32(3),
+		"sequence":  int64(9007199254740993),
+		"speed":     12.5,
+		"urgent":    true,
+		"signature": []byte{0, 1, 2},
+		"sentAt":    time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+
+	headers := &capturedArgument{}
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO outbox").
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), headers, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(),
+			sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(),
+			sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	tx, err := db.Begin()
+	assert.Nil(t, err)
+
+	err = outbox.Store(context.Background(), tx, "vehicles", &amqp.Publishing{Headers: expected})
+	assert.Nil(t, err)
+	assert.Nil(t, tx.Commit())
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT pg_try_advisory_xact_lock").WillReturnRows(sqlmock.NewRows([]string{"locked"}).AddRow(true))
+	mock.ExpectQuery("SELECT (.+) FROM outbox").
+		WillReturnRows(sqlmock.NewRows(outboxColumns).
+			AddRow(1, "vehicles", "", headers.value, "", "", false, 0, "", "", "", nil, 0, []byte{}, 0))
+	mock.ExpectExec("UPDATE outbox SET sent_at").WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	publisher := &fakePublisher{}
+	relay := newRelay(t, db, publisher, &outbox.RelaySettings{})
+
+	// Act
+	_, err = relay.RelayPending(context.Background())
+
+	// Assert
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	if assert.Len(t, publisher.published, 1) {
+		assert.Equal(t, expected, publisher.published[0].message.Headers)
+	}
+}
+
+func Test_Store_RejectsUnsupportedHeaders(t *testing.T) {
+	// Arrange
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+
+	mock.ExpectBegin()
+
+	tx, err := db.Begin()
+	assert.Nil(t, err)
+	defer tx.Rollback()
+
+	// Act
+	err = outbox.Store(context.Background(), tx, "vehicles", &amqp.Publishing{
+		Headers: map[string]interface{}{"vehicles": []interface{}{"1", "2"}},
+	})
+
+	// Assert
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "header 'vehicles' has unsupported type")
+}
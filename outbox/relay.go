@@ -0,0 +1,324 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/syncromatics/go-kit/v2/amqp"
+	"github.com/syncromatics/go-kit/v2/log"
+)
+
+const (
+	// lockQuery takes a lock held until the end of the transaction, so that only one relay publishes at a time
+	lockQuery = `SELECT pg_try_advisory_xact_lock($1)`
+
+	selectPendingQuery = `SELECT id, exchange, routing_key, headers, content_type, content_encoding, persistent, priority,
+	correlation_id, reply_to, message_id, message_timestamp, expiration_ms, body, rejections
+FROM outbox
+WHERE sent_at IS NULL AND failed_at IS NULL
+ORDER BY id
+LIMIT $1`
+
+	markSentQuery = `UPDATE outbox SET sent_at = now() WHERE id = $1`
+
+	markRejectedQuery = `UPDATE outbox SET rejections = rejections + 1, last_error = $2 WHERE id = $1`
+
+	markFailedQuery = `UPDATE outbox SET rejections = rejections + 1, last_error = $2, failed_at = now() WHERE id = $1`
+
+	purgeQuery = `DELETE FROM outbox WHERE sent_at < now() - $1 * INTERVAL '1 millisecond'`
+
+	// relayLockKey identifies the advisory lock taken by relays, and is "outbox" in ASCII
+	relayLockKey = 0x6f7574626f78
+
+	defaultPollInterval  = time.Second
+	defaultBatchSize     = 100
+	defaultRetention     = 24 * time.Hour
+	defaultMaxRejections = 3
+	purgeInterval        = 10 * time.Minute
+)
+
+// ErrPublisherNotConfirming is returned when creating a relay with a publisher that does not wait for the broker to
+// acknowledge messages, since messages would be marked sent and purged without the broker having accepted them
+var ErrPublisherNotConfirming = errors.New("outbox relay requires a publisher in confirm mode")
+
+// Publisher publishes messages relayed from the outbox. It is satisfied by *amqp.ExchangePublisher created with
+// Confirm enabled, so that messages are only marked sent once the broker has accepted them.
+type Publisher interface {
+	PublishMessage(ctx context.Context, exchangeName string, message *amqp.Publishing) error
+	// Confirms reports whether publishing waits for the broker to acknowledge each message
+	Confirms() bool
+}
+
+// RelaySettings are the settings for a Relay
+type RelaySettings struct {
+	// PollInterval is how long to wait before looking for new messages once the outbox has been emptied.
+	// Defaults to 1 second.
+	PollInterval time.Duration
+	// BatchSize is the maximum number of messages published in each transaction. Defaults to 100.
+	BatchSize int
+	// Retention is how long sent messages are kept in the outbox before Run deletes them. Defaults to 24 hours. When
+	// negative, sent messages are never deleted.
+	Retention time.Duration
+	// MaxRejections is how many times the broker may reject a message, with an *amqp.NackError or an
+	// *amqp.UnroutableError, before the message is parked and the messages behind it are published. Defaults to 3.
+	MaxRejections int
+}
+
+// Relay publishes the messages stored in the outbox, in the order they were stored, and marks them sent
+//
+// Several relays can run against the same outbox, such as one in each replica of a service. They take turns through
+// a Postgres advisory lock, so that only one of them publishes at a time and the order of the messages is kept.
+// Messages are published at least once: if the relay stops after publishing a message but before marking it sent, the
+// message is published again. A message that the broker keeps rejecting is parked, after which it is skipped.
+type Relay struct {
+	db        *sql.DB
+	publisher Publisher
+	settings  RelaySettings
+}
+
+// NewRelay creates a new Relay, returning ErrPublisherNotConfirming if the publisher is not in confirm mode
+func NewRelay(db *sql.DB, publisher Publisher, settings *RelaySettings) (*Relay, error) {
+	if !publisher.Confirms() {
+		return nil, ErrPublisherNotConfirming
+	}
+
+	r := &Relay{
+		db:        db,
+		publisher: publisher,
+		settings:  *settings,
+	}
+
+	if r.settings.PollInterval == 0 {
+		r.settings.PollInterval = defaultPollInterval
+	}
+	if r.settings.BatchSize == 0 {
+		r.settings.BatchSize = defaultBatchSize
+	}
+	if r.settings.Retention == 0 {
+		r.settings.Retention = defaultRetention
+	}
+	if r.settings.MaxRejections == 0 {
+		r.settings.MaxRejections = defaultMaxRejections
+	}
+
+	return r, nil
+}
+
+// Run relays messages until the context is cancelled, and can be started with cmd.ProcessGroup.Start. Sent messages
+// older than the retention are purged every 10 minutes.
+//
+// Failures to read the outbox or to publish are logged, and the messages are retried after the poll interval.
+func (r *Relay) Run(ctx context.Context) error {
+	lastPurge := time.Now()
+	for {
+		if r.settings.Retention > 0 && time.Since(lastPurge) >= purgeInterval {
+			_, err := r.Purge(ctx)
+			if err != nil && ctx.Err() == nil {
+				log.Warn("failed to purge sent messages from outbox",
+					"err", err,
+				)
+			}
+			lastPurge = time.Now()
+		}
+
+		relayed, err := r.RelayPending(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Warn("failed to relay messages from outbox",
+				"err", err,
+			)
+		}
+
+		if err == nil && relayed == r.settings.BatchSize {
+			// there are probably more messages waiting
+			continue
+		}
+
+		select {
+		case <-time.After(r.settings.PollInterval):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// RelayPending publishes a batch of pending messages in a single transaction and returns how many were published.
+// Messages that were published before a failure are still marked sent. A message rejected by the broker has the
+// rejection recorded, and is parked once it has been rejected MaxRejections times. Nothing is published while another
+// relay is publishing.
+func (r *Relay) RelayPending(ctx context.Context) (int, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+
+	var locked bool
+	err = tx.QueryRowContext(ctx, lockQuery, relayLockKey).Scan(&locked)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to lock outbox")
+	}
+	if !locked {
+		return 0, nil
+	}
+
+	pending, err := r.selectPending(ctx, tx)
+	if err != nil {
+		return 0, err
+	}
+
+	relayed := 0
+	var publishErr error
+	for _, message := range pending {
+		publishErr = r.publisher.PublishMessage(ctx, message.exchangeName, message.publishing)
+		if publishErr != nil && isRejection(publishErr) {
+			var parked bool
+			parked, err = r.reject(ctx, tx, message, publishErr)
+			if err != nil {
+				return 0, err
+			}
+			if parked {
+				publishErr = nil
+				continue
+			}
+		}
+		if publishErr != nil {
+			publishErr = errors.Wrapf(publishErr, "failed to publish message %d", message.id)
+			break
+		}
+
+		_, err = tx.ExecContext(ctx, markSentQuery, message.id)
+		if err != nil {
+			return 0, errors.Wrapf(err, "failed to mark message %d sent", message.id)
+		}
+		relayed++
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to commit transaction")
+	}
+
+	return relayed, publishErr
+}
+
+// reject records that the broker rejected the message, parking it once it has been rejected too many times, and
+// returns whether it was parked
+func (r *Relay) reject(ctx context.Context, tx *sql.Tx, message *pendingMessage, rejection error) (bool, error) {
+	query := markRejectedQuery
+	parked := message.rejections+1 >= r.settings.MaxRejections
+	if parked {
+		query = markFailedQuery
+	}
+
+	_, err := tx.ExecContext(ctx, query, message.id, rejection.Error())
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to record rejection of message %d", message.id)
+	}
+
+	if parked {
+		log.Error("parked outbox message rejected by the broker",
+			"err", rejection,
+			"id", message.id,
+			"exchange", message.exchangeName,
+			"routingKey", message.publishing.RoutingKey,
+			"rejections", message.rejections+1,
+		)
+	}
+
+	return parked, nil
+}
+
+// isRejection reports whether the broker rejected the message, in which case publishing it again is likely to fail
+// the same way
+func isRejection(err error) bool {
+	switch errors.Cause(err).(type) {
+	case *amqp.NackError, *amqp.UnroutableError:
+		return true
+	}
+	return false
+}
+
+// Purge deletes the messages that were sent longer ago than the retention, and returns how many were deleted
+func (r *Relay) Purge(ctx context.Context) (int64, error) {
+	result, err := r.db.ExecContext(ctx, purgeQuery, int64(r.settings.Retention/time.Millisecond))
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to purge sent messages")
+	}
+
+	purged, err := result.RowsAffected()
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to count purged messages")
+	}
+
+	return purged, nil
+}
+
+type pendingMessage struct {
+	id           int64
+	exchangeName string
+	publishing   *amqp.Publishing
+	rejections   int
+}
+
+func (r *Relay) selectPending(ctx context.Context, tx *sql.Tx) ([]*pendingMessage, error) {
+	rows, err := tx.QueryContext(ctx, selectPendingQuery, r.settings.BatchSize)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to select pending messages")
+	}
+	defer rows.Close()
+
+	var pending []*pendingMessage
+	for rows.Next() {
+		var (
+			message      = &pendingMessage{publishing: &amqp.Publishing{}}
+			headers      sql.NullString
+			priority     int
+			timestamp    *time.Time
+			expirationMS int64
+		)
+
+		err = rows.Scan(
+			&message.id,
+			&message.exchangeName,
+			&message.publishing.RoutingKey,
+			&headers,
+			&message.publishing.ContentType,
+			&message.publishing.ContentEncoding,
+			&message.publishing.Persistent,
+			&priority,
+			&message.publishing.CorrelationID,
+			&message.publishing.ReplyTo,
+			&message.publishing.MessageID,
+			&timestamp,
+			&expirationMS,
+			&message.publishing.Body,
+			&message.rejections,
+		)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read pending message")
+		}
+
+		if headers.Valid {
+			message.publishing.Headers, err = decodeHeaders(headers.String)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to decode headers of message %d", message.id)
+			}
+		}
+		if timestamp != nil {
+			message.publishing.Timestamp = *timestamp
+		}
+		message.publishing.Priority = uint8(priority)
+		message.publishing.Expiration = time.Duration(expirationMS) * time.Millisecond
+
+		pending = append(pending, message)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read pending messages")
+	}
+
+	return pending, nil
+}
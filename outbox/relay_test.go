@@ -0,0 +1,284 @@
+package outbox_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/syncromatics/go-kit/v2/amqp"
+	"github.com/syncromatics/go-kit/v2/outbox"
+)
+
+var outboxColumns = []string{"id", "exchange", "routing_key", "headers", "content_type", "content_encoding", "persistent",
+	"priority", "correlation_id", "reply_to", "message_id", "message_timestamp", "expiration_ms", "body", "rejections"}
+
+type published struct {
+	exchangeName string
+	message      *amqp.Publishing
+}
+
+type fakePublisher struct {
+	published   []published
+	failOn      int
+	rejectID    string
+	unconfirmed bool
+}
+
+func (p *fakePublisher) PublishMessage(ctx context.Context, exchangeName string, message *amqp.Publishing) error {
+	if p.failOn > 0 && len(p.published)+1 == p.failOn {
+		return errors.New("broker unavailable")
+	}
+	if p.rejectID != "" && message.MessageID == p.rejectID {
+		return &amqp.NackError{Exchange: exchangeName, RoutingKey: message.RoutingKey}
+	}
+	p.published = append(p.published, published{exchangeName, message})
+	return nil
+}
+
+func (p *fakePublisher) Confirms() bool {
+	return !p.unconfirmed
+}
+
+func newRelay(t *testing.T, db *sql.DB, publisher *fakePublisher, settings *outbox.RelaySettings) *outbox.Relay {
+	relay, err := outbox.NewRelay(db, publisher, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return relay
+}
+
+func Test_Relay_PublishesPendingMessagesAndMarksThemSent(t *testing.T) {
+	// Arrange
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT pg_try_advisory_xact_lock").WillReturnRows(sqlmock.NewRows([]string{"locked"}).AddRow(true))
+	mock.ExpectQuery("SELECT (.+) FROM outbox WHERE sent_at IS NULL AND failed_at IS NULL ORDER BY id LIMIT \\$1").
+		WithArgs(10).
+		WillReturnRows(sqlmock.NewRows(outboxColumns).
+			AddRow(1, "vehicles", "vehicles.position", `{"messageType":{"type":"string","value":"Position"}}`, "application/json", "", true, 5, "", "", "first", nil, 60000, []byte("1"), 0).
+			AddRow(2, "vehicles", "vehicles.emergency", nil, "", "", false, 0, "", "", "second", nil, 0, []byte("2"), 0))
+	mock.ExpectExec("UPDATE outbox SET sent_at").WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE outbox SET sent_at").WithArgs(2).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	publisher := &fakePublisher{}
+	relay := newRelay(t, db, publisher, &outbox.RelaySettings{BatchSize: 10})
+
+	// Act
+	relayed, err := relay.RelayPending(context.Background())
+
+	// Assert
+	assert.Nil(t, err)
+	assert.Equal(t, 2, relayed)
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	if assert.Len(t, publisher.published, 2) {
+		first := publisher.published[0]
+		assert.Equal(t, "vehicles", first.exchangeName)
+		assert.Equal(t, &amqp.Publishing{
+			RoutingKey:  "vehicles.position",
+			Headers:     map[string]interface{}{"messageType": "Position"},
+			ContentType: "application/json",
+			Persistent:  true,
+			Priority:    5,
+			MessageID:   "first",
+			Expiration:  time.Minute,
+			Body:        []byte("1"),
+		}, first.message)
+
+		second := publisher.published[1]
+		assert.Equal(t, "vehicles.emergency", second.message.RoutingKey)
+		assert.Nil(t, second.message.Headers)
+	}
+}
+
+func Test_Relay_MarksPublishedMessagesSentWhenPublishingFails(t *testing.T) {
+	// Arrange
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT pg_try_advisory_xact_lock").WillReturnRows(sqlmock.NewRows([]string{"locked"}).AddRow(true))
+	mock.ExpectQuery("SELECT (.+) FROM outbox").
+		WithArgs(100).
+		WillReturnRows(sqlmock.NewRows(outboxColumns).
+			AddRow(1, "vehicles", "", nil, "", "", false, 0, "", "", "", nil, 0, []byte("1"), 0).
+			AddRow(2, "vehicles", "", nil, "", "", false, 0, "", "", "", nil, 0, []byte("2"), 0))
+	mock.ExpectExec("UPDATE outbox SET sent_at").WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	publisher := &fakePublisher{failOn: 2}
+	relay := newRelay(t, db, publisher, &outbox.RelaySettings{})
+
+	// Act
+	relayed, err := relay.RelayPending(context.Background())
+
+	// Assert
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, relayed)
+	assert.Len(t, publisher.published, 1)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func Test_Relay_RunStopsWhenContextIsCancelled(t *testing.T) {
+	// Arrange
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT pg_try_advisory_xact_lock").WillReturnRows(sqlmock.NewRows([]string{"locked"}).AddRow(true))
+	mock.ExpectQuery("SELECT (.+) FROM outbox").WillReturnRows(sqlmock.NewRows(outboxColumns))
+	mock.ExpectCommit()
+
+	relay := newRelay(t, db, &fakePublisher{}, &outbox.RelaySettings{PollInterval: time.Minute})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+
+	// Act
+	go func() {
+		done <- relay.Run(ctx)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+
+	// Assert
+	select {
+	case err = <-done:
+		assert.Nil(t, err)
+	case <-time.After(3 * time.Second):
+		assert.Fail(t, "did not stop in a timely manner")
+	}
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func Test_Relay_WaitsWhileAnotherRelayIsPublishing(t *testing.T) {
+	// Arrange
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT pg_try_advisory_xact_lock").WillReturnRows(sqlmock.NewRows([]string{"locked"}).AddRow(false))
+	mock.ExpectRollback()
+
+	publisher := &fakePublisher{}
+	relay := newRelay(t, db, publisher, &outbox.RelaySettings{})
+
+	// Act
+	relayed, err := relay.RelayPending(context.Background())
+
+	// Assert
+	assert.Nil(t, err)
+	assert.Equal(t, 0, relayed)
+	assert.Empty(t, publisher.published)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func Test_Relay_PurgeDeletesMessagesSentBeforeRetention(t *testing.T) {
+	// Arrange
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+
+	mock.ExpectExec("DELETE FROM outbox WHERE sent_at < now\\(\\) - \\$1 \\* INTERVAL '1 millisecond'").
+		WithArgs(int64(3600000)).
+		WillReturnResult(sqlmock.NewResult(0, 7))
+
+	relay := newRelay(t, db, &fakePublisher{}, &outbox.RelaySettings{Retention: time.Hour})
+
+	// Act
+	purged, err := relay.Purge(context.Background())
+
+	// Assert
+	assert.Nil(t, err)
+	assert.Equal(t, int64(7), purged)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func Test_NewRelay_RequiresConfirmingPublisher(t *testing.T) {
+	// Arrange
+	db, _, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+
+	// Act
+	relay, err := outbox.NewRelay(db, &fakePublisher{unconfirmed: true}, &outbox.RelaySettings{})
+
+	// Assert
+	assert.Equal(t, outbox.ErrPublisherNotConfirming, err)
+	assert.Nil(t, relay)
+}
+
+func Test_Relay_RecordsRejectedMessagesAndStops(t *testing.T) {
+	// Arrange
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT pg_try_advisory_xact_lock").WillReturnRows(sqlmock.NewRows([]string{"locked"}).AddRow(true))
+	mock.ExpectQuery("SELECT (.+) FROM outbox").
+		WillReturnRows(sqlmock.NewRows(outboxColumns).
+			AddRow(1, "vehicles", "", nil, "", "", false, 0, "", "", "rejected", nil, 0, []byte("1"), 0).
+			AddRow(2, "vehicles", "", nil, "", "", false, 0, "", "", "accepted", nil, 0, []byte("2"), 0))
+	mock.ExpectExec("UPDATE outbox SET rejections = rejections \\+ 1, last_error = \\$2 WHERE id = \\$1").
+		WithArgs(1, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	publisher := &fakePublisher{rejectID: "rejected"}
+	relay := newRelay(t, db, publisher, &outbox.RelaySettings{})
+
+	// Act
+	relayed, err := relay.RelayPending(context.Background())
+
+	// Assert
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, relayed)
+	assert.Empty(t, publisher.published)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func Test_Relay_ParksMessagesRejectedTooManyTimes(t *testing.T) {
+	// Arrange
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT pg_try_advisory_xact_lock").WillReturnRows(sqlmock.NewRows([]string{"locked"}).AddRow(true))
+	mock.ExpectQuery("SELECT (.+) FROM outbox").
+		WillReturnRows(sqlmock.NewRows(outboxColumns).
+			AddRow(1, "vehicles", "", nil, "", "", false, 0, "", "", "rejected", nil, 0, []byte("1"), 2).
+			AddRow(2, "vehicles", "", nil, "", "", false, 0, "", "", "accepted", nil, 0, []byte("2"), 0))
+	mock.ExpectExec("UPDATE outbox SET rejections = rejections \\+ 1, last_error = \\$2, failed_at = now\\(\\) WHERE id = \\$1").
+		WithArgs(1, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE outbox SET sent_at").WithArgs(2).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	publisher := &fakePublisher{rejectID: "rejected"}
+	relay := newRelay(t, db, publisher, &outbox.RelaySettings{MaxRejections: 3})
+
+	// Act
+	relayed, err := relay.RelayPending(context.Background())
+
+	// Assert
+	assert.Nil(t, err)
+	assert.Equal(t, 1, relayed)
+	if assert.Len(t, publisher.published, 1) {
+		assert.Equal(t, "accepted", publisher.published[0].message.MessageID)
+	}
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
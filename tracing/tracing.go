@@ -0,0 +1,115 @@
+// Package tracing creates opentracing tracers that report spans to Jaeger, or that record them in memory for tests
+package tracing
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/pkg/errors"
+	jaegerClient "github.com/uber/jaeger-client-go"
+	"github.com/uber/jaeger-client-go/thrift-gen/sampling"
+	"github.com/uber/jaeger-client-go/transport"
+)
+
+// Backend is where a tracer reports its spans
+type Backend string
+
+const (
+	// JaegerUDP reports spans to a Jaeger agent over UDP
+	JaegerUDP Backend = "jaeger-udp"
+	// JaegerHTTP reports spans directly to a Jaeger collector over HTTP
+	JaegerHTTP Backend = "jaeger-http"
+	// Noop discards every span
+	Noop Backend = "noop"
+	// Memory records finished spans in memory. The tracer is a *mocktracer.MockTracer, whose FinishedSpans can be
+	// inspected by tests.
+	Memory Backend = "memory"
+)
+
+// Settings are the settings for a tracer
+type Settings struct {
+	// ServiceName is the name of the service reporting spans
+	ServiceName string
+	// Backend is where spans are reported. Defaults to JaegerUDP.
+	Backend Backend
+	// AgentHost is the host of the Jaeger agent for JaegerUDP. Defaults to localhost.
+	AgentHost string
+	// AgentPort is the UDP port of the Jaeger agent for JaegerUDP. Defaults to 6831.
+	AgentPort int
+	// CollectorEndpoint is the URL of the Jaeger collector for JaegerHTTP, such as
+	// "http://jaeger-collector:14268/api/traces"
+	CollectorEndpoint string
+	// Sampler decides which traces are reported to Jaeger. Defaults to sampling 10% of the traces of each operation,
+	// and at least one per second.
+	Sampler jaegerClient.Sampler
+}
+
+// NewTracer creates a tracer for the backend of the settings. The closer flushes any spans that have not been
+// reported yet, and should be closed when the process shuts down.
+func NewTracer(settings *Settings) (opentracing.Tracer, io.Closer, error) {
+	switch settings.Backend {
+	case JaegerUDP, "":
+		host := settings.AgentHost
+		if host == "" {
+			host = jaegerClient.DefaultUDPSpanServerHost
+		}
+
+		port := settings.AgentPort
+		if port == 0 {
+			port = jaegerClient.DefaultUDPSpanServerPort
+		}
+
+		udpTransport, err := jaegerClient.NewUDPTransport(fmt.Sprintf("%s:%d", host, port), 0)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "failed to create jaeger udp transport")
+		}
+
+		return newJaegerTracer(settings, udpTransport)
+
+	case JaegerHTTP:
+		if settings.CollectorEndpoint == "" {
+			return nil, nil, errors.New("a collector endpoint is required to report spans over http")
+		}
+
+		return newJaegerTracer(settings, transport.NewHTTPTransport(settings.CollectorEndpoint))
+
+	case Noop:
+		return opentracing.NoopTracer{}, nopCloser{}, nil
+
+	case Memory:
+		return mocktracer.New(), nopCloser{}, nil
+
+	default:
+		return nil, nil, errors.Errorf("unknown tracing backend '%s'", settings.Backend)
+	}
+}
+
+func newJaegerTracer(settings *Settings, sender jaegerClient.Transport) (opentracing.Tracer, io.Closer, error) {
+	if settings.ServiceName == "" {
+		return nil, nil, errors.New("a service name is required to report spans to jaeger")
+	}
+
+	sampler := settings.Sampler
+	if sampler == nil {
+		sampler = jaegerClient.NewPerOperationSampler(jaegerClient.PerOperationSamplerParams{
+			Strategies: &sampling.PerOperationSamplingStrategies{
+				DefaultSamplingProbability:       0.1,
+				DefaultLowerBoundTracesPerSecond: 1.0,
+			},
+		})
+	}
+
+	tracer, closer := jaegerClient.NewTracer(settings.ServiceName,
+		sampler,
+		jaegerClient.NewRemoteReporter(sender))
+
+	return tracer, closer, nil
+}
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,118 @@
+package tracing_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/stretchr/testify/assert"
+	sut "github.com/syncromatics/go-kit/v2/tracing"
+	jaegerClient "github.com/uber/jaeger-client-go"
+)
+
+func Test_NewTracer_Memory(t *testing.T) {
+	// Arrange
+	tracer, closer, err := sut.NewTracer(&sut.Settings{
+		ServiceName: "test",
+		Backend:     sut.Memory,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closer.Close()
+
+	// Act
+	tracer.StartSpan("operation").Finish()
+
+	// Assert
+	spans := tracer.(*mocktracer.MockTracer).FinishedSpans()
+	if assert.Len(t, spans, 1) {
+		assert.Equal(t, "operation", spans[0].OperationName)
+	}
+}
+
+func Test_NewTracer_Noop(t *testing.T) {
+	// Act
+	tracer, closer, err := sut.NewTracer(&sut.Settings{
+		Backend: sut.Noop,
+	})
+
+	// Assert
+	assert.Nil(t, err)
+	assert.Equal(t, opentracing.NoopTracer{}, tracer)
+	assert.Nil(t, closer.Close())
+}
+
+func Test_NewTracer_JaegerUDP(t *testing.T) {
+	// Act
+	tracer, closer, err := sut.NewTracer(&sut.Settings{
+		ServiceName: "test",
+		AgentHost:   "localhost",
+		AgentPort:   6831,
+	})
+
+	// Assert
+	assert.Nil(t, err)
+	assert.IsType(t, &jaegerClient.Tracer{}, tracer)
+	assert.Nil(t, closer.Close())
+}
+
+func Test_NewTracer_JaegerHTTP_FlushesOnClose(t *testing.T) {
+	// Arrange
+	batches := make(chan []byte, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		batches <- body
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer collector.Close()
+
+	tracer, closer, err := sut.NewTracer(&sut.Settings{
+		ServiceName:       "test",
+		Backend:           sut.JaegerHTTP,
+		CollectorEndpoint: collector.URL,
+		Sampler:           jaegerClient.NewConstSampler(true),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tracer.StartSpan("operation").Finish()
+
+	// Act
+	err = closer.Close()
+
+	// Assert
+	assert.Nil(t, err)
+	select {
+	case batch := <-batches:
+		assert.Contains(t, string(batch), "operation")
+	default:
+		t.Fatal("expected the span to be sent to the collector")
+	}
+}
+
+func Test_NewTracer_JaegerHTTP_RequiresEndpoint(t *testing.T) {
+	// Act
+	_, _, err := sut.NewTracer(&sut.Settings{
+		ServiceName: "test",
+		Backend:     sut.JaegerHTTP,
+	})
+
+	// Assert
+	assert.NotNil(t, err)
+}
+
+func Test_NewTracer_UnknownBackend(t *testing.T) {
+	// Act
+	_, _, err := sut.NewTracer(&sut.Settings{
+		ServiceName: "test",
+		Backend:     "zipkin",
+	})
+
+	// Assert
+	assert.NotNil(t, err)
+}